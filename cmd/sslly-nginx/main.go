@@ -30,10 +30,16 @@ func main() {
 		logger.Fatal("Failed to start application: %v", err)
 	}
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal, or for nginx supervision to give up
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case <-sigChan:
+	case err := <-application.Failed():
+		application.Stop()
+		// Exit non-zero so the container restart policy takes over.
+		logger.Fatal("nginx could not be kept running: %v", err)
+	}
 
 	logger.Info("Shutting down sslly-nginx...")
 	application.Stop()
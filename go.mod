@@ -4,7 +4,9 @@ go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	golang.org/x/crypto v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
 require golang.org/x/sys v0.13.0 // indirect
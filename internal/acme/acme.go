@@ -0,0 +1,345 @@
+// Package acme obtains and renews certificates from an ACME CA (Let's Encrypt,
+// Pebble, ...) using HTTP-01 challenges that nginx serves from a shared directory.
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/fsutil"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+const (
+	// StorageDir is the directory below the SSL directory that issued certificates are written to
+	StorageDir = "acme"
+
+	AccountKeyFile     = "account.key"
+	defaultRenewBefore = 30 * 24 * time.Hour
+	retryAfterFailure  = time.Hour
+	orderTimeout       = 5 * time.Minute
+)
+
+// Issuer requests certificates for domains that have no usable certificate and
+// renews the ones that are about to expire.
+type Issuer struct {
+	sslDir       string
+	challengeDir string
+
+	mu          sync.Mutex
+	cfg         config.ACMEConfig
+	renewBefore time.Duration
+	client      *xacme.Client
+	failures    map[string]time.Time
+}
+
+// NewIssuer returns an Issuer that stores certificates below sslDir/acme and writes
+// HTTP-01 challenge responses into challengeDir.
+func NewIssuer(sslDir, challengeDir string) *Issuer {
+	return &Issuer{
+		sslDir:       sslDir,
+		challengeDir: challengeDir,
+		renewBefore:  defaultRenewBefore,
+		failures:     make(map[string]time.Time),
+	}
+}
+
+// Configure applies acme.yaml settings. The ACME account is set up again when
+// the directory or contact changes.
+func (i *Issuer) Configure(cfg config.ACMEConfig) error {
+	renewBefore := defaultRenewBefore
+	if cfg.RenewBefore != "" {
+		d, err := time.ParseDuration(cfg.RenewBefore)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid renew_before %q: expected a positive duration like 720h", cfg.RenewBefore)
+		}
+		renewBefore = d
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if cfg.DirectoryURL != i.cfg.DirectoryURL || cfg.DirectoryCA != i.cfg.DirectoryCA || cfg.Email != i.cfg.Email {
+		i.client = nil
+		i.failures = make(map[string]time.Time)
+	}
+	i.cfg = cfg
+	i.renewBefore = renewBefore
+	return nil
+}
+
+// DueDomains returns the domains that need a certificate: no certificate covers them,
+// or the one that does expires within renew_before. Wildcards and IP addresses cannot
+// be validated over HTTP-01 and are skipped, as are domains that failed recently.
+func (i *Issuer) DueDomains(domains []string, certMap map[string]ssl.Certificate, now time.Time) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var due []string
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if !isIssuable(domain) {
+			continue
+		}
+		if failedAt, ok := i.failures[domain]; ok && now.Sub(failedAt) < retryAfterFailure {
+			continue
+		}
+		if cert, ok := ssl.FindCertificate(certMap, domain); ok && cert.NotAfter.Sub(now) > i.renewBefore {
+			continue
+		}
+		due = append(due, domain)
+	}
+	sort.Strings(due)
+	return due
+}
+
+// isIssuable reports whether a public CA can validate the domain over HTTP-01
+func isIssuable(domain string) bool {
+	if domain == "" || strings.Contains(domain, "*") || !strings.Contains(domain, ".") {
+		return false
+	}
+	return net.ParseIP(domain) == nil
+}
+
+// Obtain orders a certificate for domain and writes it with its key below sslDir/acme/<domain>/.
+// A failure holds the domain back from DueDomains for a while.
+func (i *Issuer) Obtain(ctx context.Context, domain string) error {
+	err := i.obtain(ctx, domain)
+
+	i.mu.Lock()
+	if err != nil {
+		i.failures[domain] = time.Now()
+	} else {
+		delete(i.failures, domain)
+	}
+	i.mu.Unlock()
+	return err
+}
+
+func (i *Issuer) obtain(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, orderTimeout)
+	defer cancel()
+
+	client, err := i.accountClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(domain))
+	if err != nil {
+		return fmt.Errorf("create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("wait for order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("create certificate request: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalize order: %w", err)
+	}
+
+	return i.store(domain, chain, key)
+}
+
+// authorize completes the HTTP-01 challenge of one authorization
+func (i *Issuer) authorize(ctx context.Context, client *xacme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == xacme.StatusValid {
+		return nil
+	}
+
+	var chal *xacme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return fmt.Errorf("compute challenge response: %w", err)
+	}
+	if err := os.MkdirAll(i.challengeDir, 0755); err != nil {
+		return fmt.Errorf("create challenge directory: %w", err)
+	}
+	tokenPath := filepath.Join(i.challengeDir, filepath.Base(chal.Token))
+	if err := os.WriteFile(tokenPath, []byte(response), 0644); err != nil {
+		return fmt.Errorf("write challenge response: %w", err)
+	}
+	defer os.Remove(tokenPath)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization for %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// accountClient returns a client with a registered account, creating the account key on first use
+func (i *Issuer) accountClient(ctx context.Context) (*xacme.Client, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.client != nil {
+		return i.client, nil
+	}
+
+	key, err := loadOrCreateAccountKey(filepath.Join(i.sslDir, StorageDir, AccountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := directoryHTTPClient(i.cfg.DirectoryCA)
+	if err != nil {
+		return nil, err
+	}
+
+	directoryURL := i.cfg.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = xacme.LetsEncryptURL
+	}
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: directoryURL,
+		HTTPClient:   httpClient,
+		UserAgent:    "sslly-nginx",
+	}
+
+	account := &xacme.Account{}
+	if i.cfg.Email != "" {
+		account.Contact = []string{"mailto:" + i.cfg.Email}
+	}
+	if _, err := client.Register(ctx, account, xacme.AcceptTOS); err != nil && !errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register ACME account at %s: %w", directoryURL, err)
+	}
+	logger.Info("ACME account ready at %s", directoryURL)
+
+	i.client = client
+	return client, nil
+}
+
+// directoryHTTPClient trusts caFile in addition to the system roots, if set
+func directoryHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read directory_ca: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("directory_ca %s contains no PEM certificate", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+func loadOrCreateAccountKey(path string) (crypto.Signer, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("account key %s is not PEM", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse account key %s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encode account key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("write account key: %w", err)
+	}
+	return key, nil
+}
+
+// store writes the certificate chain and key where the SSL scanner picks them up. The
+// scanner pairs keys with certificates by public key, so on renewal the new key is
+// written under a second name, then the certificate is replaced and the key renamed
+// over the old one: a scan in between always finds a matching pair.
+func (i *Issuer) store(domain string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	dir := filepath.Join(i.sslDir, StorageDir, domain)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create %s: %w", dir, err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encode certificate key: %w", err)
+	}
+	nextKeyPath := filepath.Join(dir, domain+".next.key")
+	if err := fsutil.WriteFileAtomic(nextKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	var certPEM []byte
+	for _, c := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	if err := fsutil.WriteFileAtomic(filepath.Join(dir, domain+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(nextKeyPath, filepath.Join(dir, domain+".key")); err != nil {
+		return fmt.Errorf("rename %s: %w", nextKeyPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestIssuer_DueDomains(t *testing.T) {
+	now := time.Now()
+	i := NewIssuer(t.TempDir(), t.TempDir())
+	if err := i.Configure(config.ACMEConfig{Enabled: true, RenewBefore: "240h"}); err != nil {
+		t.Fatal(err)
+	}
+	i.failures["failed.example.com"] = now.Add(-time.Minute)
+	i.failures["failed-long-ago.example.com"] = now.Add(-2 * retryAfterFailure)
+
+	certs := map[string]ssl.Certificate{
+		"valid.example.com":    {CertPath: "/c.pem", KeyPath: "/c.key", NotAfter: now.Add(60 * 24 * time.Hour)},
+		"expiring.example.com": {CertPath: "/e.pem", KeyPath: "/e.key", NotAfter: now.Add(5 * 24 * time.Hour)},
+		"*.wild.example.com":   {CertPath: "/w.pem", KeyPath: "/w.key", NotAfter: now.Add(60 * 24 * time.Hour)},
+	}
+	domains := []string{
+		"valid.example.com",
+		"expiring.example.com",
+		"new.example.com",
+		"a.wild.example.com",
+		"*.other.example.com",
+		"10.0.0.1",
+		"localhost",
+		"failed.example.com",
+		"failed-long-ago.example.com",
+	}
+
+	got := i.DueDomains(domains, certs, now)
+	want := []string{"expiring.example.com", "failed-long-ago.example.com", "new.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DueDomains = %v, want %v", got, want)
+	}
+}
+
+func TestIssuer_ConfigureRejectsInvalidRenewBefore(t *testing.T) {
+	i := NewIssuer(t.TempDir(), t.TempDir())
+	if err := i.Configure(config.ACMEConfig{RenewBefore: "thirty days"}); err == nil {
+		t.Fatal("expected error for invalid renew_before")
+	}
+	if err := i.Configure(config.ACMEConfig{RenewBefore: "-1h"}); err == nil {
+		t.Fatal("expected error for negative renew_before")
+	}
+}
+
+func TestIssuer_StoredCertificateIsScanned(t *testing.T) {
+	sslDir := t.TempDir()
+	i := NewIssuer(sslDir, t.TempDir())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.store("example.com", [][]byte{der}, key); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	certs, err := ssl.ScanCertificates(sslDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := certs["example.com"]
+	if !ok {
+		t.Fatalf("stored certificate not found by scanner: %v", certs)
+	}
+	if want := filepath.Join(StorageDir, "example.com", "example.com.pem"); !strings.HasSuffix(cert.CertPath, want) {
+		t.Fatalf("unexpected cert path %s", cert.CertPath)
+	}
+	if !cert.NotAfter.Equal(notAfter) {
+		t.Fatalf("NotAfter = %v, want %v", cert.NotAfter, notAfter)
+	}
+}
+
+func TestIssuer_StoreReplacesPairOnRenewal(t *testing.T) {
+	sslDir := t.TempDir()
+	i := NewIssuer(sslDir, t.TempDir())
+
+	var last *ecdsa.PrivateKey
+	for serial := int64(1); serial <= 2; serial++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "example.com"},
+			DNSNames:     []string{"example.com"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Duration(serial) * 30 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.store("example.com", [][]byte{der}, key); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+		last = key
+	}
+
+	dir := filepath.Join(sslDir, StorageDir, "example.com")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "example.com.key,example.com.pem" {
+		t.Fatalf("unexpected files after renewal: %v", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "example.com.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	stored, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil || !stored.Equal(last) {
+		t.Fatalf("stored key is not the renewed key: %v", err)
+	}
+}
+
+func TestLoadOrCreateAccountKey_ReusesKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StorageDir, AccountKeyFile)
+	first, err := loadOrCreateAccountKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadOrCreateAccountKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.(*ecdsa.PrivateKey).Equal(second) {
+		t.Fatal("expected the stored account key to be reused")
+	}
+}
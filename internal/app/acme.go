@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/acme"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"github.com/hnrobert/sslly-nginx/internal/nginx"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// acmeCheckEvery is how often certificates are checked for issuance and renewal,
+// in addition to the check after every successful reload.
+const acmeCheckEvery = 12 * time.Hour
+
+// startACME runs the certificate issuance loop until Stop. It does nothing while
+// acme.yaml keeps ACME disabled; issued certificates land in ssl/acme/ and are
+// applied by the regular SSL watcher reload.
+func (a *App) startACME() {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.acmeIssuer = acme.NewIssuer(sslDir, nginx.ACMEChallengeDir)
+	a.acmeTrigger = make(chan struct{}, 1)
+	a.acmeCancel = cancel
+	a.acmeDone = make(chan struct{})
+
+	go a.runACME(ctx)
+	a.triggerACME()
+}
+
+// triggerACME schedules a certificate check without blocking
+func (a *App) triggerACME() {
+	if a.acmeTrigger == nil {
+		return
+	}
+	select {
+	case a.acmeTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func (a *App) stopACME() {
+	if a.acmeCancel == nil {
+		return
+	}
+	a.acmeCancel()
+	<-a.acmeDone
+}
+
+func (a *App) runACME(ctx context.Context) {
+	defer close(a.acmeDone)
+	ticker := time.NewTicker(acmeCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.acmeTrigger:
+		case <-ticker.C:
+		}
+		a.checkACME(ctx)
+	}
+}
+
+// checkACME requests certificates for configured domains that lack a valid one
+func (a *App) checkACME(ctx context.Context) {
+	a.reloadMu.Lock()
+	cfg := a.config
+	// Local CA certificates only stand in until a real one is issued.
+	certMap := make(map[string]ssl.Certificate, len(a.activeCertMap))
+	for domain, cert := range a.activeCertMap {
+		if !a.localCADomains[domain] {
+			certMap[domain] = cert
+		}
+	}
+	a.reloadMu.Unlock()
+	if cfg == nil || !cfg.ACME.Enabled {
+		return
+	}
+	if err := a.acmeIssuer.Configure(cfg.ACME); err != nil {
+		logger.Error("ACME disabled: %v", err)
+		return
+	}
+
+	var domains []string
+	for domain := range collectBaseDomains(cfg) {
+		domains = append(domains, domain)
+	}
+	for _, domain := range a.acmeIssuer.DueDomains(domains, certMap, time.Now()) {
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Info("ACME: requesting certificate for %s", domain)
+		if err := a.acmeIssuer.Obtain(ctx, domain); err != nil {
+			logger.Warn("ACME: certificate for %s failed (retrying later): %v", domain, err)
+			continue
+		}
+		logger.Info("ACME: certificate for %s issued", domain)
+	}
+}
@@ -1,11 +1,13 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/hnrobert/sslly-nginx/internal/acme"
 	"github.com/hnrobert/sslly-nginx/internal/backup"
 	"github.com/hnrobert/sslly-nginx/internal/config"
 	"github.com/hnrobert/sslly-nginx/internal/logger"
@@ -30,6 +32,11 @@ type App struct {
 	lastGoodConf        string
 	activeCertMap       map[string]ssl.Certificate
 	sslReport           ssl.ScanReport
+	scanCache           *ssl.ScanCache
+	mappingIssues       mappingIssues
+	localCADomains      map[string]bool
+	nextCertEvent       time.Time
+	expiryAlerts        expiryAlerts
 	backupManager       *backup.Manager
 	staticSites         map[string]*runningStaticSite
 	reloadMu            sync.Mutex
@@ -41,13 +48,51 @@ type App struct {
 	reloadDebounceMu    sync.Mutex
 	reloadDebounceTimer *time.Timer
 	reloadDebounceSeq   uint64
+
+	// ACME issuance loop (see acme.go)
+	acmeIssuer  *acme.Issuer
+	acmeTrigger chan struct{}
+	acmeCancel  context.CancelFunc
+	acmeDone    chan struct{}
+
+	// certificate expiry monitor (see expiry.go)
+	expiryWake   chan struct{}
+	expiryCancel context.CancelFunc
+	expiryDone   chan struct{}
 }
 
 func New() (*App, error) {
-	return &App{
+	a := &App{
 		nginxManager: nginx.NewManager(),
 		staticSites:  make(map[string]*runningStaticSite),
-	}, nil
+	}
+	a.nginxManager.BeforeRestart = a.restoreForNginxRestart
+	return a, nil
+}
+
+// Failed is signalled when nginx can no longer be kept running
+func (a *App) Failed() <-chan error {
+	return a.nginxManager.Failed()
+}
+
+// restoreForNginxRestart puts the last-good runtime snapshot back in place before the
+// supervisor restarts a crashed nginx master.
+func (a *App) restoreForNginxRestart() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	if a.backupManager == nil {
+		return nil
+	}
+	a.suppressNginxWatch()
+	if err := a.backupManager.RestoreLastGood(); err != nil {
+		return fmt.Errorf("restore last-good snapshot: %w", err)
+	}
+	if err := a.reRegisterRuntimeNginxWatcher(); err != nil {
+		logger.Warn("failed to re-register runtime nginx.conf watcher: %v", err)
+	}
+	logger.Info("Restored last-good configuration snapshot for nginx restart")
+	return nil
 }
 
 func (a *App) Start() error {
@@ -124,7 +169,7 @@ func (a *App) Start() error {
 	}
 
 	// Print a single summary after everything is successfully applied.
-	logDomainSummary(a.config, a.activeCertMap, a.sslReport, time.Now())
+	logDomainSummary(a.config, a.activeCertMap, a.sslReport, a.mappingIssues, time.Now())
 
 	// Save the good configuration
 	a.saveGoodConfiguration()
@@ -134,6 +179,10 @@ func (a *App) Start() error {
 		return fmt.Errorf("failed to setup watchers: %w", err)
 	}
 
+	// Request missing certificates once watchers can apply them
+	a.startACME()
+	a.startExpiryMonitor()
+
 	logger.Info("Application started successfully")
 	return nil
 }
@@ -148,12 +197,15 @@ func (a *App) Stop() {
 	if a.runtimeNginxWatcher != nil {
 		a.runtimeNginxWatcher.Close()
 	}
-	a.stopAllStaticSites()
 	a.reloadDebounceMu.Lock()
 	if a.reloadDebounceTimer != nil {
 		a.reloadDebounceTimer.Stop()
 		a.reloadDebounceTimer = nil
 	}
 	a.reloadDebounceMu.Unlock()
+	a.stopACME()
+	a.stopExpiryMonitor()
+	// Drain nginx first: static site servers are its upstreams.
 	a.nginxManager.Stop()
+	a.stopAllStaticSites()
 }
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// certSelectionPolicy builds the duplicate-certificate policy from certs.yaml.
+// Invalid entries are dropped and reported in the returned error.
+func certSelectionPolicy(cfg *config.Config) (ssl.SelectionPolicy, error) {
+	policy := ssl.SelectionPolicy{}
+	if cfg == nil || len(cfg.Certs.Prefer) == 0 {
+		return policy, nil
+	}
+
+	var problems []string
+	policy.Prefer = make(map[string]ssl.Preference, len(cfg.Certs.Prefer))
+	for pattern, pref := range cfg.Certs.Prefer {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		keyType := strings.ToLower(strings.TrimSpace(pref.KeyType))
+		switch keyType {
+		case "", ssl.KeyTypeRSA, ssl.KeyTypeECDSA, ssl.KeyTypeEd25519:
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown key_type %q (expected rsa, ecdsa or ed25519)", pattern, pref.KeyType))
+			continue
+		}
+		if pattern == "" || (pref.Issuer == "" && keyType == "") {
+			continue
+		}
+		policy.Prefer[pattern] = ssl.Preference{Issuer: strings.TrimSpace(pref.Issuer), KeyType: keyType}
+	}
+
+	if len(problems) > 0 {
+		return policy, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return policy, nil
+}
@@ -0,0 +1,25 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestCertSelectionPolicy(t *testing.T) {
+	cfg := &config.Config{Certs: config.CertsConfig{Prefer: map[string]config.CertPreference{
+		"Example.COM": {Issuer: "Let's Encrypt", KeyType: "ECDSA"},
+		"*.lan":       {KeyType: "dsa"},
+		"empty.com":   {},
+	}}}
+
+	policy, err := certSelectionPolicy(cfg)
+	if err == nil {
+		t.Fatalf("expected an error for the unknown key type")
+	}
+	want := ssl.Preference{Issuer: "Let's Encrypt", KeyType: ssl.KeyTypeECDSA}
+	if len(policy.Prefer) != 1 || policy.Prefer["example.com"] != want {
+		t.Fatalf("unexpected policy: %+v", policy.Prefer)
+	}
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// clientAuthPathRe limits client_auth paths to characters that are safe in the nginx
+// regex that enforces them
+var clientAuthPathRe = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// stageClientAuth loads the CA bundles and CRLs of tls.yaml client_auth, writes them into
+// the stage and returns the entries pointing at their paths under current/. An entry
+// whose files are unusable keeps an empty CA, so nginx refuses its requests instead of
+// serving them unprotected.
+func stageClientAuth(snapshotID, sslDir string, entries map[string]config.ClientAuthConfig, now time.Time) (map[string]config.ClientAuthConfig, []string) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	stageDir, err := runtimeStageDirAbs(snapshotID)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	out := make(map[string]config.ClientAuthConfig, len(entries))
+	for _, key := range keys {
+		entry := entries[key]
+		name, ok := normalizeClientAuthKey(key)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected a domain, a wildcard pattern or domain/path (e.g. example.com/admin); entry ignored", key))
+			continue
+		}
+
+		switch mode := strings.ToLower(strings.TrimSpace(entry.Mode)); mode {
+		case "", config.ClientAuthRequired:
+			entry.Mode = config.ClientAuthRequired
+		case config.ClientAuthOptional:
+			entry.Mode = mode
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown mode %q, using required", key, entry.Mode))
+			entry.Mode = config.ClientAuthRequired
+		}
+
+		staged, crlNextUpdate, err := stageClientCA(entry, sslDir, stageDir, currentDir)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v; requests are refused", key, err))
+			entry.CA, entry.CRL = "", ""
+			out[name] = entry
+			continue
+		}
+		if !crlNextUpdate.IsZero() && crlNextUpdate.Before(now) {
+			problems = append(problems, fmt.Sprintf("%s: crl expired at %s; nginx refuses every client certificate until it is renewed", key, crlNextUpdate.Format(time.RFC3339)))
+		}
+		out[name] = staged
+	}
+	return out, problems
+}
+
+// normalizeClientAuthKey lowercases the domain of a client_auth key and drops a trailing
+// slash from its path
+func normalizeClientAuthKey(key string) (string, bool) {
+	key = strings.TrimSpace(key)
+	domain, path := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		domain, path = key[:i], strings.TrimRight(key[i:], "/")
+		if path == "" || !clientAuthPathRe.MatchString(path) || strings.HasPrefix(domain, "*") {
+			return "", false
+		}
+	}
+	domain = strings.ToLower(domain)
+	if domain == "" || strings.ContainsAny(domain, " \t;{}\"'") {
+		return "", false
+	}
+	return domain + path, true
+}
+
+// stageClientCA writes the CA bundle (and CRL) of entry as client-auth.<name>.ca.pem and
+// client-auth.<name>.crl.pem; entries naming the same files share them.
+func stageClientCA(entry config.ClientAuthConfig, sslDir, stageDir, currentDir string) (config.ClientAuthConfig, time.Time, error) {
+	if entry.CA == "" {
+		return entry, time.Time{}, fmt.Errorf("ca is required")
+	}
+	crlPath := ""
+	if entry.CRL != "" {
+		crlPath = sslRelativePath(sslDir, entry.CRL)
+	}
+	ca, err := ssl.LoadClientCA(sslRelativePath(sslDir, entry.CA), crlPath)
+	if err != nil {
+		return entry, time.Time{}, err
+	}
+
+	name := sanitizeDomainForFileName(entry.CA)
+	if entry.CRL != "" {
+		name += "+" + sanitizeDomainForFileName(entry.CRL)
+	}
+	caName := "client-auth." + name + ".ca.pem"
+	if err := os.WriteFile(filepath.Join(stageDir, "certs", caName), ca.PEM, 0666); err != nil {
+		return entry, time.Time{}, fmt.Errorf("write ca: %w", err)
+	}
+	entry.CA = filepath.Join(currentDir, "certs", caName)
+	entry.VerifyDepth = ca.Count
+	if ca.CRL != nil {
+		crlName := "client-auth." + name + ".crl.pem"
+		if err := os.WriteFile(filepath.Join(stageDir, "certs", crlName), ca.CRL, 0666); err != nil {
+			return entry, time.Time{}, fmt.Errorf("write crl: %w", err)
+		}
+		entry.CRL = filepath.Join(currentDir, "certs", crlName)
+	}
+	return entry, ca.CRLNextUpdate, nil
+}
+
+// sslRelativePath resolves a tls.yaml file path relative to the SSL directory
+func sslRelativePath(sslDir, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(sslDir, filepath.FromSlash(p))
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+)
+
+func TestNormalizeClientAuthKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+		ok   bool
+	}{
+		{"Dashboard.Example.com", "dashboard.example.com", true},
+		{"*.internal.example.com", "*.internal.example.com", true},
+		{"example.com/admin/", "example.com/admin", true},
+		{"example.com/Admin/v1", "example.com/Admin/v1", true},
+		{"example.com/", "", false},
+		{"example.com/a b", "", false},
+		{"example.com/a$", "", false},
+		{"*.example.com/admin", "", false},
+		{"/admin", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeClientAuthKey(tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeClientAuthKey(%q) = %q, %v; want %q, %v", tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStageClientAuth(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	sslDir := filepath.Join(tmp, "ssl")
+	writeTestSelfSigned(t, filepath.Join(sslDir, "clients", "ca.pem"), "", "Clients CA", true)
+	cfg := &config.Config{Ports: map[string][]string{"8000": {"dash.example.com"}}}
+	if _, err := stageRuntimeCertificates("snap1", cfg, nil); err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+
+	entries := map[string]config.ClientAuthConfig{
+		"Dash.example.com":   {CA: "clients/ca.pem"},
+		"example.com/admin/": {CA: "clients/ca.pem", Mode: "optional"},
+		"broken.example.com": {CA: "clients/missing.pem", Mode: "optional"},
+		"odd.example.com":    {CA: "clients/ca.pem", Mode: "sometimes"},
+	}
+	got, problems := stageClientAuth("snap1", sslDir, entries, time.Now())
+
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		t.Fatalf("current dir: %v", err)
+	}
+	staged := filepath.Join(currentDir, "certs", "client-auth.clients_ca.pem.ca.pem")
+	dash := got["dash.example.com"]
+	if dash.CA != staged || dash.Mode != config.ClientAuthRequired || dash.VerifyDepth != 1 {
+		t.Fatalf("unexpected dash.example.com entry: %+v", dash)
+	}
+	if admin := got["example.com/admin"]; admin.CA != staged || admin.Mode != config.ClientAuthOptional {
+		t.Fatalf("unexpected example.com/admin entry: %+v", admin)
+	}
+	if broken, ok := got["broken.example.com"]; !ok || broken.CA != "" {
+		t.Fatalf("an unusable entry must be kept without CA (refused by nginx): %+v", broken)
+	}
+	if odd := got["odd.example.com"]; odd.Mode != config.ClientAuthRequired {
+		t.Fatalf("an unknown mode must fall back to required: %+v", odd)
+	}
+	if len(problems) != 2 || !strings.Contains(problems[0], "broken.example.com") || !strings.Contains(problems[1], `unknown mode "sometimes"`) {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(stageDir, "certs", filepath.Base(staged))); err != nil {
+		t.Fatalf("expected the staged CA bundle: %v", err)
+	}
+}
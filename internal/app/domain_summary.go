@@ -1,6 +1,7 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -16,19 +17,48 @@ type domainEntry struct {
 	Destinations []string
 }
 
+type streamEntry struct {
+	Listener string
+	Targets  []string
+	Balance  config.StreamBalance
+	Unused   []config.UnusedStreamTarget
+	Problems []string // proxy.yaml keys of the listener that are not forwarded
+}
+
+// mappingIssues holds the proxy.yaml validation results of the last reload
+type mappingIssues struct {
+	Errors   []error
+	Warnings []*config.MappingWarning
+}
+
 type multipleCertEntry struct {
 	Domain   string
 	Selected string
 	NotAfter time.Time
 	Ignored  int
+	Reason   string // last selection decision, see ssl.MultipleCertificateReport
 }
 
-func logDomainSummary(cfg *config.Config, activeCertMap map[string]ssl.Certificate, report ssl.ScanReport, now time.Time) {
+func logDomainSummary(cfg *config.Config, activeCertMap map[string]ssl.Certificate, report ssl.ScanReport, issues mappingIssues, now time.Time) {
 	matched, missing, expired := classifyDomains(cfg, activeCertMap, now)
 	multiple := classifyMultipleCertificates(cfg, report)
+	chains := classifyChainIssues(cfg, activeCertMap)
+	ocspIssues := classifyOCSPIssues(cfg, activeCertMap)
 	all := len(matched) + len(missing) + len(expired)
 
 	logger.Info("Domain summary: total=%d matched=%d warning(no-cert)=%d warning(expired)=%d", all, len(matched), len(missing), len(expired))
+	if len(issues.Errors) > 0 {
+		logger.Error("%s", formatMappingErrorSection("Config errors (ignored):", issues.Errors))
+	}
+	if len(issues.Warnings) > 0 {
+		logger.Warn("%s", formatMappingWarningSection("Config warnings:", issues.Warnings))
+	}
+	if len(report.Unused) > 0 {
+		logger.Warn("%s", formatUnusedSSLFileSection("Unused/invalid SSL files:", report.Unused))
+	}
+	if len(report.Refused) > 0 {
+		logger.Warn("%s", formatRefusedNameSection("Refused wildcards:", report.Refused))
+	}
 	if all == 0 {
 		return
 	}
@@ -45,6 +75,129 @@ func logDomainSummary(cfg *config.Config, activeCertMap map[string]ssl.Certifica
 	if len(multiple) > 0 {
 		logger.Warn("%s", formatMultipleCertSection("Multiple-certs:", multiple))
 	}
+	if len(chains) > 0 {
+		logger.Warn("%s", formatChainSection("Chain:", chains))
+	}
+	if len(ocspIssues) > 0 {
+		logger.Warn("%s", formatChainSection("OCSP:", ocspIssues))
+	}
+	logStreamSummary(cfg)
+}
+
+func logStreamSummary(cfg *config.Config) {
+	streams := classifyStreams(cfg)
+	if len(streams) == 0 {
+		return
+	}
+	logger.Info("%s", formatStreamSection("Streams:", streams))
+
+	var unused, problems []streamEntry
+	for _, e := range streams {
+		if len(e.Unused) > 0 {
+			unused = append(unused, e)
+		}
+		if len(e.Problems) > 0 {
+			problems = append(problems, e)
+		}
+	}
+	if len(unused) > 0 {
+		logger.Warn("%s", formatUnusedStreamTargetSection("Unused stream targets:", unused))
+	}
+	if len(problems) > 0 {
+		logger.Warn("%s", formatStreamProblemSection("Ignored stream mappings:", problems))
+	}
+}
+
+func formatMappingErrorSection(header string, errs []error) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, err := range errs {
+		var me *config.MappingError
+		if errors.As(err, &me) {
+			b.WriteString("\n  - " + formatMappingLocation(me.Key, me.Value) + ": " + me.Message)
+			continue
+		}
+		b.WriteString("\n  - " + err.Error())
+	}
+	return b.String()
+}
+
+func formatMappingWarningSection(header string, warnings []*config.MappingWarning) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, w := range warnings {
+		b.WriteString("\n  - " + formatMappingLocation(w.Key, w.Value) + ": " + w.Message)
+	}
+	return b.String()
+}
+
+func formatMappingLocation(key, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + " -> " + value
+}
+
+func formatStreamSection(header string, entries []streamEntry) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range entries {
+		b.WriteString("\n  - " + e.Listener + " -> ")
+		if len(e.Targets) == 0 {
+			b.WriteString("(no usable target)")
+		} else {
+			b.WriteString(strings.Join(e.Targets, ", "))
+		}
+		if e.Balance != "" && e.Balance != config.StreamBalanceRoundRobin {
+			b.WriteString(" [" + string(e.Balance) + "]")
+		}
+	}
+	return b.String()
+}
+
+func formatUnusedStreamTargetSection(header string, entries []streamEntry) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range entries {
+		for _, u := range e.Unused {
+			b.WriteString(fmt.Sprintf("\n  - %s: %s (%s)", e.Listener, u.Target, u.Reason))
+		}
+	}
+	return b.String()
+}
+
+func formatStreamProblemSection(header string, entries []streamEntry) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range entries {
+		for _, p := range e.Problems {
+			b.WriteString("\n  - " + p)
+		}
+	}
+	return b.String()
+}
+
+// classifyStreams resolves every TCP/UDP mapping the same way nginx.GenerateConfig does,
+// keeping the targets that had to be dropped for reporting.
+func classifyStreams(cfg *config.Config) []streamEntry {
+	if cfg == nil {
+		return nil
+	}
+	var out []streamEntry
+	for _, l := range config.ResolveStreams(cfg.Ports) {
+		listener := "<" + string(l.Listen.Protocol) + ">" + l.Listen.Port
+		if l.Listen.Host != "" {
+			listener = "<" + string(l.Listen.Protocol) + ">" + l.Listen.Host + "|" + l.Listen.Port
+		}
+		entry := streamEntry{Listener: listener, Balance: l.Balance, Unused: l.Unused, Problems: l.Problems}
+		for _, up := range l.Targets {
+			dest := formatUpstreamDestination(up)
+			entry.Targets = append(entry.Targets, strings.TrimPrefix(dest, up.Scheme+"://"))
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Listener < out[j].Listener })
+	return out
 }
 
 func formatDomainSection(header string, entries []domainEntry) string {
@@ -90,6 +243,9 @@ func formatMultipleCertSection(header string, entries []multipleCertEntry) strin
 		if e.Ignored > 0 {
 			line += fmt.Sprintf(" (ignored other %d)", e.Ignored)
 		}
+		if e.Reason != "" {
+			line += "\n      why: " + e.Reason
+		}
 		b.WriteString(line)
 	}
 	return b.String()
@@ -102,13 +258,12 @@ func classifyDomains(cfg *config.Config, activeCertMap map[string]ssl.Certificat
 	// Build a map from baseDomain to all its domainPaths
 	domainPaths := make(map[string][]string)
 	if cfg != nil {
-		for _, paths := range cfg.Ports {
+		for key, paths := range cfg.Ports {
+			if config.IsStreamKey(key) {
+				continue
+			}
 			for _, domainPath := range paths {
-				base := domainPath
-				if idx := strings.Index(base, "/"); idx > 0 {
-					base = base[:idx]
-				}
-				base = strings.ToLower(strings.TrimSpace(base))
+				base := config.ParseHTTPListener(domainPath).Domain
 				if base == "" {
 					continue
 				}
@@ -165,15 +320,27 @@ func classifyMultipleCertificates(cfg *config.Config, report ssl.ScanReport) []m
 			continue
 		}
 		selected := rep.Selected.CertPath
+		// Everything not served (as the selected or an additional certificate) is ignored.
+		served := map[string]bool{strings.ToLower(rep.Selected.CertPath): true}
+		for _, extra := range rep.Selected.Additional {
+			served[strings.ToLower(extra.CertPath)] = true
+		}
 		ignored := 0
-		if n := len(rep.All); n > 1 {
-			ignored = n - 1
+		for _, c := range rep.All {
+			if !served[strings.ToLower(c.CertPath)] {
+				ignored++
+			}
+		}
+		reason := ""
+		if n := len(rep.Decisions); n > 0 {
+			reason = rep.Decisions[n-1]
 		}
 		out = append(out, multipleCertEntry{
 			Domain:   d,
 			Selected: selected,
 			NotAfter: rep.Selected.NotAfter,
 			Ignored:  ignored,
+			Reason:   reason,
 		})
 	}
 
@@ -181,6 +348,54 @@ func classifyMultipleCertificates(cfg *config.Config, report ssl.ScanReport) []m
 	return out
 }
 
+// chainEntry is a served certificate whose chain needed fixing or is not trusted, or
+// whose OCSP response is not stapled
+type chainEntry struct {
+	Domain string
+	Issue  string
+}
+
+func classifyChainIssues(cfg *config.Config, activeCertMap map[string]ssl.Certificate) []chainEntry {
+	return classifyCertificateIssues(cfg, activeCertMap, func(c ssl.Certificate) string { return c.ChainIssue })
+}
+
+func classifyOCSPIssues(cfg *config.Config, activeCertMap map[string]ssl.Certificate) []chainEntry {
+	return classifyCertificateIssues(cfg, activeCertMap, func(c ssl.Certificate) string { return c.OCSPIssue })
+}
+
+// classifyCertificateIssues lists issueOf for every served certificate that has one
+func classifyCertificateIssues(cfg *config.Config, activeCertMap map[string]ssl.Certificate, issueOf func(ssl.Certificate) string) []chainEntry {
+	var out []chainEntry
+	for domain := range collectBaseDomains(cfg) {
+		cert, ok := activeCertMap[domain]
+		if !ok {
+			continue
+		}
+		for i, c := range append([]ssl.Certificate{cert}, cert.Additional...) {
+			issue := issueOf(c)
+			if issue == "" {
+				continue
+			}
+			name := domain
+			if i > 0 {
+				name = fmt.Sprintf("%s (%s)", domain, c.KeyType)
+			}
+			out = append(out, chainEntry{Domain: name, Issue: issue})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return domainLess(out[i].Domain, out[j].Domain) })
+	return out
+}
+
+func formatChainSection(header string, entries []chainEntry) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, e := range entries {
+		b.WriteString("\n  - " + e.Domain + ": " + e.Issue)
+	}
+	return b.String()
+}
+
 // domainLess sorts by labels from TLD -> left, comparing each label by Unicode codepoint.
 // For domain/path entries, domain is compared first, then path.
 // Example ordering:
@@ -247,8 +462,10 @@ func collectDomainDestinations(cfg *config.Config) map[string][]string {
 
 	seen := make(map[string]map[string]struct{})
 	for portKey, domainPaths := range cfg.Ports {
-		up := config.ParseUpstream(portKey)
-		dest := formatUpstreamDestination(up)
+		if config.IsStreamKey(portKey) {
+			continue
+		}
+		targets, _ := config.ParseUpstreamTargets(portKey)
 		for _, domainPath := range domainPaths {
 			// Use full domainPath as key to preserve path information
 			key := strings.ToLower(strings.TrimSpace(domainPath))
@@ -258,7 +475,9 @@ func collectDomainDestinations(cfg *config.Config) map[string][]string {
 			if _, ok := seen[key]; !ok {
 				seen[key] = make(map[string]struct{})
 			}
-			seen[key][dest] = struct{}{}
+			for _, up := range targets {
+				seen[key][formatUpstreamDestination(up)] = struct{}{}
+			}
 		}
 	}
 
@@ -283,5 +502,8 @@ func formatUpstreamDestination(up config.Upstream) string {
 	if up.Path != "" {
 		dest += up.Path
 	}
+	if params := up.ServerParams(); params != "" {
+		dest += " (" + params + ")"
+	}
 	return dest
 }
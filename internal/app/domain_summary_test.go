@@ -145,3 +145,97 @@ func TestClassifyMultipleCertificates_ConfigDomainsOnlyAndSorted(t *testing.T) {
 		t.Fatalf("expected abc.de ignored=1, got %d", entries[1].Ignored)
 	}
 }
+
+func TestClassifyStreams_ReportsUnusedTargets(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{
+		"<tcp>9122": {"192.168.50.1|22", "192.168.50.2|22 weight=2", "ssh.internal"},
+		"1234":      {"abc.de"},
+	}}
+
+	streams := classifyStreams(cfg)
+	if len(streams) != 1 {
+		t.Fatalf("expected 1 stream entry, got %v", streams)
+	}
+	e := streams[0]
+	if e.Listener != "<tcp>9122" {
+		t.Fatalf("unexpected listener: %s", e.Listener)
+	}
+	if len(e.Targets) != 2 || e.Targets[0] != "192.168.50.1:22" || e.Targets[1] != "192.168.50.2:22 (weight=2)" {
+		t.Fatalf("unexpected targets: %v", e.Targets)
+	}
+	if len(e.Unused) != 1 || e.Unused[0].Target != "ssh.internal" {
+		t.Fatalf("unexpected unused targets: %v", e.Unused)
+	}
+
+	// Stream targets must not show up as domains.
+	if _, ok := collectBaseDomains(cfg)["192.168.50.1|22"]; ok {
+		t.Fatalf("stream target reported as domain")
+	}
+}
+
+func TestClassifyStreams_ReportsIgnoredKeys(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{
+		"<tcp>9122 balance=fast": {"192.168.50.1|22"},
+	}}
+
+	streams := classifyStreams(cfg)
+	if len(streams) != 1 || len(streams[0].Problems) != 1 {
+		t.Fatalf("expected the invalid key to be reported, got %+v", streams)
+	}
+	got := formatStreamProblemSection("Ignored stream mappings:", streams)
+	want := "Ignored stream mappings:\n  - <tcp>9122 balance=fast: unknown balance method \"fast\" (use round_robin, hash or least_conn)"
+	if got != want {
+		t.Fatalf("unexpected section:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFormatMappingErrorSection(t *testing.T) {
+	errs := []error{
+		&config.MappingError{Key: "3000", Value: "<tcp>bad.example.com", Message: "not compatible"},
+		&config.MappingError{Key: "10.0.0.1:99999", Message: "invalid upstream port"},
+	}
+
+	got := formatMappingErrorSection("Config errors (ignored):", errs)
+	want := "Config errors (ignored):\n" +
+		"  - 3000 -> <tcp>bad.example.com: not compatible\n" +
+		"  - 10.0.0.1:99999: invalid upstream port"
+	if got != want {
+		t.Fatalf("unexpected section:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestClassifyChainIssues(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{"3000": {"b.example.com", "a.example.com", "ok.example.com"}}}
+	active := map[string]ssl.Certificate{
+		"a.example.com":  {ChainIssue: "incomplete chain in file; completed with int.pem"},
+		"ok.example.com": {},
+		"b.example.com": {
+			KeyType:    ssl.KeyTypeECDSA,
+			Additional: []ssl.Certificate{{KeyType: ssl.KeyTypeRSA, ChainIssue: "misordered"}},
+		},
+		"unused.example.com": {ChainIssue: "ignored"},
+	}
+
+	entries := classifyChainIssues(cfg, active)
+	if len(entries) != 2 || entries[0].Domain != "a.example.com" || entries[1].Domain != "b.example.com (rsa)" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	want := "Chain:\n  - a.example.com: incomplete chain in file; completed with int.pem\n  - b.example.com (rsa): misordered"
+	if got := formatChainSection("Chain:", entries); got != want {
+		t.Fatalf("unexpected section:\n%s", got)
+	}
+}
+
+func TestClassifyOCSPIssues(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{"3000": {"a.example.com", "ok.example.com"}}}
+	active := map[string]ssl.Certificate{
+		"a.example.com":  {ChainIssue: "misordered", OCSPIssue: "a.pem.ocsp not used: stale since 2025-01-01T00:00:00Z (fetch a fresh response)"},
+		"ok.example.com": {OCSPPath: "/ok.pem.ocsp"},
+	}
+
+	entries := classifyOCSPIssues(cfg, active)
+	want := "OCSP:\n  - a.example.com: a.pem.ocsp not used: stale since 2025-01-01T00:00:00Z (fetch a fresh response)"
+	if got := formatChainSection("OCSP:", entries); got != want {
+		t.Fatalf("unexpected section:\n%s", got)
+	}
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+const defaultExpiryCheckInterval = time.Hour
+
+var defaultExpiryWarnDays = []int{30, 14, 3}
+
+// expiryAlert is one warning (or, when Expired, error) about a served certificate
+type expiryAlert struct {
+	Domain   string
+	NotAfter time.Time
+	Days     int // threshold that was crossed
+	Expired  bool
+}
+
+func (e expiryAlert) String() string {
+	if e.Expired {
+		return fmt.Sprintf("Certificate for %s expired at %s", e.Domain, e.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("Certificate for %s expires within %d days (at %s)", e.Domain, e.Days, e.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// expiryAlerts remembers the alerts already raised, so each threshold is reported once
+// per certificate.
+type expiryAlerts struct {
+	raised map[string]expiryAlert
+}
+
+// evaluate returns the alerts that became due for the active certificates
+func (s *expiryAlerts) evaluate(active map[string]ssl.Certificate, warnDays []int, now time.Time) []expiryAlert {
+	if s.raised == nil {
+		s.raised = make(map[string]expiryAlert)
+	}
+
+	var alerts []expiryAlert
+	served := make(map[string]bool)
+	for domain, cert := range active {
+		for i, c := range append([]ssl.Certificate{cert}, cert.Additional...) {
+			name := domain
+			if i > 0 {
+				// Certificates served alongside the primary one, e.g. "example.com (rsa)".
+				name = fmt.Sprintf("%s (%s)", domain, c.KeyType)
+			}
+			served[name] = true
+			if c.NotAfter.IsZero() {
+				continue
+			}
+			alert, due := expiryAlertFor(name, c.NotAfter, warnDays, now)
+			if !due {
+				continue
+			}
+			if prev, ok := s.raised[name]; ok && prev.NotAfter.Equal(alert.NotAfter) {
+				// Same certificate: only escalate to a smaller threshold or to expired.
+				if prev.Expired || (!alert.Expired && prev.Days <= alert.Days) {
+					continue
+				}
+			}
+			s.raised[name] = alert
+			alerts = append(alerts, alert)
+		}
+	}
+	for name := range s.raised {
+		if !served[name] {
+			delete(s.raised, name)
+		}
+	}
+
+	sort.Slice(alerts, func(i, j int) bool { return domainLess(alerts[i].Domain, alerts[j].Domain) })
+	return alerts
+}
+
+// expiryAlertFor finds the smallest threshold (in days) that notAfter is within
+func expiryAlertFor(domain string, notAfter time.Time, warnDays []int, now time.Time) (expiryAlert, bool) {
+	alert := expiryAlert{Domain: domain, NotAfter: notAfter}
+	if !notAfter.After(now) {
+		alert.Expired = true
+		return alert, true
+	}
+	left := notAfter.Sub(now)
+	due := false
+	for _, days := range warnDays {
+		if left <= time.Duration(days)*24*time.Hour && (!due || days < alert.Days) {
+			alert.Days = days
+			due = true
+		}
+	}
+	return alert, due
+}
+
+// expirySettings resolves the expiry section of logs.yaml
+func expirySettings(cfg *config.Config) (warnDays []int, interval time.Duration, err error) {
+	warnDays, interval = defaultExpiryWarnDays, defaultExpiryCheckInterval
+	if cfg == nil {
+		return warnDays, interval, nil
+	}
+	exp := cfg.Log.Expiry
+	if len(exp.WarnDays) > 0 {
+		for _, d := range exp.WarnDays {
+			if d <= 0 {
+				return defaultExpiryWarnDays, interval, fmt.Errorf("invalid expiry warn_days %v: days must be positive", exp.WarnDays)
+			}
+		}
+		warnDays = exp.WarnDays
+	}
+	if exp.CheckInterval != "" {
+		d, perr := time.ParseDuration(exp.CheckInterval)
+		if perr != nil || d <= 0 {
+			return warnDays, interval, fmt.Errorf("invalid expiry check_interval %q: expected a duration like 1h", exp.CheckInterval)
+		}
+		interval = d
+	}
+	return warnDays, interval, nil
+}
+
+// nextCertificateEvent returns the earliest moment after now at which the certificate
+// choice can change: a served certificate or its stapled OCSP response expires, or a
+// scanned certificate becomes valid.
+func nextCertificateEvent(cfg *config.Config, scanned map[string]ssl.Certificate, report ssl.ScanReport, active map[string]ssl.Certificate, now time.Time) time.Time {
+	var next time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	for _, cert := range active {
+		consider(cert.NotAfter)
+		consider(cert.OCSPNextUpdate)
+		for _, extra := range cert.Additional {
+			consider(extra.NotAfter)
+			consider(extra.OCSPNextUpdate)
+		}
+	}
+	for domain := range collectBaseDomains(cfg) {
+		if cert, ok := ssl.FindCertificate(scanned, domain); ok {
+			consider(cert.NotBefore)
+		}
+		if rep, ok := report.Multiple[domain]; ok {
+			for _, cert := range rep.All {
+				consider(cert.NotBefore)
+			}
+		}
+	}
+	return next
+}
+
+// startExpiryMonitor re-evaluates the served certificates until Stop: it raises the
+// expiry alerts and reloads when a certificate expires or a newer one becomes valid.
+func (a *App) startExpiryMonitor() {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.expiryWake = make(chan struct{}, 1)
+	a.expiryCancel = cancel
+	a.expiryDone = make(chan struct{})
+	go a.runExpiryMonitor(ctx)
+}
+
+// wakeExpiryMonitor re-arms the monitor after the served certificates changed
+func (a *App) wakeExpiryMonitor() {
+	if a.expiryWake == nil {
+		return
+	}
+	select {
+	case a.expiryWake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *App) stopExpiryMonitor() {
+	if a.expiryCancel == nil {
+		return
+	}
+	a.expiryCancel()
+	<-a.expiryDone
+}
+
+func (a *App) runExpiryMonitor(ctx context.Context) {
+	defer close(a.expiryDone)
+	for {
+		a.checkCertificateExpiry(time.Now())
+
+		a.reloadMu.Lock()
+		_, wait, _ := expirySettings(a.config)
+		next := a.nextCertEvent
+		a.reloadMu.Unlock()
+		if !next.IsZero() {
+			// Fire just after the event so the new state is in effect.
+			if untilNext := time.Until(next) + time.Second; untilNext < wait {
+				wait = untilNext
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-a.expiryWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (a *App) checkCertificateExpiry(now time.Time) {
+	a.reloadMu.Lock()
+	warnDays, _, _ := expirySettings(a.config)
+	alerts := a.expiryAlerts.evaluate(a.activeCertMap, warnDays, now)
+	next := a.nextCertEvent
+	due := !next.IsZero() && !now.Before(next)
+	if due {
+		// The reload computes the next event again.
+		a.nextCertEvent = time.Time{}
+	}
+	a.reloadMu.Unlock()
+
+	for _, alert := range alerts {
+		if alert.Expired {
+			logger.Error("%s", alert)
+			continue
+		}
+		logger.Warn("%s", alert)
+	}
+
+	if due {
+		logger.Info("Certificate validity changed at %s, reloading to pick the best certificate", next.UTC().Format(time.RFC3339))
+		a.scheduleReload()
+	}
+}
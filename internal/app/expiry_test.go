@@ -0,0 +1,114 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestExpiryAlerts_RaisesEachThresholdOnce(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	warnDays := []int{30, 14, 3}
+	active := map[string]ssl.Certificate{
+		"a.example.com": {NotAfter: now.Add(20 * day)},
+		"b.example.com": {NotAfter: now.Add(90 * day)},
+	}
+
+	var alerts expiryAlerts
+	got := alerts.evaluate(active, warnDays, now)
+	if len(got) != 1 || got[0].Domain != "a.example.com" || got[0].Days != 30 {
+		t.Fatalf("expected one 30-day alert for a.example.com, got %+v", got)
+	}
+	if got := alerts.evaluate(active, warnDays, now.Add(time.Hour)); len(got) != 0 {
+		t.Fatalf("expected no repeated alert, got %+v", got)
+	}
+	// Jumping past two thresholds reports only the smallest one.
+	if got := alerts.evaluate(active, warnDays, now.Add(18*day)); len(got) != 1 || got[0].Days != 3 {
+		t.Fatalf("expected a 3-day alert, got %+v", got)
+	}
+	if got := alerts.evaluate(active, warnDays, now.Add(21*day)); len(got) != 1 || !got[0].Expired {
+		t.Fatalf("expected an expired alert, got %+v", got)
+	}
+	if got := alerts.evaluate(active, warnDays, now.Add(22*day)); len(got) != 0 {
+		t.Fatalf("expected expiry to be reported once, got %+v", got)
+	}
+
+	// A replaced certificate starts over.
+	active["a.example.com"] = ssl.Certificate{NotAfter: now.Add(40 * day)}
+	if got := alerts.evaluate(active, warnDays, now.Add(22*day)); len(got) != 1 || got[0].Days != 30 {
+		t.Fatalf("expected a fresh 30-day alert for the new certificate, got %+v", got)
+	}
+}
+
+func TestExpiryAlerts_AdditionalCertificates(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	active := map[string]ssl.Certificate{
+		"example.com": {
+			KeyType:    ssl.KeyTypeECDSA,
+			NotAfter:   now.Add(60 * day),
+			Additional: []ssl.Certificate{{KeyType: ssl.KeyTypeRSA, NotAfter: now.Add(10 * day)}},
+		},
+	}
+
+	var alerts expiryAlerts
+	got := alerts.evaluate(active, []int{14}, now)
+	if len(got) != 1 || got[0].Domain != "example.com (rsa)" || got[0].Days != 14 {
+		t.Fatalf("expected a 14-day alert for the RSA certificate, got %+v", got)
+	}
+	if got := alerts.evaluate(active, []int{14}, now.Add(time.Hour)); len(got) != 0 {
+		t.Fatalf("expected no repeated alert, got %+v", got)
+	}
+	if next := nextCertificateEvent(nil, nil, ssl.ScanReport{}, active, now); !next.Equal(now.Add(10 * day)) {
+		t.Fatalf("expected the RSA expiry as next event, got %v", next)
+	}
+}
+
+func TestNextCertificateEvent(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := &config.Config{Ports: map[string][]string{"3000": {"a.example.com", "b.example.com"}}}
+	active := map[string]ssl.Certificate{
+		"a.example.com": {NotBefore: now.Add(-time.Hour), NotAfter: now.Add(10 * 24 * time.Hour)},
+	}
+	scanned := map[string]ssl.Certificate{
+		"a.example.com": {NotBefore: now.Add(-time.Hour), NotAfter: now.Add(10 * 24 * time.Hour)},
+	}
+	report := ssl.ScanReport{Multiple: map[string]*ssl.MultipleCertificateReport{
+		"b.example.com": {All: []ssl.Certificate{
+			{NotBefore: now.Add(-time.Hour)},
+			{NotBefore: now.Add(48 * time.Hour)},
+		}},
+		"unused.example.com": {All: []ssl.Certificate{{NotBefore: now.Add(time.Hour)}}},
+	}}
+
+	got := nextCertificateEvent(cfg, scanned, report, active, now)
+	if want := now.Add(48 * time.Hour); !got.Equal(want) {
+		t.Fatalf("next event = %v, want %v (newer b.example.com certificate becomes valid)", got, want)
+	}
+
+	active["a.example.com"] = ssl.Certificate{NotAfter: now.Add(10 * 24 * time.Hour), OCSPNextUpdate: now.Add(24 * time.Hour)}
+	if got := nextCertificateEvent(cfg, scanned, report, active, now); !got.Equal(now.Add(24 * time.Hour)) {
+		t.Fatalf("next event = %v, want the stapled OCSP response to go stale first", got)
+	}
+}
+
+func TestExpirySettings(t *testing.T) {
+	warnDays, interval, err := expirySettings(&config.Config{})
+	if err != nil || interval != time.Hour || len(warnDays) != 3 {
+		t.Fatalf("unexpected defaults: %v %v %v", warnDays, interval, err)
+	}
+
+	cfg := &config.Config{Log: config.LogConfig{Expiry: config.ExpiryAlertConfig{WarnDays: []int{7}, CheckInterval: "10m"}}}
+	warnDays, interval, err = expirySettings(cfg)
+	if err != nil || interval != 10*time.Minute || len(warnDays) != 1 || warnDays[0] != 7 {
+		t.Fatalf("unexpected settings: %v %v %v", warnDays, interval, err)
+	}
+
+	cfg.Log.Expiry.WarnDays = []int{0}
+	if _, _, err := expirySettings(cfg); err == nil {
+		t.Fatal("expected error for non-positive warn_days")
+	}
+}
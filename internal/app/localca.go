@@ -0,0 +1,54 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/localca"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// localCADir holds the local development CA and the leaves it signed.
+// Clients trust <localCADir>/root.pem.
+const localCADir = "./configs/.sslly-ca"
+
+// issueLocalCACertificates signs a certificate for every configured base domain
+// that localca.yaml covers and no scanned certificate matches.
+func issueLocalCACertificates(cfg *config.Config, certMap map[string]ssl.Certificate, now time.Time) (map[string]ssl.Certificate, error) {
+	validity := localca.DefaultLeafValidity
+	if cfg.LocalCA.Validity != "" {
+		d, err := time.ParseDuration(cfg.LocalCA.Validity)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid validity %q: expected a positive duration like 8760h", cfg.LocalCA.Validity)
+		}
+		validity = d
+	}
+
+	var ca *localca.CA
+	out := make(map[string]ssl.Certificate)
+	for domain := range collectBaseDomains(cfg) {
+		if _, ok := ssl.FindCertificate(certMap, domain); ok {
+			continue
+		}
+		if !localca.Matches(cfg.LocalCA.Domains, domain) {
+			continue
+		}
+		if ca == nil {
+			var err error
+			if ca, err = localca.Open(localCADir); err != nil {
+				return nil, err
+			}
+		}
+		cert, issued, err := ca.Leaf(domain, validity, now)
+		if err != nil {
+			return nil, err
+		}
+		if issued {
+			logger.Info("Local CA: signed certificate for %s (trust %s)", domain, ca.RootPath())
+		}
+		out[domain] = cert
+	}
+	return out, nil
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/hnrobert/sslly-nginx/internal/backup"
 	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/fsutil"
 	"github.com/hnrobert/sslly-nginx/internal/logger"
 	"github.com/hnrobert/sslly-nginx/internal/nginx"
 	"github.com/hnrobert/sslly-nginx/internal/ssl"
@@ -29,8 +30,6 @@ func (a *App) reload(snapshotID string) error {
 	success := false
 	defer func() { finalizeStatic(success) }()
 
-	a.config = effectiveCfg
-
 	// Apply log configuration
 	ssllyLevel := "info"
 	if cfg.Log.SSLLY.Level != "" {
@@ -56,25 +55,86 @@ func (a *App) reload(snapshotID string) error {
 	logger.SetSSLLYLevel(ssllyLevel)
 	logger.SetNginxLevel(nginxLevel)
 	logger.SetNginxStderrLevel(nginxStderrShow)
+	if _, _, err := expirySettings(cfg); err != nil {
+		logger.Warn("logs.yaml: %v; using defaults", err)
+	}
 
 	// Scan SSL certificates
-	certMap, report, err := ssl.ScanCertificatesWithReport(sslDir)
+	policy, err := certSelectionPolicy(cfg)
+	if err != nil {
+		logger.Warn("certs.yaml: %v", err)
+	}
+	if a.scanCache == nil {
+		if path, err := runtimeScanCachePath(); err == nil {
+			a.scanCache = ssl.OpenScanCache(path)
+		}
+	}
+	certMap, report, err := ssl.ScanCertificatesCached(sslDir, policy, a.scanCache)
 	if err != nil {
 		return fmt.Errorf("failed to scan certificates: %w", err)
 	}
-	a.sslReport = report
+	report.Unused = sslFileIssues(effectiveCfg, certMap, report.Unused)
+	report.Refused = append(report.Refused, refusedWildcardMatches(effectiveCfg, certMap)...)
 
-	// Stage runtime cert cache for configured domains.
+	// Local CA: sign certificates for domains that still have none
+	var localCADomains map[string]bool
+	if cfg.LocalCA.Enabled {
+		localCerts, err := issueLocalCACertificates(effectiveCfg, certMap, time.Now())
+		if err != nil {
+			logger.Warn("Local CA: %v", err)
+		}
+		localCADomains = make(map[string]bool, len(localCerts))
+		for domain, cert := range localCerts {
+			certMap[domain] = cert
+			localCADomains[domain] = true
+		}
+	}
+
+	// Validate mappings and drop the failing ones, so one bad entry does not
+	// reject the whole reload. Errors are reported in the domain summary.
+	certDomains := make(map[string]bool, len(certMap))
+	for domain := range certMap {
+		certDomains[domain] = true
+	}
+	validMappings, mappingErrs, mappingWarnings := config.ValidateConfig(effectiveCfg, certDomains)
+	effectiveCfg = config.FilterValidMappings(effectiveCfg, validMappings)
+	if len(mappingErrs) > 0 {
+		logger.Warn("Config validation: %d mapping error(s), affected entries ignored (others continue)", len(mappingErrs))
+	}
+
+	if err := nginx.CheckTLSConfig(effectiveCfg.TLS); err != nil {
+		logger.Warn("tls.yaml: %v", err)
+	}
+	if path, err := ensureRuntimeDHParam(); err != nil {
+		logger.Warn("Failed to write DH parameters, ssl_dhparam not set: %v", err)
+	} else {
+		effectiveCfg.TLS.DHParamPath = path
+	}
+
+	// Stage runtime cert cache for configured domains. Until nginx.conf is swapped
+	// below, a failure drops the stage and leaves the app state of the last reload.
 	if snapshotID == "" {
 		snapshotID = time.Now().UTC().Format("20060102T150405.000000000Z")
 	}
-	activeCertMap, err := stageRuntimeCertificates(snapshotID, cfg, certMap)
+	defer func() {
+		if !success {
+			discardRuntimeStage(snapshotID)
+		}
+	}()
+	activeCertMap, err := stageRuntimeCertificates(snapshotID, effectiveCfg, certMap)
 	if err != nil {
 		return fmt.Errorf("failed to stage runtime certificates: %w", err)
 	}
-
-	// Keep the latest active cert map for summarized logging.
-	a.activeCertMap = activeCertMap
+	clientAuth, problems := stageClientAuth(snapshotID, sslDir, effectiveCfg.TLS.ClientAuth, time.Now())
+	for _, p := range problems {
+		logger.Warn("tls.yaml: client_auth: %s", p)
+	}
+	effectiveCfg.TLS.ClientAuth = clientAuth
+	upstreamTLS, problems := stageUpstreamTLS(snapshotID, sslDir, effectiveCfg.TLS.Upstreams, time.Now())
+	for _, p := range problems {
+		logger.Warn("tls.yaml: upstreams: %s", p)
+	}
+	effectiveCfg.TLS.Upstreams = upstreamTLS
 
 	// Generate nginx configuration
 	nginxConfig := nginx.GenerateConfig(effectiveCfg, activeCertMap)
@@ -83,6 +143,17 @@ func (a *App) reload(snapshotID string) error {
 	if err := writeRuntimeNginxConf(snapshotID, nginxConfig); err != nil {
 		return fmt.Errorf("failed to write runtime nginx.conf: %w", err)
 	}
+	// Test the staged config before anything is promoted; a failure leaves the
+	// runtime cache and the live nginx.conf untouched.
+	testConfPath, err := writeRuntimeTestNginxConf(snapshotID, nginxConfig)
+	if err != nil {
+		return fmt.Errorf("failed to write runtime test nginx.conf: %w", err)
+	}
+	if err := a.nginxManager.TestConfig(testConfPath); err != nil {
+		return fmt.Errorf("staged nginx.conf rejected: %w", err)
+	}
+	_ = os.Remove(testConfPath)
+
 	// Activate runtime cache for this snapshot so nginx -t / reload reads stable cert paths.
 	if err := activateRuntimeSnapshot(snapshotID); err != nil {
 		return fmt.Errorf("failed to activate runtime snapshot: %w", err)
@@ -109,11 +180,19 @@ func (a *App) reload(snapshotID string) error {
 	// Suppress nginx.conf watchers before writing.
 	a.suppressNginxWatch()
 
-	// Write nginx configuration
-	if err := os.WriteFile(nginxConf, []byte(nginxConfig), 0644); err != nil {
+	// Swap in the tested nginx configuration atomically
+	if err := fsutil.WriteFileAtomic(nginxConf, []byte(nginxConfig), 0644); err != nil {
 		return fmt.Errorf("failed to write nginx config: %w", err)
 	}
 
+	// Only now does the new configuration describe what nginx serves.
+	a.config = effectiveCfg
+	a.activeCertMap = activeCertMap
+	a.nextCertEvent = nextCertificateEvent(effectiveCfg, certMap, report, activeCertMap, time.Now())
+	a.sslReport = report
+	a.localCADomains = localCADomains
+	a.mappingIssues = mappingIssues{Errors: mappingErrs, Warnings: mappingWarnings}
+
 	logger.Info("Nginx configuration generated successfully")
 	success = true
 	return nil
@@ -179,8 +258,12 @@ func (a *App) handleReload() {
 	// Save the new good configuration
 	a.saveGoodConfiguration()
 
-	logDomainSummary(a.config, a.activeCertMap, a.sslReport, time.Now())
+	logDomainSummary(a.config, a.activeCertMap, a.sslReport, a.mappingIssues, time.Now())
 	logger.Info("Configuration reloaded successfully")
+
+	// Domains or acme.yaml may have changed
+	a.triggerACME()
+	a.wakeExpiryMonitor()
 }
 
 func (a *App) saveGoodConfiguration() {
@@ -211,7 +294,7 @@ func (a *App) restoreGoodConfiguration() {
 		return
 	}
 
-	if err := os.WriteFile(nginxConf, []byte(a.lastGoodConf), 0644); err != nil {
+	if err := fsutil.WriteFileAtomic(nginxConf, []byte(a.lastGoodConf), 0644); err != nil {
 		logger.Error("Failed to restore good configuration: %v", err)
 	} else {
 		logger.Info("Restored previous good configuration")
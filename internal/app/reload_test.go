@@ -0,0 +1,61 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/nginx"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestReload_RejectedStageKeepsStateAndIsDiscarded(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	for _, dir := range []string{"configs", "ssl"} {
+		if err := os.MkdirAll(filepath.Join(tmp, dir), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "configs", "proxy.yaml"), []byte("8000:\n  - example.com\n"), 0644); err != nil {
+		t.Fatalf("write proxy.yaml: %v", err)
+	}
+	// An nginx that rejects every configuration.
+	bin := filepath.Join(tmp, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "nginx"), []byte("#!/bin/sh\necho rejected >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("write nginx: %v", err)
+	}
+	t.Setenv("PATH", bin)
+
+	prevCfg := &config.Config{}
+	prevCerts := map[string]ssl.Certificate{"old.example.com": {CertPath: "/old.pem"}}
+	a := &App{nginxManager: &nginx.Manager{}, config: prevCfg, activeCertMap: prevCerts}
+
+	err = a.reload("snap1")
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the staged config to be rejected, got %v", err)
+	}
+	if a.config != prevCfg || len(a.activeCertMap) != 1 || a.activeCertMap["old.example.com"].CertPath != "/old.pem" {
+		t.Fatalf("expected the state of the last reload to be kept, got %+v / %v", a.config, a.activeCertMap)
+	}
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	if _, err := os.Stat(stageDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the stage to be discarded, stat: %v", err)
+	}
+}
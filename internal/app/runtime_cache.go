@@ -15,13 +15,13 @@ func collectBaseDomains(cfg *config.Config) map[string]struct{} {
 	if cfg == nil {
 		return out
 	}
-	for _, domainPaths := range cfg.Ports {
+	for key, domainPaths := range cfg.Ports {
+		// TCP/UDP mappings list forwarding targets, not domains.
+		if config.IsStreamKey(key) {
+			continue
+		}
 		for _, domainPath := range domainPaths {
-			base := domainPath
-			if idx := strings.Index(base, "/"); idx > 0 {
-				base = base[:idx]
-			}
-			base = strings.ToLower(strings.TrimSpace(base))
+			base := config.ParseHTTPListener(domainPath).Domain
 			if base == "" {
 				continue
 			}
@@ -51,6 +51,48 @@ func runtimeCurrentDirAbs() (string, error) {
 	return filepath.Join(root, "current"), nil
 }
 
+// runtimeScanCachePath is where parsed ssl/ files are kept between reloads
+func runtimeScanCachePath() (string, error) {
+	root, err := runtimeRootAbs()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, "scan-cache.json"), nil
+}
+
+// ffdhe2048PEM is the RFC 7919 ffdhe2048 group, the DH parameters the Mozilla TLS
+// guidelines recommend.
+const ffdhe2048PEM = `-----BEGIN DH PARAMETERS-----
+MIIBCAKCAQEA//////////+t+FRYortKmq/cViAnPTzx2LnFg84tNpWp4TZBFGQz
++8yTnc4kmz75fS/jY2MMddj2gbICrsRhetPfHtXV/WVhJDP1H18GbtCFY2VVPe0a
+87VXE15/V8k1mE8McODmi3fipona8+/och3xWKE2rec1MKzKT0g6eXq8CrGCsyT7
+YdEIqUuyyOP7uWrat2DX9GgdT0Kj3jlN9K5W7edjcrsZCwenyO4KbXCeAvzhzffi
+7MA0BM0oNC9hkXL+nOmFg/+OTxIy7vKBg8P+OxtMb61zO7X8vC7CIAXFjvGDfRaD
+ssbzSibBsu/6iGtCOGEoXJf//////////wIBAg==
+-----END DH PARAMETERS-----
+`
+
+// ensureRuntimeDHParam writes the ssl_dhparam file to the runtime directory once and
+// returns its path. An existing file is kept, so it can be replaced with the output
+// of `openssl dhparam`.
+func ensureRuntimeDHParam() (string, error) {
+	root, err := runtimeRootAbs()
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(root, "dhparam.pem")
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, []byte(ffdhe2048PEM), 0644); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
 func runtimeOldDirAbs() (string, error) {
 	root, err := runtimeRootAbs()
 	if err != nil {
@@ -120,34 +162,72 @@ func stageRuntimeCertificates(snapshotID string, cfg *config.Config, scanned map
 		}
 
 		safe := sanitizeDomainForFileName(baseDomain)
-		certExt := strings.ToLower(filepath.Ext(cert.CertPath))
-		if certExt == "" {
-			certExt = ".pem"
+		staged, err := stageCertificatePair(cert, stageDir, currentDir, safe)
+		if err != nil {
+			return nil, fmt.Errorf("stage certificate for %s: %w", baseDomain, err)
 		}
-		keyExt := strings.ToLower(filepath.Ext(cert.KeyPath))
-		if keyExt == "" {
-			keyExt = ".key"
+		staged.Additional = nil
+		for _, extra := range cert.Additional {
+			// e.g. example.com.rsa.cert.pem next to example.com.cert.pem
+			stagedExtra, err := stageCertificatePair(extra, stageDir, currentDir, safe+"."+extra.KeyType)
+			if err != nil {
+				return nil, fmt.Errorf("stage %s certificate for %s: %w", extra.KeyType, baseDomain, err)
+			}
+			staged.Additional = append(staged.Additional, stagedExtra)
 		}
+		active[baseDomain] = staged
+	}
+
+	return active, nil
+}
+
+// stageCertificatePair copies cert and its key into the stage as <name>.cert.<ext> and
+// <name>.key.<ext>, and returns cert with the paths they will have under current/.
+// Converted material is staged as <name>.cert.pem and <name>.key.key, the OCSP
+// response as <name>.ocsp.
+func stageCertificatePair(cert ssl.Certificate, stageDir, currentDir, name string) (ssl.Certificate, error) {
+	certExt := strings.ToLower(filepath.Ext(cert.CertPath))
+	if certExt == "" || cert.CertPEM != nil {
+		certExt = ".pem"
+	}
+	keyExt := strings.ToLower(filepath.Ext(cert.KeyPath))
+	if keyExt == "" || cert.KeyPEM != nil {
+		keyExt = ".key"
+	}
 
-		stageCertName := safe + ".cert" + certExt
-		stageKeyName := safe + ".key" + keyExt
-		stageCertPath := filepath.Join(stageDir, "certs", stageCertName)
-		stageKeyPath := filepath.Join(stageDir, "certs", stageKeyName)
-		if err := copyFileContents(cert.CertPath, stageCertPath); err != nil {
-			return nil, fmt.Errorf("copy cert for %s: %w", baseDomain, err)
+	stageCertName := name + ".cert" + certExt
+	stageKeyName := name + ".key" + keyExt
+	stageCertPath := filepath.Join(stageDir, "certs", stageCertName)
+	stageKeyPath := filepath.Join(stageDir, "certs", stageKeyName)
+
+	// Converted material (PKCS#12, encrypted keys) is written as plain PEM for nginx.
+	if cert.CertPEM != nil {
+		if err := os.WriteFile(stageCertPath, cert.CertPEM, 0666); err != nil {
+			return ssl.Certificate{}, fmt.Errorf("write cert: %w", err)
 		}
-		if err := copyFileContents(cert.KeyPath, stageKeyPath); err != nil {
-			return nil, fmt.Errorf("copy key for %s: %w", baseDomain, err)
+	} else if err := copyFileContents(cert.CertPath, stageCertPath); err != nil {
+		return ssl.Certificate{}, fmt.Errorf("copy cert: %w", err)
+	}
+	if cert.KeyPEM != nil {
+		if err := os.WriteFile(stageKeyPath, cert.KeyPEM, 0600); err != nil {
+			return ssl.Certificate{}, fmt.Errorf("write key: %w", err)
 		}
+	} else if err := copyFileContents(cert.KeyPath, stageKeyPath); err != nil {
+		return ssl.Certificate{}, fmt.Errorf("copy key: %w", err)
+	}
 
-		active[baseDomain] = ssl.Certificate{
-			CertPath: filepath.Join(currentDir, "certs", stageCertName),
-			KeyPath:  filepath.Join(currentDir, "certs", stageKeyName),
-			NotAfter: cert.NotAfter,
+	if cert.OCSPPath != "" {
+		stageOCSPName := name + ssl.OCSPExt
+		if err := copyFileContents(cert.OCSPPath, filepath.Join(stageDir, "certs", stageOCSPName)); err != nil {
+			return ssl.Certificate{}, fmt.Errorf("copy OCSP response: %w", err)
 		}
+		cert.OCSPPath = filepath.Join(currentDir, "certs", stageOCSPName)
 	}
 
-	return active, nil
+	cert.CertPath = filepath.Join(currentDir, "certs", stageCertName)
+	cert.KeyPath = filepath.Join(currentDir, "certs", stageKeyName)
+	cert.CertPEM, cert.KeyPEM = nil, nil
+	return cert, nil
 }
 
 func writeRuntimeNginxConf(snapshotID string, nginxConfig string) error {
@@ -162,6 +242,36 @@ func writeRuntimeNginxConf(snapshotID string, nginxConfig string) error {
 	return os.WriteFile(p, []byte(nginxConfig), 0666)
 }
 
+// writeRuntimeTestNginxConf writes a copy of the staged nginx.conf whose certificate paths
+// point into the stage instead of current/, so it can be checked with nginx -t before
+// anything is promoted. It returns the path of the copy.
+func writeRuntimeTestNginxConf(snapshotID string, nginxConfig string) (string, error) {
+	stageDir, err := runtimeStageDirAbs(snapshotID)
+	if err != nil {
+		return "", err
+	}
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		return "", err
+	}
+	testConfig := strings.ReplaceAll(nginxConfig, currentDir+string(filepath.Separator), stageDir+string(filepath.Separator))
+	p := filepath.Join(stageDir, "nginx", "nginx.test.conf")
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, []byte(testConfig), 0666); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// discardRuntimeStage removes a stage that will not be activated
+func discardRuntimeStage(snapshotID string) {
+	if stageDir, err := runtimeStageDirAbs(snapshotID); err == nil {
+		_ = os.RemoveAll(stageDir)
+	}
+}
+
 func activateRuntimeSnapshot(snapshotID string) error {
 	stageDir, err := runtimeStageDirAbs(snapshotID)
 	if err != nil {
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/pem"
 	"os"
 	"path/filepath"
 	"strings"
@@ -83,3 +84,280 @@ func TestStageRuntimeCertificates_DistinctNamesForPemCertAndKey(t *testing.T) {
 		t.Fatalf("staged key content mismatch")
 	}
 }
+
+func TestStageRuntimeCertificates_CopiesSymlinkTargets(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	archive := filepath.Join(tmp, "archive")
+	live := filepath.Join(tmp, "live")
+	for _, dir := range []string{archive, live} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certBody := "-----BEGIN CERTIFICATE-----\nCERT-DATA\n-----END CERTIFICATE-----\n"
+	if err := os.WriteFile(filepath.Join(archive, "fullchain1.pem"), []byte(certBody), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(archive, "privkey1.pem"), []byte("KEY"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../archive/fullchain1.pem", filepath.Join(live, "fullchain.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../archive/privkey1.pem", filepath.Join(live, "privkey.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Ports: map[string][]string{"8000": {"example.com"}}}
+	scanned := map[string]ssl.Certificate{
+		"example.com": {CertPath: filepath.Join(live, "fullchain.pem"), KeyPath: filepath.Join(live, "privkey.pem")},
+	}
+	if _, err := stageRuntimeCertificates("snap1", cfg, scanned); err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+
+	staged := filepath.Join(tmp, "configs", ".sslly-runtime", "stage", "snap1", "certs", "example.com.cert.pem")
+	info, err := os.Lstat(staged)
+	if err != nil {
+		t.Fatalf("stat staged cert: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("expected staged cert to be a regular file, got mode %v", info.Mode())
+	}
+	if data, _ := os.ReadFile(staged); string(data) != certBody {
+		t.Fatalf("staged cert content mismatch")
+	}
+}
+
+func TestWriteRuntimeTestNginxConf_PointsAtStage(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		t.Fatalf("current dir: %v", err)
+	}
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+
+	conf := "ssl_certificate " + filepath.Join(currentDir, "certs", "example.com.cert.pem") + ";\n"
+	p, err := writeRuntimeTestNginxConf("snap1", conf)
+	if err != nil {
+		t.Fatalf("writeRuntimeTestNginxConf error: %v", err)
+	}
+	if p != filepath.Join(stageDir, "nginx", "nginx.test.conf") {
+		t.Fatalf("unexpected test conf path: %s", p)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read test conf: %v", err)
+	}
+	want := "ssl_certificate " + filepath.Join(stageDir, "certs", "example.com.cert.pem") + ";\n"
+	if string(data) != want {
+		t.Fatalf("unexpected test conf:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestStageRuntimeCertificates_StagesAdditionalKeyTypes(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	for _, name := range []string{"ec.pem", "ec.key", "rsa.pem", "rsa.key"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(name), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	cfg := &config.Config{Ports: map[string][]string{"8000": {"example.com"}}}
+	scanned := map[string]ssl.Certificate{
+		"example.com": {
+			CertPath: filepath.Join(tmp, "ec.pem"),
+			KeyPath:  filepath.Join(tmp, "ec.key"),
+			KeyType:  ssl.KeyTypeECDSA,
+			Additional: []ssl.Certificate{{
+				CertPath: filepath.Join(tmp, "rsa.pem"),
+				KeyPath:  filepath.Join(tmp, "rsa.key"),
+				KeyType:  ssl.KeyTypeRSA,
+			}},
+		},
+	}
+
+	active, err := stageRuntimeCertificates("snap1", cfg, scanned)
+	if err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+	got := active["example.com"]
+	if len(got.Additional) != 1 {
+		t.Fatalf("expected one additional certificate, got %+v", got)
+	}
+	extra := got.Additional[0]
+	if filepath.Base(extra.CertPath) != "example.com.rsa.cert.pem" || extra.KeyType != ssl.KeyTypeRSA {
+		t.Fatalf("unexpected additional certificate: %+v", extra)
+	}
+
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	for _, name := range []string{"example.com.cert.pem", "example.com.rsa.cert.pem", "example.com.rsa.key.key"} {
+		if _, err := os.Stat(filepath.Join(stageDir, "certs", name)); err != nil {
+			t.Fatalf("expected staged %s: %v", name, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(stageDir, "certs", "example.com.rsa.key.key"))
+	if err != nil || string(data) != "rsa.key" {
+		t.Fatalf("unexpected staged rsa key: %q, %v", data, err)
+	}
+}
+
+func TestStageRuntimeCertificates_WritesConvertedMaterial(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	bundle := filepath.Join(tmp, "corp.pfx")
+	if err := os.WriteFile(bundle, []byte("PFX-DATA"), 0644); err != nil {
+		t.Fatalf("write bundle: %v", err)
+	}
+
+	cfg := &config.Config{Ports: map[string][]string{"8000": {"example.com"}}}
+	scanned := map[string]ssl.Certificate{
+		"example.com": {CertPath: bundle, KeyPath: bundle, CertPEM: []byte("CERT-PEM"), KeyPEM: []byte("KEY-PEM")},
+	}
+
+	active, err := stageRuntimeCertificates("snap1", cfg, scanned)
+	if err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+	got := active["example.com"]
+	if got.CertPEM != nil || got.KeyPEM != nil {
+		t.Fatalf("converted material should not be kept after staging")
+	}
+	if filepath.Base(got.CertPath) != "example.com.cert.pem" || filepath.Base(got.KeyPath) != "example.com.key.key" {
+		t.Fatalf("unexpected staged names: %s, %s", got.CertPath, got.KeyPath)
+	}
+
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	keyPath := filepath.Join(stageDir, "certs", "example.com.key.key")
+	data, err := os.ReadFile(keyPath)
+	if err != nil || string(data) != "KEY-PEM" {
+		t.Fatalf("unexpected staged key: %q, %v", data, err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("stat staged key: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected staged key mode 0600, got %v", info.Mode().Perm())
+	}
+	if data, err := os.ReadFile(filepath.Join(stageDir, "certs", "example.com.cert.pem")); err != nil || string(data) != "CERT-PEM" {
+		t.Fatalf("unexpected staged cert: %q, %v", data, err)
+	}
+}
+
+func TestStageRuntimeCertificates_CopiesOCSPResponse(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	for name, content := range map[string]string{"a.pem": "CERT", "a.key": "KEY", "a.pem.ocsp": "OCSP-DER"} {
+		if err := os.WriteFile(filepath.Join(tmp, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	cfg := &config.Config{Ports: map[string][]string{"8000": {"example.com"}}}
+	scanned := map[string]ssl.Certificate{
+		"example.com": {CertPath: filepath.Join(tmp, "a.pem"), KeyPath: filepath.Join(tmp, "a.key"), OCSPPath: filepath.Join(tmp, "a.pem.ocsp")},
+	}
+
+	active, err := stageRuntimeCertificates("snap1", cfg, scanned)
+	if err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		t.Fatalf("current dir: %v", err)
+	}
+	if got := active["example.com"].OCSPPath; got != filepath.Join(currentDir, "certs", "example.com.ocsp") {
+		t.Fatalf("unexpected staged OCSP path: %s", got)
+	}
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(stageDir, "certs", "example.com.ocsp")); err != nil || string(data) != "OCSP-DER" {
+		t.Fatalf("unexpected staged OCSP response: %q, %v", data, err)
+	}
+}
+
+func TestEnsureRuntimeDHParam_KeepsExistingFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	path, err := ensureRuntimeDHParam()
+	if err != nil {
+		t.Fatalf("ensureRuntimeDHParam error: %v", err)
+	}
+	block, _ := pem.Decode([]byte(ffdhe2048PEM))
+	if data, err := os.ReadFile(path); err != nil || block == nil || block.Type != "DH PARAMETERS" || string(data) != ffdhe2048PEM {
+		t.Fatalf("unexpected DH parameters at %s: %v", path, err)
+	}
+
+	if err := os.WriteFile(path, []byte("custom"), 0644); err != nil {
+		t.Fatalf("write custom parameters: %v", err)
+	}
+	if again, err := ensureRuntimeDHParam(); err != nil || again != path {
+		t.Fatalf("unexpected second call: %s, %v", again, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "custom" {
+		t.Fatalf("existing parameters were overwritten: %q", data)
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/acme"
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// sslFileIssues completes the scan's list of unused files: it drops files sslly-nginx
+// keeps in ssl/ itself and adds certificates that serve no configured domain.
+func sslFileIssues(cfg *config.Config, certMap map[string]ssl.Certificate, unused []ssl.FileIssue) []ssl.FileIssue {
+	accountKey := ""
+	if abs, err := filepath.Abs(sslDir); err == nil {
+		accountKey = filepath.Join(abs, acme.StorageDir, acme.AccountKeyFile)
+	}
+
+	var out []ssl.FileIssue
+	for _, u := range unused {
+		if u.Path != accountKey {
+			out = append(out, u)
+		}
+	}
+	out = append(out, unmatchedCertificates(cfg, certMap)...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// unmatchedCertificates returns the scanned certificates that no configured domain
+// uses, with the closest configured domain when a name looks like a near miss.
+func unmatchedCertificates(cfg *config.Config, certMap map[string]ssl.Certificate) []ssl.FileIssue {
+	baseDomains := collectBaseDomains(cfg)
+
+	served := make(map[string]bool)
+	for domain := range baseDomains {
+		if cert, ok := ssl.FindCertificate(certMap, domain); ok {
+			served[cert.CertPath] = true
+			for _, extra := range cert.Additional {
+				served[extra.CertPath] = true
+			}
+		}
+	}
+
+	names := make(map[string][]string) // CertPath -> domains it was selected for
+	for domain, cert := range certMap {
+		for _, c := range append([]ssl.Certificate{cert}, cert.Additional...) {
+			if !served[c.CertPath] {
+				names[c.CertPath] = append(names[c.CertPath], domain)
+			}
+		}
+	}
+
+	out := make([]ssl.FileIssue, 0, len(names))
+	for path, domains := range names {
+		sort.Slice(domains, func(i, j int) bool { return domainLess(domains[i], domains[j]) })
+		reason := "certificate matches no configured domain"
+		if hint := nearMissHint(domains, baseDomains); hint != "" {
+			reason += "; " + hint
+		}
+		out = append(out, ssl.FileIssue{Path: path, Reason: reason, Domains: domains})
+	}
+	return out
+}
+
+// refusedWildcardMatches explains configured domains that a wildcard certificate seems
+// to cover but does not, because a wildcard covers exactly one label.
+func refusedWildcardMatches(cfg *config.Config, certMap map[string]ssl.Certificate) []ssl.NameIssue {
+	var domains []string
+	for domain := range collectBaseDomains(cfg) {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domainLess(domains[i], domains[j]) })
+
+	var out []ssl.NameIssue
+	for _, domain := range domains {
+		if _, ok := ssl.FindCertificate(certMap, domain); ok {
+			continue
+		}
+		if pattern, cert, ok := ssl.FindRefusedWildcard(certMap, domain); ok {
+			out = append(out, ssl.NameIssue{
+				Path:   cert.CertPath,
+				Name:   pattern,
+				Reason: fmt.Sprintf("does not cover %s: a wildcard covers exactly one label", domain),
+			})
+		}
+	}
+	return out
+}
+
+// nearMissHint suggests the configured domain a certificate was probably meant for
+func nearMissHint(names []string, baseDomains map[string]struct{}) string {
+	best, bestName, bestDist := "", "", -1
+	for _, name := range names {
+		if apex := strings.TrimPrefix(name, "*."); apex != name {
+			if _, ok := baseDomains[apex]; ok {
+				return fmt.Sprintf("%s does not cover %s itself", name, apex)
+			}
+		}
+		for domain := range baseDomains {
+			d := editDistance(name, domain)
+			if d > len(name)/3 {
+				continue
+			}
+			if bestDist < 0 || d < bestDist || (d == bestDist && domainLess(domain, best)) {
+				best, bestName, bestDist = domain, name, d
+			}
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("did you mean %s (certificate has %s)?", best, bestName)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func formatUnusedSSLFileSection(header string, issues []ssl.FileIssue) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, u := range issues {
+		b.WriteString("\n  - " + u.Path)
+		if len(u.Domains) > 0 {
+			b.WriteString(" (" + strings.Join(u.Domains, ", ") + ")")
+		}
+		b.WriteString(": " + u.Reason)
+	}
+	return b.String()
+}
+
+func formatRefusedNameSection(header string, issues []ssl.NameIssue) string {
+	var b strings.Builder
+	b.WriteString(header)
+	for _, n := range issues {
+		b.WriteString(fmt.Sprintf("\n  - %s (%s): %s", n.Name, n.Path, n.Reason))
+	}
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/acme"
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestSSLFileIssues(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{
+		"8080": {"example.com", "api.example.com", "served.lan"},
+	}}
+	certMap := map[string]ssl.Certificate{
+		"served.lan":    {CertPath: "/ssl/served.pem"},
+		"*.served.lan":  {CertPath: "/ssl/served.pem"},
+		"exmaple.com":   {CertPath: "/ssl/typo.pem"},
+		"*.example.com": {CertPath: "/ssl/wildcard.pem"},
+		"other.org":     {CertPath: "/ssl/other.pem"},
+	}
+	abs, err := filepath.Abs(sslDir)
+	if err != nil {
+		t.Fatalf("abs: %v", err)
+	}
+	unused := []ssl.FileIssue{
+		{Path: filepath.Join(abs, acme.StorageDir, acme.AccountKeyFile), Reason: "private key without a matching certificate in ssl/"},
+		{Path: "/ssl/lonely.key", Reason: "private key without a matching certificate in ssl/"},
+	}
+
+	got := sslFileIssues(cfg, certMap, unused)
+	want := map[string]string{
+		"/ssl/lonely.key": "private key without a matching certificate",
+		"/ssl/typo.pem":   "did you mean example.com (certificate has exmaple.com)?",
+		"/ssl/other.pem":  "certificate matches no configured domain",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d issues, got %+v", len(want), got)
+	}
+	for _, u := range got {
+		reason, ok := want[u.Path]
+		if !ok {
+			t.Errorf("unexpected issue for %s: %s", u.Path, u.Reason)
+			continue
+		}
+		if !strings.Contains(u.Reason, reason) {
+			t.Errorf("%s: expected reason containing %q, got %q", u.Path, reason, u.Reason)
+		}
+		if u.Path == "/ssl/other.pem" && strings.Contains(u.Reason, "did you mean") {
+			t.Errorf("unexpected suggestion for an unrelated domain: %q", u.Reason)
+		}
+	}
+}
+
+func TestNearMissHint_WildcardDoesNotCoverApex(t *testing.T) {
+	base := map[string]struct{}{"example.com": {}}
+	hint := nearMissHint([]string{"*.example.com"}, base)
+	if hint != "*.example.com does not cover example.com itself" {
+		t.Fatalf("unexpected hint %q", hint)
+	}
+}
+
+func TestFormatUnusedSSLFileSection(t *testing.T) {
+	got := formatUnusedSSLFileSection("Unused/invalid SSL files:", []ssl.FileIssue{
+		{Path: "/ssl/a.pem", Reason: "certificate without a matching private key in ssl/", Domains: []string{"a.com", "www.a.com"}},
+		{Path: "/ssl/b.key", Reason: "encrypted private key: encrypted, but no password is configured"},
+	})
+	want := "Unused/invalid SSL files:\n" +
+		"  - /ssl/a.pem (a.com, www.a.com): certificate without a matching private key in ssl/\n" +
+		"  - /ssl/b.key: encrypted private key: encrypted, but no password is configured"
+	if got != want {
+		t.Fatalf("unexpected section:\n%s", got)
+	}
+}
+
+func TestRefusedWildcardMatches(t *testing.T) {
+	cfg := &config.Config{Ports: map[string][]string{
+		"8080": {"a.example.com", "x.y.example.com"},
+	}}
+	certMap := map[string]ssl.Certificate{
+		"*.example.com": {CertPath: "/ssl/wild.pem"},
+	}
+	got := refusedWildcardMatches(cfg, certMap)
+	if len(got) != 1 {
+		t.Fatalf("expected one refused match, got %+v", got)
+	}
+	want := ssl.NameIssue{Path: "/ssl/wild.pem", Name: "*.example.com", Reason: "does not cover x.y.example.com: a wildcard covers exactly one label"}
+	if got[0] != want {
+		t.Fatalf("unexpected refused match %+v", got[0])
+	}
+	if section := formatRefusedNameSection("Refused wildcards:", got); section != "Refused wildcards:\n  - *.example.com (/ssl/wild.pem): "+want.Reason {
+		t.Fatalf("unexpected section:\n%s", section)
+	}
+}
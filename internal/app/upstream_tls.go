@@ -0,0 +1,124 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// systemRootBundles are the CA bundles of common distributions, as searched by
+// crypto/x509; the image installs ca-certificates at the first one.
+var systemRootBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// stageUpstreamTLS writes the trusted certificates and client certificates of tls.yaml
+// upstreams into the stage and returns the entries pointing at their paths under
+// current/. Upstreams verified without ca use the system roots. An entry whose files are
+// unusable is marked Refused, so nginx does not reach the backend with weaker settings.
+func stageUpstreamTLS(snapshotID, sslDir string, entries map[string]config.UpstreamTLSConfig, now time.Time) (map[string]config.UpstreamTLSConfig, []string) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	stageDir, err := runtimeStageDirAbs(snapshotID)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	out := make(map[string]config.UpstreamTLSConfig, len(entries))
+	for _, key := range keys {
+		entry := entries[key]
+		// ca turns verification on unless verify says otherwise.
+		verify := entry.CA != ""
+		if entry.Verify != nil {
+			verify = *entry.Verify
+		}
+		entry.Verify = &verify
+
+		staged, notAfter, err := stageUpstreamFiles(entry, sslDir, stageDir, currentDir)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v; requests are refused", key, err))
+			entry.Refused = true
+			out[key] = entry
+			continue
+		}
+		if !notAfter.IsZero() && notAfter.Before(now) {
+			problems = append(problems, fmt.Sprintf("%s: cert expired at %s; the backend may refuse it", key, notAfter.Format(time.RFC3339)))
+		}
+		out[key] = staged
+	}
+	return out, problems
+}
+
+// stageUpstreamFiles stages the files of one entry as upstream.<name>.ca.pem and
+// upstream.<name>.cert/.key, and returns the expiry of its client certificate.
+func stageUpstreamFiles(entry config.UpstreamTLSConfig, sslDir, stageDir, currentDir string) (config.UpstreamTLSConfig, time.Time, error) {
+	switch {
+	case entry.CA != "":
+		data, err := ssl.LoadTrustedCertificates(sslRelativePath(sslDir, entry.CA))
+		if err != nil {
+			return entry, time.Time{}, fmt.Errorf("ca: %w", err)
+		}
+		caName := "upstream." + sanitizeDomainForFileName(entry.CA) + ".ca.pem"
+		if err := os.WriteFile(filepath.Join(stageDir, "certs", caName), data, 0666); err != nil {
+			return entry, time.Time{}, fmt.Errorf("write ca: %w", err)
+		}
+		entry.CA = filepath.Join(currentDir, "certs", caName)
+	case *entry.Verify:
+		roots := systemRootBundle()
+		if roots == "" {
+			return entry, time.Time{}, fmt.Errorf("no system CA bundle found (set ca)")
+		}
+		entry.CA = roots
+	}
+
+	if entry.Cert == "" {
+		return entry, time.Time{}, nil
+	}
+	cert, err := ssl.LoadKeyPair(sslDir, entry.Cert, entry.Key)
+	if err != nil {
+		return entry, time.Time{}, err
+	}
+	staged, err := stageCertificatePair(cert, stageDir, currentDir, "upstream."+sanitizeDomainForFileName(entry.Cert))
+	if err != nil {
+		return entry, time.Time{}, err
+	}
+	entry.Cert, entry.Key = staged.CertPath, staged.KeyPath
+	return entry, cert.NotAfter, nil
+}
+
+// systemRootBundle returns the system CA bundle nginx verifies upstreams against;
+// SSL_CERT_FILE overrides the search like it does for crypto/x509.
+func systemRootBundle() string {
+	candidates := systemRootBundles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		candidates = []string{f}
+	}
+	for _, p := range candidates {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
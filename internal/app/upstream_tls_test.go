@@ -0,0 +1,123 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+)
+
+// writeTestSelfSigned writes a self-signed certificate (and its key, when keyPath is set)
+func writeTestSelfSigned(t *testing.T, certPath, keyPath, name string, isCA bool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if keyPath == "" {
+		return
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+func TestStageUpstreamTLS(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	tmp := t.TempDir()
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	sslDir := filepath.Join(tmp, "ssl")
+	writeTestSelfSigned(t, filepath.Join(sslDir, "backends", "ca.pem"), "", "Backends CA", true)
+	writeTestSelfSigned(t, filepath.Join(sslDir, "backends", "client.pem"), filepath.Join(sslDir, "backends", "client.key"), "sslly", false)
+	roots := filepath.Join(tmp, "roots.pem")
+	writeTestSelfSigned(t, roots, "", "System Root", true)
+	t.Setenv("SSL_CERT_FILE", roots)
+
+	cfg := &config.Config{Ports: map[string][]string{"<https>api.internal:8443": {"a.example.com"}}}
+	if _, err := stageRuntimeCertificates("snap1", cfg, nil); err != nil {
+		t.Fatalf("stageRuntimeCertificates error: %v", err)
+	}
+
+	on, off := true, false
+	got, problems := stageUpstreamTLS("snap1", sslDir, map[string]config.UpstreamTLSConfig{
+		"api.internal:8443":  {CA: "backends/ca.pem", Cert: "backends/client.pem", Key: "backends/client.key"},
+		"public.example.com": {Verify: &on},
+		"legacy:8443":        {CA: "backends/ca.pem", Verify: &off},
+		"broken:8443":        {Cert: "backends/client.pem"},
+	}, time.Now())
+
+	currentDir, err := runtimeCurrentDirAbs()
+	if err != nil {
+		t.Fatalf("current dir: %v", err)
+	}
+	api := got["api.internal:8443"]
+	if api.CA != filepath.Join(currentDir, "certs", "upstream.backends_ca.pem.ca.pem") || api.Verify == nil || !*api.Verify ||
+		api.Cert != filepath.Join(currentDir, "certs", "upstream.backends_client.pem.cert.pem") ||
+		api.Key != filepath.Join(currentDir, "certs", "upstream.backends_client.pem.key.key") {
+		t.Fatalf("unexpected api.internal entry: %+v", api)
+	}
+	if public := got["public.example.com"]; public.CA != roots || public.Refused {
+		t.Fatalf("verification without ca must use the system roots: %+v", public)
+	}
+	if legacy := got["legacy:8443"]; legacy.Verify == nil || *legacy.Verify {
+		t.Fatalf("verify: false must win over ca: %+v", legacy)
+	}
+	if broken := got["broken:8443"]; !broken.Refused {
+		t.Fatalf("a client certificate without usable key must be refused: %+v", broken)
+	}
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "broken:8443: ") || !strings.HasSuffix(problems[0], "; requests are refused") {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+
+	stageDir, err := runtimeStageDirAbs("snap1")
+	if err != nil {
+		t.Fatalf("stage dir: %v", err)
+	}
+	for _, name := range []string{"upstream.backends_ca.pem.ca.pem", "upstream.backends_client.pem.cert.pem", "upstream.backends_client.pem.key.key"} {
+		if _, err := os.Stat(filepath.Join(stageDir, "certs", name)); err != nil {
+			t.Errorf("expected %s in the stage: %v", name, err)
+		}
+	}
+}
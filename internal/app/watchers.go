@@ -2,6 +2,8 @@ package app
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
@@ -31,6 +33,9 @@ func (a *App) setupWatchers() error {
 	}
 	a.sslWatcher = sslWatcher
 
+	configAccess := newReadability(configDir)
+	sslAccess := newReadability(sslDir)
+
 	// Handle config changes
 	go func() {
 		for {
@@ -45,11 +50,7 @@ func (a *App) setupWatchers() error {
 				if !isEffectiveConfigPath(event.Name) {
 					continue
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write ||
-					event.Op&fsnotify.Create == fsnotify.Create ||
-					event.Op&fsnotify.Rename == fsnotify.Rename ||
-					event.Op&fsnotify.Remove == fsnotify.Remove ||
-					event.Op&fsnotify.Chmod == fsnotify.Chmod {
+				if configAccess.relevant(event) {
 					logger.Info("Config file changed: %s", event.Name)
 					a.scheduleReload()
 				}
@@ -70,11 +71,7 @@ func (a *App) setupWatchers() error {
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write ||
-					event.Op&fsnotify.Create == fsnotify.Create ||
-					event.Op&fsnotify.Rename == fsnotify.Rename ||
-					event.Op&fsnotify.Remove == fsnotify.Remove ||
-					event.Op&fsnotify.Chmod == fsnotify.Chmod {
+				if sslAccess.relevant(event) {
 					logger.Info("SSL file changed: %s", event.Name)
 					a.scheduleReload()
 				}
@@ -138,6 +135,67 @@ func (a *App) setupWatchers() error {
 	return nil
 }
 
+// readability remembers which watched paths the process cannot read, so a permission
+// change only triggers a reload when it makes a file readable or unreadable.
+type readability struct {
+	unreadable map[string]bool
+}
+
+func newReadability(dir string) *readability {
+	r := &readability{unreadable: make(map[string]bool)}
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !isReadable(path) {
+			r.unreadable[path] = true
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return r
+}
+
+// relevant reports whether event changes what a reload would read. Only called from
+// the goroutine handling the watcher's events.
+func (r *readability) relevant(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Remove == fsnotify.Remove || event.Op&fsnotify.Rename == fsnotify.Rename {
+		delete(r.unreadable, event.Name)
+		return true
+	}
+	readable := isReadable(event.Name)
+	changed := readable == r.unreadable[event.Name]
+	if readable {
+		delete(r.unreadable, event.Name)
+	} else {
+		r.unreadable[event.Name] = true
+	}
+	if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
+		return true
+	}
+	return event.Op&fsnotify.Chmod == fsnotify.Chmod && changed
+}
+
+// isReadable reports whether the process can read the file, or list the directory, at path
+func isReadable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return true // opening a FIFO would block; the scan skips these anyway
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info.IsDir() {
+		_, err = f.Readdirnames(1)
+		return err == nil || err == io.EOF
+	}
+	return true
+}
+
 // reRegisterRuntimeNginxWatcher closes any existing runtime nginx.conf watcher
 // and creates a new one. Called after each activateRuntimeSnapshot because the
 // current/ directory is replaced by rename, invalidating the previous inode.
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestReadability_ChmodOnlyMattersWhenReadabilityChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "site.key")
+	if err := os.WriteFile(path, []byte("key"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r := newReadability(dir)
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if r.relevant(fsnotify.Event{Name: path, Op: fsnotify.Chmod}) {
+		t.Fatal("expected a chmod that keeps the file readable to be ignored")
+	}
+	if !r.relevant(fsnotify.Event{Name: path, Op: fsnotify.Write}) {
+		t.Fatal("expected a write to be relevant")
+	}
+
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if isReadable(path) {
+		t.Skip("running with permission to read any file")
+	}
+	if !r.relevant(fsnotify.Event{Name: path, Op: fsnotify.Chmod}) {
+		t.Fatal("expected the file becoming unreadable to be relevant")
+	}
+	if r.relevant(fsnotify.Event{Name: path, Op: fsnotify.Chmod}) {
+		t.Fatal("expected a second chmod keeping it unreadable to be ignored")
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if !r.relevant(fsnotify.Event{Name: path, Op: fsnotify.Chmod}) {
+		t.Fatal("expected the file becoming readable to be relevant")
+	}
+}
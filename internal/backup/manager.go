@@ -8,6 +8,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/fsutil"
 )
 
 type Manager struct {
@@ -238,7 +240,14 @@ func (m *Manager) restoreSnapshotLocked(id string) error {
 		return fmt.Errorf("restore runtime: %w", err)
 	}
 	if m.nginxConf != "" {
-		if err := copyFile(nginxSrc, m.nginxConf); err != nil {
+		data, err := os.ReadFile(nginxSrc)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(m.nginxConf), 0755)
+		}
+		if err == nil {
+			err = fsutil.WriteFileAtomic(m.nginxConf, data, 0644)
+		}
+		if err != nil {
 			if !os.IsNotExist(err) {
 				return fmt.Errorf("restore nginx conf: %w", err)
 			}
@@ -270,33 +279,7 @@ func (m *Manager) writeStateLocked(st *state) error {
 	if err != nil {
 		return fmt.Errorf("marshal state: %w", err)
 	}
-	return writeFileAtomic(m.statePath(), data, 0666)
-}
-
-func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		return err
-	}
-	tmp, err := os.CreateTemp(dir, ".tmp-*")
-	if err != nil {
-		return err
-	}
-	tmpName := tmp.Name()
-	defer func() { _ = os.Remove(tmpName) }()
-
-	if _, err := tmp.Write(data); err != nil {
-		_ = tmp.Close()
-		return err
-	}
-	if err := tmp.Chmod(perm); err != nil {
-		_ = tmp.Close()
-		return err
-	}
-	if err := tmp.Close(); err != nil {
-		return err
-	}
-	return os.Rename(tmpName, path)
+	return fsutil.WriteFileAtomic(m.statePath(), data, 0666)
 }
 
 func replaceDirContents(dstDir, srcDir string, keepNames map[string]bool) error {
@@ -325,43 +308,67 @@ func replaceDirContents(dstDir, srcDir string, keepNames map[string]bool) error
 	return copyDir(srcDir, dstDir, nil)
 }
 
+// copyDir copies srcDir into dstDir. Symlinks are followed, so the snapshot holds the
+// files they point at (e.g. certbot's live/ links into archive/). A directory that links
+// back to one of its parents is skipped; broken links are ignored.
 func copyDir(srcDir, dstDir string, skip func(srcPath string, d os.DirEntry) bool) error {
-	return filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if skip != nil && skip(path, d) {
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+	return copyDirFollowingSymlinks(srcDir, dstDir, skip, make(map[string]bool))
+}
 
-		rel, err := filepath.Rel(srcDir, path)
-		if err != nil {
-			return err
-		}
-		if rel == "." {
-			return nil
-		}
-		dstPath := filepath.Join(dstDir, rel)
+func copyDirFollowingSymlinks(srcDir, dstDir string, skip func(srcPath string, d os.DirEntry) bool, ancestors map[string]bool) error {
+	real, err := filepath.EvalSymlinks(srcDir)
+	if err != nil {
+		return err
+	}
+	if ancestors[real] {
+		return nil
+	}
+	ancestors[real] = true
+	defer delete(ancestors, real)
 
-		if d.IsDir() {
-			return os.MkdirAll(dstPath, 0777)
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dstDir, 0777); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(srcDir, e.Name())
+		if skip != nil && skip(path, e) {
+			continue
 		}
+		dstPath := filepath.Join(dstDir, e.Name())
 
-		info, err := d.Info()
-		if err != nil {
-			return err
+		isDir := e.IsDir()
+		if e.Type()&os.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			isDir = info.IsDir()
 		}
-		if info.Mode()&os.ModeSymlink != 0 {
-			return nil
+		if isDir {
+			if err := copyDirFollowingSymlinks(path, dstPath, skip, ancestors); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(path, dstPath); err != nil {
+			return err
 		}
-		return copyFile(path, dstPath)
-	})
+	}
+	return nil
 }
 
+// copyFile copies srcPath to dstPath. Files only their owner can read stay that way:
+// the runtime cache holds decrypted private keys with mode 0600.
 func copyFile(srcPath, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
 	data, err := os.ReadFile(srcPath)
 	if err != nil {
 		return err
@@ -369,10 +376,13 @@ func copyFile(srcPath, dstPath string) error {
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0777); err != nil {
 		return err
 	}
-	if err := os.WriteFile(dstPath, data, 0666); err != nil {
+	if info.Mode().Perm()&0077 != 0 {
+		return os.WriteFile(dstPath, data, 0666)
+	}
+	if err := os.WriteFile(dstPath, data, 0600); err != nil {
 		return err
 	}
-	return nil
+	return os.Chmod(dstPath, 0600)
 }
 
 func isUnder(path, parent string) bool {
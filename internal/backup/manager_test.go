@@ -174,3 +174,76 @@ func TestAbortClearsInProgress(t *testing.T) {
 		t.Fatalf("did not expect restore after abort")
 	}
 }
+
+func TestCopyDir_FollowsSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "ssl")
+	outside := filepath.Join(tmp, "letsencrypt", "archive")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "fullchain1.pem"), []byte("cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "live"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(src, "live", "fullchain.pem"): filepath.Join(outside, "fullchain1.pem"),
+		filepath.Join(src, "archive"):               outside,
+		filepath.Join(src, "live", "loop"):          src,
+		filepath.Join(src, "dangling.pem"):          filepath.Join(tmp, "missing"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(tmp, "snapshot")
+	if err := copyDir(src, dst, nil); err != nil {
+		t.Fatalf("copyDir: %v", err)
+	}
+
+	for _, rel := range []string{"live/fullchain.pem", "archive/fullchain1.pem"} {
+		p := filepath.Join(dst, rel)
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("expected %s in snapshot: %v", rel, err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Fatalf("expected %s to be copied as a regular file", rel)
+		}
+		if data, _ := os.ReadFile(p); string(data) != "cert" {
+			t.Fatalf("unexpected content in %s: %q", rel, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "live", "loop", "live")); err == nil {
+		t.Fatalf("symlink loop should not be copied recursively")
+	}
+}
+
+func TestCopyDir_KeepsPrivateFilesPrivate(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "runtime")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "site.key.pem"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "site.cert.pem"), []byte("cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(tmp, "snapshot")
+	if err := copyDir(src, dst, nil); err != nil {
+		t.Fatalf("copyDir: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "site.key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key copied with mode 0600, got %v, %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "site.cert.pem")); err != nil || info.Mode().Perm()&0044 == 0 {
+		t.Fatalf("expected the certificate to stay readable, got %v, %v", info, err)
+	}
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,15 +18,23 @@ const (
 	legacyConfigYAML = "config.yaml"
 	legacyConfigYML  = "config.yml"
 
-	proxyConfigFile = "proxy.yaml"
-	corsConfigFile  = "cors.yaml"
-	logsConfigFile  = "logs.yaml"
+	proxyConfigFile   = "proxy.yaml"
+	corsConfigFile    = "cors.yaml"
+	logsConfigFile    = "logs.yaml"
+	acmeConfigFile    = "acme.yaml"
+	localCAConfigFile = "localca.yaml"
+	certsConfigFile   = "certs.yaml"
+	tlsConfigFile     = "tls.yaml"
 
 	exampleDirDefault = "/etc/sslly/configs/"
 
-	proxyExampleFile = "proxy.example.yaml"
-	corsExampleFile  = "cors.example.yaml"
-	logsExampleFile  = "logs.example.yaml"
+	proxyExampleFile   = "proxy.example.yaml"
+	corsExampleFile    = "cors.example.yaml"
+	logsExampleFile    = "logs.example.yaml"
+	acmeExampleFile    = "acme.example.yaml"
+	localCAExampleFile = "localca.example.yaml"
+	certsExampleFile   = "certs.example.yaml"
+	tlsExampleFile     = "tls.example.yaml"
 )
 
 // Protocol represents the protocol type for listen/upstream configuration
@@ -65,10 +77,112 @@ type NginxLogConfig struct {
 	StderrShow string `yaml:"stderr_show"` // Display stderr as: warn or error (default: same as stderr_as)
 }
 
+// ExpiryAlertConfig represents certificate expiry alerting
+type ExpiryAlertConfig struct {
+	WarnDays      []int  `yaml:"warn_days"`      // Warn when a certificate expires within these many days (default: 30, 14, 3)
+	CheckInterval string `yaml:"check_interval"` // How often certificates are re-evaluated (default: 1h)
+}
+
 // LogConfig represents logging configuration
 type LogConfig struct {
-	SSLLY LogLevelConfig `yaml:"sslly"` // SSLLY-NGINX component log level
-	Nginx NginxLogConfig `yaml:"nginx"` // NGINX-PROCS component log configuration
+	SSLLY  LogLevelConfig    `yaml:"sslly"`  // SSLLY-NGINX component log level
+	Nginx  NginxLogConfig    `yaml:"nginx"`  // NGINX-PROCS component log configuration
+	Expiry ExpiryAlertConfig `yaml:"expiry"` // Certificate expiry alerts
+}
+
+// ACMEConfig represents automatic certificate issuance configuration
+type ACMEConfig struct {
+	Enabled      bool   `yaml:"enabled"`       // Request certificates for configured domains that lack a valid one (default: false)
+	Email        string `yaml:"email"`         // Account contact email (optional)
+	DirectoryURL string `yaml:"directory_url"` // ACME directory URL (default: Let's Encrypt production)
+	DirectoryCA  string `yaml:"directory_ca"`  // PEM file with an extra CA to trust for the directory (e.g. Pebble)
+	RenewBefore  string `yaml:"renew_before"`  // Renew this long before expiry, e.g. "720h" (default: 720h)
+}
+
+// LocalCAConfig represents the local development CA configuration
+type LocalCAConfig struct {
+	Enabled  bool     `yaml:"enabled"`  // Sign certificates for domains without one (default: false)
+	Domains  []string `yaml:"domains"`  // Domains to sign, e.g. "*.lan" or "app.internal" (default: all)
+	Validity string   `yaml:"validity"` // Leaf certificate lifetime, e.g. "8760h" (default: 8760h)
+}
+
+// CertsConfig represents certificate selection preferences
+type CertsConfig struct {
+	// Prefer pins issuer and/or key type when several certificates cover a domain.
+	// Keys are a domain, a wildcard pattern ("*.example.com") or "*" for all domains.
+	Prefer map[string]CertPreference `yaml:"prefer"`
+}
+
+// CertPreference pins the certificate used for a domain
+type CertPreference struct {
+	Issuer  string `yaml:"issuer"`   // Case-insensitive substring of the issuer DN, e.g. "Let's Encrypt"
+	KeyType string `yaml:"key_type"` // rsa, ecdsa or ed25519
+}
+
+// TLSConfig represents the TLS policy of the HTTPS servers
+type TLSConfig struct {
+	Default  string                `yaml:"default"`  // Profile for domains without an override (default: intermediate)
+	Domains  map[string]string     `yaml:"domains"`  // Profile per domain or wildcard pattern ("*.example.com")
+	Profiles map[string]TLSProfile `yaml:"profiles"` // Custom profiles, usable alongside modern, intermediate and old
+
+	// ClientAuth requires client certificates per domain, wildcard pattern or
+	// domain/path (e.g. "example.com/admin").
+	ClientAuth map[string]ClientAuthConfig `yaml:"client_auth"`
+
+	// Upstreams sets how nginx connects to <https> upstreams, keyed by target as written
+	// in proxy.yaml (e.g. "10.0.0.5:8443" or "api.internal").
+	Upstreams map[string]UpstreamTLSConfig `yaml:"upstreams"`
+
+	// DHParamPath is the ssl_dhparam file kept in the runtime directory.
+	// It is runtime-only (not persisted to YAML).
+	DHParamPath string `yaml:"-"`
+}
+
+// TLSProfile is a named set of TLS settings. Unset fields are taken from Base.
+type TLSProfile struct {
+	Base                string   `yaml:"base"`                  // Built-in profile to start from (default: intermediate)
+	Protocols           []string `yaml:"protocols"`             // e.g. [TLSv1.2, TLSv1.3]
+	Ciphers             string   `yaml:"ciphers"`               // OpenSSL cipher list for TLS 1.2 and below
+	PreferServerCiphers *bool    `yaml:"prefer_server_ciphers"` // Server picks the cipher
+	ECDHCurve           string   `yaml:"ecdh_curve"`            // e.g. "X25519:prime256v1:secp384r1"
+	DHParam             *bool    `yaml:"dhparam"`               // Use the DH parameters from the runtime directory for DHE ciphers
+	SessionCache        string   `yaml:"session_cache"`         // Shared session cache size, e.g. "10m"; "off" disables it
+	SessionTimeout      string   `yaml:"session_timeout"`       // e.g. "1d"
+	SessionTickets      *bool    `yaml:"session_tickets"`       // TLS session tickets
+	EarlyData           *bool    `yaml:"early_data"`            // TLS 1.3 0-RTT data; replayable, only for idempotent backends
+}
+
+// Client certificate modes of ClientAuthConfig
+const (
+	ClientAuthRequired = "required" // requests without a verified certificate are refused
+	ClientAuthOptional = "optional" // certificates are verified when sent and forwarded to the upstream
+)
+
+// ClientAuthConfig verifies TLS client certificates for a domain or path
+type ClientAuthConfig struct {
+	CA   string `yaml:"ca"`   // Bundle of the CAs that issue client certificates, relative to ssl/
+	Mode string `yaml:"mode"` // required or optional (default: required)
+	CRL  string `yaml:"crl"`  // Certificate revocation list, relative to ssl/ (optional)
+
+	// VerifyDepth is the number of CA certificates in the bundle (ssl_verify_depth).
+	// It is runtime-only, like CA and CRL pointing at the staged files.
+	VerifyDepth int `yaml:"-"`
+}
+
+// UpstreamTLSConfig sets the TLS connection to an <https> upstream
+type UpstreamTLSConfig struct {
+	Verify      *bool  `yaml:"verify"`       // Check the backend certificate (default: true when ca is set)
+	CA          string `yaml:"ca"`           // Trusted certificates, relative to ssl/ (default: system roots)
+	VerifyDepth int    `yaml:"verify_depth"` // Maximum chain depth (default: 2)
+	Name        string `yaml:"name"`         // Name sent as SNI and verified (default: upstream host)
+	SNI         *bool  `yaml:"sni"`          // Send SNI (default: true, unless the upstream is an IP address without name)
+	Cert        string `yaml:"cert"`         // Client certificate presented to the backend, relative to ssl/
+	Key         string `yaml:"key"`          // Its private key (may be omitted for PKCS#12 bundles)
+
+	// Refused is set when the configured files cannot be used; requests get 502
+	// instead of reaching the backend unverified or without its client certificate.
+	// It is runtime-only, like CA, Cert and Key pointing at the staged files.
+	Refused bool `yaml:"-"`
 }
 
 // Upstream represents a backend server configuration
@@ -78,6 +192,37 @@ type Upstream struct {
 	Host     string   // IP address or hostname (default: 127.0.0.1)
 	Port     string   // Port number
 	Path     string   // Optional path prefix for routing (HTTP/HTTPS only)
+
+	// Load-balancing parameters, emitted on the upstream "server" line when the
+	// target is part of a pool. Zero values mean "use the nginx default".
+	Weight      int    // weight=N (default: 1)
+	MaxFails    *int   // max_fails=N (default: 1; 0 disables failure accounting)
+	FailTimeout string // fail_timeout=T, e.g. "10s" (default: 10s)
+	Backup      bool   // backup: only used when all primary servers are unavailable
+}
+
+// HasBalanceParams returns true if any load-balancing parameter is set
+func (u Upstream) HasBalanceParams() bool {
+	return u.Weight > 0 || u.MaxFails != nil || u.FailTimeout != "" || u.Backup
+}
+
+// ServerParams returns the nginx upstream "server" parameters for this target,
+// e.g. "weight=3 max_fails=2 fail_timeout=10s backup". Empty if none are set.
+func (u Upstream) ServerParams() string {
+	var params []string
+	if u.Weight > 0 {
+		params = append(params, fmt.Sprintf("weight=%d", u.Weight))
+	}
+	if u.MaxFails != nil {
+		params = append(params, fmt.Sprintf("max_fails=%d", *u.MaxFails))
+	}
+	if u.FailTimeout != "" {
+		params = append(params, "fail_timeout="+u.FailTimeout)
+	}
+	if u.Backup {
+		params = append(params, "backup")
+	}
+	return strings.Join(params, " ")
 }
 
 // ListenConfig represents a listening configuration
@@ -108,6 +253,13 @@ type Config struct {
 	NoTrailingSlash []string              `yaml:"no_trailing_slash"`
 	Ports           map[string][]string   `yaml:",inline"`
 
+	// ACME, LocalCA, Certs and TLS are loaded from acme.yaml, localca.yaml, certs.yaml
+	// and tls.yaml only.
+	ACME    ACMEConfig    `yaml:"-"`
+	LocalCA LocalCAConfig `yaml:"-"`
+	Certs   CertsConfig   `yaml:"-"`
+	TLS     TLSConfig     `yaml:"-"`
+
 	// RuntimeStaticSites stores static site information for nginx config generation.
 	// Key is the original config key (e.g., "/app/static" or "[/app/static]/route").
 	// It is runtime-only (not persisted to YAML).
@@ -190,7 +342,100 @@ func normalizeRoutePath(p string) string {
 // - "<https>192.168.50.2:1234" -> Upstream{Scheme: "https", Host: "192.168.50.2", Port: "1234", Path: ""}
 // - "<https>www.baidu.com" -> Upstream{Scheme: "https", Host: "www.baidu.com", Port: "443", Path: ""}
 // - "www.example.com" -> Upstream{Scheme: "http", Host: "www.example.com", Port: "80", Path: ""}
+// - "192.168.1.10:8080 weight=3" -> Upstream{..., Host: "192.168.1.10", Port: "8080", Weight: 3}
+//
+// For keys listing several targets, only the first one is returned; use ParseUpstreamTargets.
 func ParseUpstream(key string) Upstream {
+	if targets, _ := ParseUpstreamTargets(key); len(targets) > 0 {
+		return targets[0]
+	}
+	return parseUpstreamAddr(key)
+}
+
+// nginxTimePattern matches nginx time values such as "30", "10s", "500ms" or "1m".
+var nginxTimePattern = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+
+// ParseUpstreamTargets parses an upstream key that may list several targets
+// forming one load-balanced pool. Targets are separated by ',' and each target
+// may be followed by whitespace-separated balancing parameters:
+//
+//	"192.168.1.10:8080 weight=3, 192.168.1.11:8080, 192.168.1.12:8080 backup"
+//
+// Supported parameters: weight=N, max_fails=N, fail_timeout=T, backup.
+// A <protocol> prefix at the start of the key applies to every target that does
+// not carry its own prefix. Targets with invalid parameters are still returned
+// (with the offending parameter dropped) alongside the error.
+func ParseUpstreamTargets(key string) ([]Upstream, error) {
+	key = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(key), ":"))
+
+	// Key-level protocol prefix, inherited by targets without their own prefix.
+	keyPrefix := ""
+	if strings.HasPrefix(key, "<") {
+		if closeIdx := strings.Index(key, ">"); closeIdx > 0 {
+			keyPrefix = key[:closeIdx+1]
+			key = strings.TrimSpace(key[closeIdx+1:])
+		}
+	}
+
+	var targets []Upstream
+	var errs []error
+	for _, part := range strings.Split(key, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			errs = append(errs, fmt.Errorf("empty upstream target in %q", key))
+			continue
+		}
+
+		addr := strings.TrimSuffix(fields[0], ":")
+		if keyPrefix != "" && !strings.HasPrefix(addr, "<") {
+			addr = keyPrefix + addr
+		}
+		up := parseUpstreamAddr(addr)
+
+		for _, param := range fields[1:] {
+			if err := applyUpstreamParam(&up, param); err != nil {
+				errs = append(errs, fmt.Errorf("upstream target %q: %w", fields[0], err))
+			}
+		}
+		targets = append(targets, up)
+	}
+
+	return targets, errors.Join(errs...)
+}
+
+func applyUpstreamParam(up *Upstream, param string) error {
+	name, value, hasValue := strings.Cut(param, "=")
+	switch strings.ToLower(name) {
+	case "weight":
+		n, err := strconv.Atoi(value)
+		if !hasValue || err != nil || n < 1 {
+			return fmt.Errorf("invalid weight %q: must be a positive integer", value)
+		}
+		up.Weight = n
+	case "max_fails":
+		n, err := strconv.Atoi(value)
+		if !hasValue || err != nil || n < 0 {
+			return fmt.Errorf("invalid max_fails %q: must be a non-negative integer", value)
+		}
+		up.MaxFails = &n
+	case "fail_timeout":
+		if !hasValue || !nginxTimePattern.MatchString(value) {
+			return fmt.Errorf("invalid fail_timeout %q: expected a duration like 10s", value)
+		}
+		up.FailTimeout = value
+	case "backup":
+		if hasValue {
+			return fmt.Errorf("backup does not take a value")
+		}
+		up.Backup = true
+	default:
+		return fmt.Errorf("unknown parameter %q", param)
+	}
+	return nil
+}
+
+// parseUpstreamAddr parses a single upstream address (with optional <protocol> prefix and path).
+func parseUpstreamAddr(key string) Upstream {
 	// Remove trailing colon if present (for YAML keys like "192.168.31.6:1234:")
 	key = strings.TrimSuffix(key, ":")
 
@@ -361,6 +606,60 @@ func ParseListenKey(key string) ListenConfig {
 	}
 }
 
+// HTTPListener represents a parsed listener_key of an HTTP/HTTPS or static site mapping
+type HTTPListener struct {
+	Protocol Protocol // Forced listen protocol (http/https); empty means smart mode
+	Domain   string   // server_name (lowercased); empty means all names
+	Port     string   // Listen port; empty means the default port of the protocol
+	Path     string   // Optional route path (e.g. "/api")
+}
+
+// ParseHTTPListener parses a listener_key of an HTTP/HTTPS or static site mapping:
+// - "example.com" -> HTTPListener{Domain: "example.com"}
+// - "example.com/api" -> HTTPListener{Domain: "example.com", Path: "/api"}
+// - "example.com|8443" -> HTTPListener{Domain: "example.com", Port: "8443"}
+// - "<https>example.com|8443/admin" -> HTTPListener{Protocol: https, Domain: "example.com", Port: "8443", Path: "/admin"}
+// - "<http>example.com" -> HTTPListener{Protocol: http, Domain: "example.com"}
+// - "8080" -> HTTPListener{Port: "8080"} (all server names)
+func ParseHTTPListener(key string) HTTPListener {
+	k := strings.TrimSpace(key)
+
+	var l HTTPListener
+	if strings.HasPrefix(k, "<") {
+		if closeIdx := strings.Index(k, ">"); closeIdx > 0 {
+			l.Protocol = Protocol(strings.ToLower(strings.TrimSpace(k[1:closeIdx])))
+			k = strings.TrimSpace(k[closeIdx+1:])
+		}
+	}
+
+	// Split the route path; skip over a bracketed IPv6 server name first.
+	searchFrom := 0
+	if strings.HasPrefix(k, "[") {
+		if closeBracket := strings.Index(k, "]"); closeBracket > 0 {
+			searchFrom = closeBracket
+		}
+	}
+	if slashIdx := strings.Index(k[searchFrom:], "/"); slashIdx >= 0 {
+		l.Path = k[searchFrom+slashIdx:]
+		k = k[:searchFrom+slashIdx]
+	}
+
+	host := k
+	if pipeIdx := strings.Index(k, "|"); pipeIdx >= 0 {
+		host = k[:pipeIdx]
+		l.Port = strings.TrimSpace(k[pipeIdx+1:])
+	} else if isNumeric(k) {
+		host = ""
+		l.Port = k
+	}
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	l.Domain = strings.ToLower(host)
+	return l
+}
+
 // IsStaticSiteKey returns true if the key appears to be a static site mapping
 // (starts with '.' or '/', or uses the [dir]/route bracket syntax with a static dir)
 func IsStaticSiteKey(key string) bool {
@@ -426,6 +725,46 @@ func Load(configDir string) (*Config, error) {
 		config.CORS = corsCfg
 	}
 
+	// Load optional ACME config
+	acmePath := filepath.Join(configDir, acmeConfigFile)
+	if data, err := os.ReadFile(acmePath); err == nil {
+		var acmeCfg ACMEConfig
+		if err := yaml.Unmarshal(data, &acmeCfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", acmeConfigFile, err)
+		}
+		config.ACME = acmeCfg
+	}
+
+	// Load optional local CA config
+	localCAPath := filepath.Join(configDir, localCAConfigFile)
+	if data, err := os.ReadFile(localCAPath); err == nil {
+		var localCACfg LocalCAConfig
+		if err := yaml.Unmarshal(data, &localCACfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", localCAConfigFile, err)
+		}
+		config.LocalCA = localCACfg
+	}
+
+	// Load optional certificate selection config
+	certsPath := filepath.Join(configDir, certsConfigFile)
+	if data, err := os.ReadFile(certsPath); err == nil {
+		var certsCfg CertsConfig
+		if err := yaml.Unmarshal(data, &certsCfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", certsConfigFile, err)
+		}
+		config.Certs = certsCfg
+	}
+
+	// Load optional TLS policy config
+	tlsPath := filepath.Join(configDir, tlsConfigFile)
+	if data, err := os.ReadFile(tlsPath); err == nil {
+		var tlsCfg TLSConfig
+		if err := yaml.Unmarshal(data, &tlsCfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", tlsConfigFile, err)
+		}
+		config.TLS = tlsCfg
+	}
+
 	// Defensive: do not allow these keys to appear as ports.
 	delete(config.Ports, "cors")
 	delete(config.Ports, "log")
@@ -656,6 +995,18 @@ func ensureSplitConfigFiles(configDir string) error {
 	if err := ensureFileFromExample(configDir, logsConfigFile, logsExampleFile); err != nil {
 		return err
 	}
+	if err := ensureFileFromExample(configDir, acmeConfigFile, acmeExampleFile); err != nil {
+		return err
+	}
+	if err := ensureFileFromExample(configDir, localCAConfigFile, localCAExampleFile); err != nil {
+		return err
+	}
+	if err := ensureFileFromExample(configDir, certsConfigFile, certsExampleFile); err != nil {
+		return err
+	}
+	if err := ensureFileFromExample(configDir, tlsConfigFile, tlsExampleFile); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -811,19 +1162,85 @@ func ValidateMapping(upstreamKey string, listenerKey string, hasCertificate bool
 			// Explicit http/https is allowed
 		} else {
 			// Smart mode: determine based on certificate
-			// If has certificate or upstream is https -> https
+			// If has certificate -> https
 			// Otherwise -> http
-			if hasCertificate || upstream.Protocol == ProtocolHTTPS {
+			if hasCertificate {
 				listenConfig.Protocol = ProtocolHTTPS
 			} else {
 				listenConfig.Protocol = ProtocolHTTP
 			}
 		}
+
+		// Rule 5: the listener must produce a valid server_name, listen port and location
+		if err := validateHTTPListener(ParseHTTPListener(listenerKey)); err != nil {
+			errors = append(errors, &MappingError{
+				Key:     upstreamKey,
+				Value:   listenerKey,
+				Message: err.Error(),
+			})
+		}
 	}
 
 	return listenConfig, errors, warnings
 }
 
+// serverNamePattern matches the characters nginx accepts in a server_name we generate
+// (hostnames, wildcards and IPv6 literals).
+var serverNamePattern = regexp.MustCompile(`^[a-z0-9*_.:-]+$`)
+
+// validateHTTPListener checks the parts of an HTTP listener that end up in nginx.conf
+func validateHTTPListener(l HTTPListener) error {
+	if l.Domain == "" && l.Port == "" {
+		return fmt.Errorf("listener needs a server name or a port")
+	}
+	if l.Domain != "" && !serverNamePattern.MatchString(l.Domain) {
+		return fmt.Errorf("invalid server name %q", l.Domain)
+	}
+	if l.Port != "" && !isValidPort(l.Port) {
+		return fmt.Errorf("invalid listen port %q: must be 1-65535", l.Port)
+	}
+	if err := validateRoutePath(l.Path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateUpstreamKey checks an HTTP upstream key and all of its pool targets
+func validateUpstreamKey(key string) error {
+	targets, err := ParseUpstreamTargets(key)
+	if err != nil {
+		return err
+	}
+	for _, up := range targets {
+		if !up.Protocol.IsHTTP() && !up.Protocol.IsStream() {
+			return fmt.Errorf("unknown upstream protocol '%s'", up.Protocol)
+		}
+		if up.Host == "" || strings.ContainsAny(up.Host, " \t;{}'\"") {
+			return fmt.Errorf("invalid upstream host %q", up.Host)
+		}
+		if !isValidPort(up.Port) {
+			return fmt.Errorf("invalid upstream port %q: must be 1-65535", up.Port)
+		}
+		if err := validateRoutePath(up.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRoutePath rejects paths that would break the generated location blocks
+func validateRoutePath(path string) error {
+	if strings.ContainsAny(path, " \t;{}'\"") {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	return nil
+}
+
+func isValidPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && isNumeric(port) && n >= 1 && n <= 65535
+}
+
 // ValidatedMapping represents a validated proxy mapping
 type ValidatedMapping struct {
 	UpstreamKey  string
@@ -835,27 +1252,32 @@ type ValidatedMapping struct {
 }
 
 // ValidateConfig validates all proxy mappings in the config.
-// Returns validated mappings (including those with errors for logging),
-// and a boolean indicating if there were any fatal errors.
+// Returns the mappings without errors, together with all errors and warnings found.
 //
 // Mappings with errors are excluded from the returned slice,
-// but their errors are collected for reporting.
+// but their errors are collected for reporting. An error in the upstream_key itself
+// excludes every mapping of that key.
 func ValidateConfig(cfg *Config, certMap map[string]bool) ([]ValidatedMapping, []error, []*MappingWarning) {
 	var validMappings []ValidatedMapping
 	var allErrors []error
 	var allWarnings []*MappingWarning
 
-	for upstreamKey, listenerKeys := range cfg.Ports {
-		// Skip static site keys - they are handled separately
-		if IsStaticSiteKey(upstreamKey) {
-			continue
-		}
+	for _, upstreamKey := range sortedKeys(cfg.Ports) {
+		listenerKeys := cfg.Ports[upstreamKey]
+
+		if IsStreamKey(upstreamKey) {
+			// Stream mapping: upstreamKey is the listen side, listenerKeys are targets.
+			// Individual targets are checked by ResolveStreamTargets.
+			listen, _, err := ParseStreamListenKey(upstreamKey)
+			if err == nil && !isValidPort(listen.Port) {
+				err = fmt.Errorf("invalid listen port %q: must be 1-65535", listen.Port)
+			}
+			if err != nil {
+				allErrors = append(allErrors, &MappingError{Key: upstreamKey, Message: err.Error()})
+				continue
+			}
 
-		// For TCP/UDP upstreams, the listenerKeys are actually upstream targets
-		// We need to check if this is a stream mapping
-		upstream := ParseUpstream(upstreamKey)
-		if upstream.Protocol.IsStream() {
-			// Stream mapping: upstreamKey is the listen side, listenerKeys are targets
+			upstream := ParseUpstream(upstreamKey)
 			for _, targetKey := range listenerKeys {
 				listenConfig, errors, warnings := ValidateMapping(upstreamKey, targetKey, false)
 				mapping := ValidatedMapping{
@@ -873,34 +1295,77 @@ func ValidateConfig(cfg *Config, certMap map[string]bool) ([]ValidatedMapping, [
 					validMappings = append(validMappings, mapping)
 				}
 			}
-		} else {
-			// HTTP/HTTPS/Static mapping: upstreamKey is the target, listenerKeys are domains
-			for _, listenerKey := range listenerKeys {
-				// Extract domain from listenerKey to check certificate
-				domain := listenerKey
-				if idx := strings.Index(listenerKey, "/"); idx > 0 {
-					domain = listenerKey[:idx]
-				}
-				hasCert := certMap[domain]
+			continue
+		}
 
-				listenConfig, errors, warnings := ValidateMapping(upstreamKey, listenerKey, hasCert)
-				mapping := ValidatedMapping{
-					UpstreamKey:  upstreamKey,
-					ListenerKey:  listenerKey,
-					Upstream:     upstream,
-					ListenConfig: listenConfig,
-					Errors:       errors,
-					Warnings:     warnings,
-				}
-				allErrors = append(allErrors, errors...)
-				allWarnings = append(allWarnings, warnings...)
+		// HTTP/HTTPS/Static mapping: upstreamKey is the target, listenerKeys are domains.
+		// Static site keys are checked when the static sites are prepared.
+		var upstream Upstream
+		if !IsStaticSiteKey(upstreamKey) {
+			if err := validateUpstreamKey(upstreamKey); err != nil {
+				allErrors = append(allErrors, &MappingError{Key: upstreamKey, Message: err.Error()})
+				continue
+			}
+			upstream = ParseUpstream(upstreamKey)
+		}
 
-				if len(errors) == 0 {
-					validMappings = append(validMappings, mapping)
-				}
+		for _, listenerKey := range listenerKeys {
+			hasCert := certMap[ParseHTTPListener(listenerKey).Domain]
+
+			listenConfig, errors, warnings := ValidateMapping(upstreamKey, listenerKey, hasCert)
+			mapping := ValidatedMapping{
+				UpstreamKey:  upstreamKey,
+				ListenerKey:  listenerKey,
+				Upstream:     upstream,
+				ListenConfig: listenConfig,
+				Errors:       errors,
+				Warnings:     warnings,
+			}
+			allErrors = append(allErrors, errors...)
+			allWarnings = append(allWarnings, warnings...)
+
+			if len(errors) == 0 {
+				validMappings = append(validMappings, mapping)
 			}
 		}
 	}
 
 	return validMappings, allErrors, allWarnings
 }
+
+// FilterValidMappings returns a copy of cfg whose mappings are limited to the
+// validated ones, so a single invalid entry does not break the generated config.
+// Listener order within each key is preserved.
+func FilterValidMappings(cfg *Config, valid []ValidatedMapping) *Config {
+	keep := make(map[string]map[string]bool)
+	for _, m := range valid {
+		if keep[m.UpstreamKey] == nil {
+			keep[m.UpstreamKey] = make(map[string]bool)
+		}
+		keep[m.UpstreamKey][m.ListenerKey] = true
+	}
+
+	filtered := *cfg
+	filtered.Ports = make(map[string][]string)
+	for key, listeners := range cfg.Ports {
+		var kept []string
+		for _, listener := range listeners {
+			if keep[key][listener] {
+				kept = append(kept, listener)
+			}
+		}
+		if len(kept) > 0 {
+			filtered.Ports[key] = kept
+		}
+	}
+	return &filtered
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +35,120 @@ no_trailing_slash:
 	}
 }
 
+func TestLoad_ACME(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("SSLLY_EXAMPLE_DIR", t.TempDir())
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "proxy.yaml"), []byte("8080:\n  - example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(tmpDir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.ACME.Enabled {
+		t.Error("ACME should be disabled without acme.yaml")
+	}
+
+	acmeYAML := `enabled: true
+email: admin@example.com
+directory_url: https://localhost:14000/dir
+renew_before: 240h
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, "acme.yaml"), []byte(acmeYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(tmpDir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := ACMEConfig{Enabled: true, Email: "admin@example.com", DirectoryURL: "https://localhost:14000/dir", RenewBefore: "240h"}
+	if cfg.ACME != want {
+		t.Errorf("ACME = %+v, want %+v", cfg.ACME, want)
+	}
+}
+
+func TestLoad_LocalCA(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("SSLLY_EXAMPLE_DIR", t.TempDir())
+
+	files := map[string]string{
+		"proxy.yaml":   "8080:\n  - app.lan\n",
+		"localca.yaml": "enabled: true\ndomains:\n  - '*.lan'\nvalidity: 2160h\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := Load(tmpDir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !cfg.LocalCA.Enabled || cfg.LocalCA.Validity != "2160h" || len(cfg.LocalCA.Domains) != 1 || cfg.LocalCA.Domains[0] != "*.lan" {
+		t.Errorf("unexpected LocalCA: %+v", cfg.LocalCA)
+	}
+}
+
+func TestLoad_Certs(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("SSLLY_EXAMPLE_DIR", t.TempDir())
+
+	files := map[string]string{
+		"proxy.yaml": "8080:\n  - example.com\n",
+		"certs.yaml": "prefer:\n  '*':\n    key_type: ecdsa\n  example.com:\n    issuer: \"Let's Encrypt\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := Load(tmpDir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Certs.Prefer["*"].KeyType != "ecdsa" || cfg.Certs.Prefer["example.com"].Issuer != "Let's Encrypt" {
+		t.Errorf("unexpected Certs: %+v", cfg.Certs)
+	}
+	if _, ok := cfg.Ports["prefer"]; ok {
+		t.Errorf("certs.yaml keys leaked into ports: %v", cfg.Ports)
+	}
+}
+
+func TestLoad_TLS(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("SSLLY_EXAMPLE_DIR", t.TempDir())
+
+	files := map[string]string{
+		"proxy.yaml": "8080:\n  - example.com\n  - printer.lan\n",
+		"tls.yaml": "default: modern\ndomains:\n  printer.lan: legacy\nprofiles:\n  legacy:\n    base: old\n    session_tickets: true\n" +
+			"client_auth:\n  example.com/admin:\n    ca: clients/ca.pem\n    mode: optional\n" +
+			"upstreams:\n  10.0.0.5:8443:\n    name: api.internal\n    verify: true\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := Load(tmpDir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	legacy := cfg.TLS.Profiles["legacy"]
+	if cfg.TLS.Default != "modern" || cfg.TLS.Domains["printer.lan"] != "legacy" || legacy.Base != "old" || legacy.SessionTickets == nil || !*legacy.SessionTickets {
+		t.Errorf("unexpected TLS: %+v", cfg.TLS)
+	}
+	if admin := cfg.TLS.ClientAuth["example.com/admin"]; admin.CA != "clients/ca.pem" || admin.Mode != ClientAuthOptional {
+		t.Errorf("unexpected client_auth: %+v", cfg.TLS.ClientAuth)
+	}
+	if up := cfg.TLS.Upstreams["10.0.0.5:8443"]; up.Name != "api.internal" || up.Verify == nil || !*up.Verify {
+		t.Errorf("unexpected upstreams: %+v", cfg.TLS.Upstreams)
+	}
+}
+
 func TestParseStaticSiteKey(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -139,3 +254,137 @@ func TestParseStaticSiteKey(t *testing.T) {
 		})
 	}
 }
+
+func TestParseUpstreamTargets(t *testing.T) {
+	targets, err := ParseUpstreamTargets("192.168.1.10:8080 weight=3, 192.168.1.11:8080 max_fails=2 fail_timeout=10s, 192.168.1.12:8080 backup")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(targets))
+	}
+	if targets[0].Host != "192.168.1.10" || targets[0].Port != "8080" || targets[0].Weight != 3 {
+		t.Errorf("unexpected first target: %+v", targets[0])
+	}
+	if targets[1].MaxFails == nil || *targets[1].MaxFails != 2 || targets[1].FailTimeout != "10s" {
+		t.Errorf("unexpected second target: %+v", targets[1])
+	}
+	if !targets[2].Backup {
+		t.Errorf("expected third target to be backup: %+v", targets[2])
+	}
+	if got := targets[1].ServerParams(); got != "max_fails=2 fail_timeout=10s" {
+		t.Errorf("ServerParams() = %q", got)
+	}
+}
+
+func TestParseUpstreamTargets_ProtocolPrefixInherited(t *testing.T) {
+	targets, err := ParseUpstreamTargets("<https>a.internal:8443, b.internal:8443/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+	for _, up := range targets {
+		if up.Scheme != "https" {
+			t.Errorf("expected https scheme, got %+v", up)
+		}
+	}
+	if targets[1].Path != "/api" {
+		t.Errorf("expected path /api, got %q", targets[1].Path)
+	}
+}
+
+func TestParseUpstreamTargets_InvalidParams(t *testing.T) {
+	tests := []string{
+		"8080 weight=0",
+		"8080 weight=abc",
+		"8080 max_fails=-1",
+		"8080 fail_timeout=soon",
+		"8080 backup=yes",
+		"8080 slow_start=10s",
+		"8080,",
+	}
+	for _, key := range tests {
+		if _, err := ParseUpstreamTargets(key); err == nil {
+			t.Errorf("ParseUpstreamTargets(%q): expected error", key)
+		}
+	}
+
+	// ParseUpstream stays lenient and still returns the address.
+	up := ParseUpstream("8080 weight=abc")
+	if up.Host != "127.0.0.1" || up.Port != "8080" || up.Weight != 0 {
+		t.Errorf("unexpected lenient parse: %+v", up)
+	}
+}
+
+func TestParseHTTPListener(t *testing.T) {
+	tests := []struct {
+		key  string
+		want HTTPListener
+	}{
+		{key: "example.com", want: HTTPListener{Domain: "example.com"}},
+		{key: "Example.com/api", want: HTTPListener{Domain: "example.com", Path: "/api"}},
+		{key: "example.com|8443", want: HTTPListener{Domain: "example.com", Port: "8443"}},
+		{key: "<https>example.com|8443/admin", want: HTTPListener{Protocol: ProtocolHTTPS, Domain: "example.com", Port: "8443", Path: "/admin"}},
+		{key: "<http>example.com", want: HTTPListener{Protocol: ProtocolHTTP, Domain: "example.com"}},
+		{key: "8080", want: HTTPListener{Port: "8080"}},
+		{key: "[2001:db8::1]|8443", want: HTTPListener{Domain: "2001:db8::1", Port: "8443"}},
+	}
+	for _, tt := range tests {
+		if got := ParseHTTPListener(tt.key); got != tt.want {
+			t.Errorf("ParseHTTPListener(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConfig_IsolatesInvalidMappings(t *testing.T) {
+	cfg := &Config{Ports: map[string][]string{
+		"3000":                    {"app.example.com", "<tcp>bad.example.com", "bad host.example.com"},
+		"10.0.0.1:99999":          {"ports.example.com"},
+		"10.0.0.2:8080 weight=x":  {"weight.example.com"},
+		"4000":                    {"admin.example.com|8443", "admin.example.com|70000"},
+		"<tcp>9122":               {"192.168.50.1|22"},
+		"<udp>9123 balance=fancy": {"192.168.50.1|53"},
+	}}
+
+	valid, errs, _ := ValidateConfig(cfg, map[string]bool{})
+	filtered := FilterValidMappings(cfg, valid)
+
+	want := map[string][]string{
+		"3000":      {"app.example.com"},
+		"4000":      {"admin.example.com|8443"},
+		"<tcp>9122": {"192.168.50.1|22"},
+	}
+	if len(filtered.Ports) != len(want) {
+		t.Fatalf("unexpected filtered mappings: %#v", filtered.Ports)
+	}
+	for key, listeners := range want {
+		got := filtered.Ports[key]
+		if strings.Join(got, ",") != strings.Join(listeners, ",") {
+			t.Errorf("Ports[%q] = %v, want %v", key, got, listeners)
+		}
+	}
+	if len(errs) != 6 {
+		t.Errorf("expected 6 errors, got %d: %v", len(errs), errs)
+	}
+	if len(cfg.Ports["3000"]) != 3 {
+		t.Error("FilterValidMappings must not modify the original config")
+	}
+}
+
+func TestValidateConfig_KeepsStaticSites(t *testing.T) {
+	cfg := &Config{Ports: map[string][]string{
+		"/var/www/site": {"static.example.com", "<udp>static.example.com"},
+	}}
+
+	valid, errs, _ := ValidateConfig(cfg, map[string]bool{})
+	filtered := FilterValidMappings(cfg, valid)
+
+	if got := filtered.Ports["/var/www/site"]; len(got) != 1 || got[0] != "static.example.com" {
+		t.Errorf("unexpected static listeners: %v", got)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %d: %v", len(errs), errs)
+	}
+}
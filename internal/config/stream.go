@@ -0,0 +1,195 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamBalance is the load-balancing method of a TCP/UDP stream upstream
+type StreamBalance string
+
+const (
+	StreamBalanceRoundRobin StreamBalance = "round_robin" // nginx default
+	StreamBalanceHash       StreamBalance = "hash"        // hash $remote_addr consistent (client affinity)
+	StreamBalanceLeastConn  StreamBalance = "least_conn"
+)
+
+// UnusedStreamTarget describes a stream target that was listed but cannot be used
+type UnusedStreamTarget struct {
+	Target string // The target entry as written in proxy.yaml
+	Reason string
+}
+
+// IsStreamKey returns true if the key is a TCP/UDP stream mapping (e.g. "<tcp>9122")
+func IsStreamKey(key string) bool {
+	return ParseListenKey(strings.TrimSpace(key)).Protocol.IsStream()
+}
+
+// ParseStreamListenKey parses the listen side of a TCP/UDP mapping. The key may carry
+// a balancing method after the listen address:
+//   - "<tcp>9122" -> round robin
+//   - "<udp>27015 balance=hash" -> hash $remote_addr
+//   - "<tcp>192.168.50.1|22 balance=least_conn" -> least_conn
+func ParseStreamListenKey(key string) (ListenConfig, StreamBalance, error) {
+	key = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(key), ":"))
+
+	// Keep a "<tcp> 9122" style prefix attached to the address.
+	prefix := ""
+	if strings.HasPrefix(key, "<") {
+		if closeIdx := strings.Index(key, ">"); closeIdx > 0 {
+			prefix = key[:closeIdx+1]
+			key = strings.TrimSpace(key[closeIdx+1:])
+		}
+	}
+
+	fields := strings.Fields(key)
+	if len(fields) == 0 {
+		return ParseListenKey(prefix), StreamBalanceRoundRobin, fmt.Errorf("missing listen port")
+	}
+	listen := ParseListenKey(prefix + fields[0])
+
+	balance := StreamBalanceRoundRobin
+	for _, param := range fields[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.ToLower(name) != "balance" {
+			return listen, balance, fmt.Errorf("unknown parameter %q", param)
+		}
+		switch StreamBalance(strings.ToLower(value)) {
+		case StreamBalanceRoundRobin, "":
+			balance = StreamBalanceRoundRobin
+		case StreamBalanceHash:
+			balance = StreamBalanceHash
+		case StreamBalanceLeastConn:
+			balance = StreamBalanceLeastConn
+		default:
+			return listen, balance, fmt.Errorf("unknown balance method %q (use round_robin, hash or least_conn)", value)
+		}
+	}
+	return listen, balance, nil
+}
+
+// ResolveStreamTargets parses the targets listed under a TCP/UDP mapping.
+// Targets use "host:port" or "host|port" (a bare port means 127.0.0.1) and may carry
+// balancing parameters: "192.168.50.1|22 weight=2", "192.168.50.2|22 backup".
+// Targets that cannot be used are returned separately together with the reason.
+func ResolveStreamTargets(values []string, balance StreamBalance) ([]Upstream, []UnusedStreamTarget) {
+	var used []Upstream
+	var unused []UnusedStreamTarget
+	seen := make(map[string]bool)
+
+	for _, value := range values {
+		raw := strings.TrimSpace(value)
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+
+		addr := fields[0]
+		// The listener-style "host|port" separator is accepted for stream targets.
+		if pipeIdx := strings.Index(addr, "|"); pipeIdx >= 0 {
+			addr = addr[:pipeIdx] + ":" + addr[pipeIdx+1:]
+		}
+		if !hasExplicitPort(addr) {
+			unused = append(unused, UnusedStreamTarget{Target: raw, Reason: "port is required for TCP/UDP targets"})
+			continue
+		}
+
+		up := parseUpstreamAddr(addr)
+		var paramErr error
+		for _, param := range fields[1:] {
+			if err := applyUpstreamParam(&up, param); err != nil {
+				paramErr = err
+				break
+			}
+		}
+		if paramErr != nil {
+			unused = append(unused, UnusedStreamTarget{Target: raw, Reason: paramErr.Error()})
+			continue
+		}
+		if up.Backup && balance == StreamBalanceHash {
+			unused = append(unused, UnusedStreamTarget{Target: raw, Reason: "backup servers cannot be used with balance=hash"})
+			continue
+		}
+
+		id := up.Host + "|" + up.Port
+		if seen[id] {
+			unused = append(unused, UnusedStreamTarget{Target: raw, Reason: "duplicate target"})
+			continue
+		}
+		seen[id] = true
+		used = append(used, up)
+	}
+
+	return used, unused
+}
+
+// StreamListener is the TCP/UDP forwarding of one listen address, merged from every
+// proxy.yaml key that names it
+type StreamListener struct {
+	Listen   ListenConfig
+	Balance  StreamBalance
+	Targets  []Upstream
+	Unused   []UnusedStreamTarget
+	Problems []string // keys that could not be parsed or merged
+}
+
+// ResolveStreams resolves the TCP/UDP mappings of ports per listener, in key order.
+// Keys sharing a listener are merged when their balance methods match, and their targets
+// are resolved as one list, so duplicates and backup servers under balance=hash are
+// caught across keys. A key with another balance method is left out.
+func ResolveStreams(ports map[string][]string) []StreamListener {
+	var out []StreamListener
+	index := make(map[string]int)
+	values := make(map[int][]string)
+	firstKey := make(map[int]string)
+
+	for _, key := range sortedKeys(ports) {
+		if !IsStreamKey(key) {
+			continue
+		}
+		listen, balance, err := ParseStreamListenKey(key)
+		id := string(listen.Protocol) + "|" + listen.Host + "|" + listen.Port
+		idx, ok := index[id]
+		if !ok {
+			idx = len(out)
+			index[id] = idx
+			out = append(out, StreamListener{Listen: listen, Balance: balance})
+		}
+		l := &out[idx]
+		switch {
+		case err != nil:
+			l.Problems = append(l.Problems, fmt.Sprintf("%s: %v", key, err))
+			continue
+		case firstKey[idx] == "":
+			firstKey[idx] = key
+			l.Balance = balance
+		case balance != l.Balance:
+			l.Problems = append(l.Problems, fmt.Sprintf("%s: balance=%s does not match balance=%s of %s; key ignored", key, balance, l.Balance, firstKey[idx]))
+			continue
+		}
+		values[idx] = append(values[idx], ports[key]...)
+	}
+
+	for i := range out {
+		out[i].Targets, out[i].Unused = ResolveStreamTargets(values[i], out[i].Balance)
+	}
+	return out
+}
+
+// hasExplicitPort reports whether a stream target address names a port
+func hasExplicitPort(addr string) bool {
+	if strings.HasPrefix(addr, "<") {
+		if closeIdx := strings.Index(addr, ">"); closeIdx > 0 {
+			addr = addr[closeIdx+1:]
+		}
+	}
+	if isNumeric(addr) {
+		return true
+	}
+	if strings.HasPrefix(addr, "[") {
+		closeBracket := strings.Index(addr, "]")
+		return closeBracket > 0 && closeBracket < len(addr)-2 && addr[closeBracket+1] == ':'
+	}
+	lastColon := strings.LastIndex(addr, ":")
+	return lastColon >= 0 && isNumeric(addr[lastColon+1:])
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStreamListenKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		proto   Protocol
+		host    string
+		port    string
+		balance StreamBalance
+		wantErr bool
+	}{
+		{key: "<tcp>9122", proto: ProtocolTCP, port: "9122", balance: StreamBalanceRoundRobin},
+		{key: "<udp>27015 balance=hash", proto: ProtocolUDP, port: "27015", balance: StreamBalanceHash},
+		{key: "<tcp>192.168.50.1|22 balance=least_conn", proto: ProtocolTCP, host: "192.168.50.1", port: "22", balance: StreamBalanceLeastConn},
+		{key: "<tcp>9122 balance=random", proto: ProtocolTCP, port: "9122", wantErr: true},
+		{key: "<tcp>9122 weight=2", proto: ProtocolTCP, port: "9122", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		listen, balance, err := ParseStreamListenKey(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseStreamListenKey(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if listen.Protocol != tt.proto || listen.Host != tt.host || listen.Port != tt.port {
+			t.Errorf("ParseStreamListenKey(%q) = %+v", tt.key, listen)
+		}
+		if !tt.wantErr && balance != tt.balance {
+			t.Errorf("ParseStreamListenKey(%q) balance = %q, want %q", tt.key, balance, tt.balance)
+		}
+	}
+}
+
+func TestResolveStreamTargets(t *testing.T) {
+	used, unused := ResolveStreamTargets([]string{
+		"192.168.50.1|22 weight=2",
+		"192.168.50.2:22",
+		"8122",
+		"[::1]|2222",
+		"192.168.50.2|22",
+		"ssh.internal",
+		"192.168.50.3:22 weight=x",
+	}, StreamBalanceRoundRobin)
+
+	if len(used) != 4 {
+		t.Fatalf("expected 4 used targets, got %+v", used)
+	}
+	if used[0].Host != "192.168.50.1" || used[0].Port != "22" || used[0].Weight != 2 {
+		t.Errorf("unexpected first target: %+v", used[0])
+	}
+	if used[2].Host != "127.0.0.1" || used[2].Port != "8122" {
+		t.Errorf("bare port should target localhost: %+v", used[2])
+	}
+	if used[3].Host != "::1" || used[3].Port != "2222" {
+		t.Errorf("unexpected IPv6 target: %+v", used[3])
+	}
+
+	if len(unused) != 3 {
+		t.Fatalf("expected 3 unused targets, got %+v", unused)
+	}
+	if unused[0].Target != "192.168.50.2|22" || unused[0].Reason != "duplicate target" {
+		t.Errorf("unexpected duplicate report: %+v", unused[0])
+	}
+	if unused[1].Target != "ssh.internal" {
+		t.Errorf("expected missing port report, got %+v", unused[1])
+	}
+}
+
+func TestResolveStreamTargets_BackupWithHash(t *testing.T) {
+	used, unused := ResolveStreamTargets([]string{"10.0.0.1:53", "10.0.0.2:53 backup"}, StreamBalanceHash)
+	if len(used) != 1 || len(unused) != 1 {
+		t.Fatalf("expected backup target to be unused with hash, got used=%+v unused=%+v", used, unused)
+	}
+}
+
+func TestResolveStreams_MergesKeysOfOneListener(t *testing.T) {
+	streams := ResolveStreams(map[string][]string{
+		"<udp>53 balance=hash":       {"10.0.0.1:53", "10.0.0.2:53"},
+		"<udp>53 balance=HASH":       {"10.0.0.2:53", "10.0.0.3:53 backup", "10.0.0.4:53"},
+		"<udp>53 balance=least_conn": {"10.0.0.5:53"},
+		"<tcp>22 balance=fast":       {"10.0.0.1:22"},
+		"8080":                       {"example.com"},
+	})
+	if len(streams) != 2 {
+		t.Fatalf("expected 2 listeners, got %+v", streams)
+	}
+
+	tcp := streams[0]
+	if len(tcp.Targets) != 0 || len(tcp.Problems) != 1 || !strings.Contains(tcp.Problems[0], `unknown balance method "fast"`) {
+		t.Errorf("expected the invalid key to be reported, got %+v", tcp)
+	}
+
+	udp := streams[1]
+	if udp.Balance != StreamBalanceHash || len(udp.Targets) != 3 {
+		t.Fatalf("expected 3 merged hash targets, got %+v", udp)
+	}
+	reasons := make(map[string]string)
+	for _, u := range udp.Unused {
+		reasons[u.Target] = u.Reason
+	}
+	if reasons["10.0.0.2:53"] != "duplicate target" || reasons["10.0.0.3:53 backup"] != "backup servers cannot be used with balance=hash" {
+		t.Errorf("unexpected unused targets: %+v", udp.Unused)
+	}
+	if len(udp.Problems) != 1 || !strings.Contains(udp.Problems[0], "<udp>53 balance=least_conn: balance=least_conn does not match balance=hash") {
+		t.Errorf("expected the key with another balance method to be ignored, got %q", udp.Problems)
+	}
+}
@@ -0,0 +1,234 @@
+// Package localca keeps a private root CA and signs leaf certificates for
+// development domains that have no certificate of their own.
+package localca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+const (
+	// DefaultLeafValidity is the lifetime of signed leaf certificates unless configured
+	DefaultLeafValidity = 365 * 24 * time.Hour
+
+	rootCertFile = "root.pem"
+	rootKeyFile  = "root.key"
+	leavesDir    = "leaves"
+	rootValidity = 10 * 365 * 24 * time.Hour
+	rootName     = "sslly-nginx Local CA"
+)
+
+// CA is a root certificate and key stored on disk
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Open loads the root CA from dir, creating it on first use
+func Open(dir string) (*CA, error) {
+	ca := &CA{dir: dir}
+	certPath := filepath.Join(dir, rootCertFile)
+	keyPath := filepath.Join(dir, rootKeyFile)
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := ca.create(certPath, keyPath); err != nil {
+			return nil, err
+		}
+		return ca, nil
+	}
+
+	cert, key, err := readPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load local CA: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("load local CA: %s is not a CA certificate", certPath)
+	}
+	ca.cert, ca.key = cert, key
+	return ca, nil
+}
+
+// RootPath returns the root certificate that clients need to trust
+func (ca *CA) RootPath() string {
+	return filepath.Join(ca.dir, rootCertFile)
+}
+
+func (ca *CA) create(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate local CA key: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: rootName, Organization: []string{"sslly-nginx"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(rootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create local CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("parse local CA certificate: %w", err)
+	}
+	if err := writePair(certPath, keyPath, der, key); err != nil {
+		return err
+	}
+	ca.cert, ca.key = cert, key
+	return nil
+}
+
+// Leaf returns a certificate for domain signed by the root. The stored leaf is reused
+// while it is signed by this root and has more than a third of its validity left;
+// issued reports whether a new one had to be signed.
+func (ca *CA) Leaf(domain string, validity time.Duration, now time.Time) (cert ssl.Certificate, issued bool, err error) {
+	safe := strings.ReplaceAll(domain, "*", "_wildcard")
+	certPath := filepath.Join(ca.dir, leavesDir, safe+".pem")
+	keyPath := filepath.Join(ca.dir, leavesDir, safe+".key")
+
+	if leaf, _, err := readPair(certPath, keyPath); err == nil && ca.reusable(leaf, domain, validity, now) {
+		return ssl.Certificate{CertPath: certPath, KeyPath: keyPath, NotBefore: leaf.NotBefore, NotAfter: leaf.NotAfter}, false, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return ssl.Certificate{}, false, fmt.Errorf("generate key for %s: %w", domain, err)
+	}
+	notBefore := now.Add(-time.Hour).Truncate(time.Second)
+	notAfter := now.Add(validity).Truncate(time.Second)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: domain},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{domain}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return ssl.Certificate{}, false, fmt.Errorf("sign certificate for %s: %w", domain, err)
+	}
+	if err := writePair(certPath, keyPath, der, key); err != nil {
+		return ssl.Certificate{}, false, err
+	}
+	return ssl.Certificate{CertPath: certPath, KeyPath: keyPath, NotBefore: notBefore, NotAfter: notAfter}, true, nil
+}
+
+func (ca *CA) reusable(leaf *x509.Certificate, domain string, validity time.Duration, now time.Time) bool {
+	if leaf.CheckSignatureFrom(ca.cert) != nil {
+		return false
+	}
+	if leaf.VerifyHostname(domain) != nil && !containsName(leaf.DNSNames, domain) {
+		return false
+	}
+	return leaf.NotAfter.Sub(now) > validity/3
+}
+
+func containsName(names []string, domain string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether domain is covered by one of the patterns. An empty list
+// covers every domain; "*.lan" covers the names one label below "lan", like
+// "printer.lan" (see ssl.WildcardPattern).
+func Matches(patterns []string, domain string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	wildcard := ssl.WildcardPattern(domain)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == domain || (wildcard != "" && p == wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+func readPair(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s is not PEM", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %s: %w", certPath, err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s is not PEM", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %s: %w", keyPath, err)
+	}
+	return cert, key, nil
+}
+
+func writePair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Dir(certPath), err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("write %s: %w", keyPath, err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", certPath, err)
+	}
+	return nil
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
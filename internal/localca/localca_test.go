@@ -0,0 +1,107 @@
+package localca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpen_CreatesAndReloadsRoot(t *testing.T) {
+	dir := t.TempDir()
+	first, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !first.cert.IsCA {
+		t.Fatal("expected a CA certificate")
+	}
+	second, err := Open(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !first.cert.Equal(second.cert) {
+		t.Fatal("expected the stored root to be reused")
+	}
+}
+
+func TestCA_LeafVerifiesAgainstRoot(t *testing.T) {
+	ca, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert, issued, err := ca.Leaf("app.lan", DefaultLeafValidity, now)
+	if err != nil {
+		t.Fatalf("Leaf: %v", err)
+	}
+	if !issued {
+		t.Fatal("expected a new leaf")
+	}
+
+	data, err := os.ReadFile(cert.CertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "app.lan", Roots: roots}); err != nil {
+		t.Fatalf("leaf does not verify against root: %v", err)
+	}
+}
+
+func TestCA_LeafReusedUntilRenewal(t *testing.T) {
+	ca, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	validity := 90 * 24 * time.Hour
+	now := time.Now()
+	first, _, err := ca.Leaf("app.lan", validity, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, issued, err := ca.Leaf("app.lan", validity, now.Add(30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued || !again.NotAfter.Equal(first.NotAfter) {
+		t.Fatal("expected the stored leaf to be reused")
+	}
+
+	renewed, issued, err := ca.Leaf("app.lan", validity, now.Add(70*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issued || !renewed.NotAfter.After(first.NotAfter) {
+		t.Fatal("expected a renewed leaf within the last third of its validity")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		domain   string
+		want     bool
+	}{
+		{nil, "anything.example.com", true},
+		{[]string{"*.lan"}, "app.lan", true},
+		{[]string{"*.lan"}, "a.b.lan", false}, // one label, like a certificate
+		{[]string{"*.lan"}, "lan", false},
+		{[]string{"*.lan", "dev.internal"}, "dev.internal", true},
+		{[]string{"*.lan", "dev.internal"}, "api.dev.internal", false},
+		{[]string{"*.lan"}, "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.patterns, tt.domain); got != tt.want {
+			t.Errorf("Matches(%v, %q) = %v, want %v", tt.patterns, tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package nginx
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+)
+
+// clientAuth is the client certificate verification of one server block
+type clientAuth struct {
+	Verify string // ssl_verify_client: "on" or "optional"; empty when not verified
+	CA     string
+	CRL    string
+	Depth  int
+
+	DenyAll       bool     // verification required but unavailable
+	RequiredPaths []string // refused without a verified certificate
+	DeniedPaths   []string // verification required but unavailable
+}
+
+// clientAuthFor resolves tls.yaml client_auth for the server of domain. Entries that
+// cannot be enforced (no certificate, unusable CA, a second CA bundle in one server)
+// refuse their requests instead of serving them unprotected.
+func clientAuthFor(cfg *config.Config, domain string, tls bool) clientAuth {
+	var ca clientAuth
+	entries := cfg.TLS.ClientAuth
+	if domain == "" || len(entries) == 0 {
+		return ca
+	}
+
+	var domainKeys, paths []string
+	prefix := strings.ToLower(domain) + "/"
+	for key := range entries {
+		if strings.HasPrefix(key, prefix) {
+			paths = append(paths, key)
+		} else if !strings.Contains(key, "/") {
+			domainKeys = append(domainKeys, key)
+		}
+	}
+	sort.Strings(paths)
+
+	if key, ok := matchDomainKey(domainKeys, domain); ok {
+		entry := entries[key]
+		switch {
+		case !tls || entry.CA == "":
+			ca.DenyAll = entry.Mode != config.ClientAuthOptional
+		case entry.Mode == config.ClientAuthOptional:
+			ca.useCA(entry, "optional")
+		default:
+			ca.useCA(entry, "on")
+		}
+		if ca.DenyAll {
+			return ca
+		}
+	}
+
+	for _, key := range paths {
+		entry := entries[key]
+		path := key[len(prefix)-1:]
+		required := entry.Mode != config.ClientAuthOptional
+		usable := tls && entry.CA != ""
+		if usable && ca.Verify == "" {
+			ca.useCA(entry, "optional")
+		}
+		if usable && (entry.CA != ca.CA || entry.CRL != ca.CRL) {
+			logger.Warn("tls.yaml: client_auth: %s uses another CA than the rest of %s; nginx verifies one CA bundle per server", key, domain)
+			usable = false
+		}
+		switch {
+		case !usable && required:
+			ca.DeniedPaths = append(ca.DeniedPaths, path)
+		case usable && required && ca.Verify != "on":
+			ca.RequiredPaths = append(ca.RequiredPaths, path)
+		}
+	}
+	return ca
+}
+
+func (ca *clientAuth) useCA(entry config.ClientAuthConfig, verify string) {
+	ca.Verify, ca.CA, ca.CRL, ca.Depth = verify, entry.CA, entry.CRL, entry.VerifyDepth
+}
+
+// writeClientAuthDirectives writes the verification settings and the server-level checks
+// that refuse requests. allowACME keeps HTTP-01 challenges reachable on a refusing server.
+func writeClientAuthDirectives(sb *strings.Builder, ca clientAuth, allowACME bool) {
+	if ca.DenyAll {
+		sb.WriteString("        # Client certificate required but not verifiable here (see the tls.yaml warnings)\n")
+		if allowACME {
+			sb.WriteString(`        if ($uri !~ "^/\.well-known/acme-challenge/") {
+            return 403;
+        }
+
+`)
+		} else {
+			sb.WriteString("        return 403;\n\n")
+		}
+		return
+	}
+
+	if ca.Verify != "" {
+		sb.WriteString("        # Client certificates (tls.yaml client_auth)\n")
+		sb.WriteString("        ssl_client_certificate " + ca.CA + ";\n")
+		if ca.CRL != "" {
+			sb.WriteString("        ssl_crl " + ca.CRL + ";\n")
+		}
+		sb.WriteString("        ssl_verify_client " + ca.Verify + ";\n")
+		sb.WriteString(fmt.Sprintf("        ssl_verify_depth %d;\n", max(ca.Depth, 1)))
+		if len(ca.RequiredPaths) > 0 {
+			sb.WriteString(`        set $sslly_client_auth "";
+        if ($ssl_client_verify != SUCCESS) {
+            set $sslly_client_auth "unverified";
+        }
+        if ($uri ~ "` + clientAuthPathRegex(ca.RequiredPaths) + `") {
+            set $sslly_client_auth "${sslly_client_auth}:protected";
+        }
+        if ($sslly_client_auth = "unverified:protected") {
+            return 403;
+        }
+`)
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(ca.DeniedPaths) > 0 {
+		sb.WriteString(`        # Client certificate required but not verifiable here (see the tls.yaml warnings)
+        if ($uri ~ "` + clientAuthPathRegex(ca.DeniedPaths) + `") {
+            return 403;
+        }
+
+`)
+	}
+}
+
+// clientAuthPathRegex matches the paths and everything below them
+func clientAuthPathRegex(paths []string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = regexp.QuoteMeta(p)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")(/|$)"
+}
+
+// clientCertHeaders forwards the verified client certificate. They are set (possibly
+// empty) on every proxied request of a verifying server, so clients cannot forge them.
+const clientCertHeaders = `            # Verified client certificate
+            proxy_set_header X-SSL-Client-Verify $ssl_client_verify;
+            proxy_set_header X-SSL-Client-DN $ssl_client_s_dn;
+            proxy_set_header X-SSL-Client-Fingerprint $ssl_client_fingerprint;
+
+`
+
+// noClientCertHeaders drops the same headers on servers that do not verify clients, so
+// a backend shared with a verifying domain cannot be sent forged ones.
+const noClientCertHeaders = `            # No client certificate is verified here
+            proxy_set_header X-SSL-Client-Verify "";
+            proxy_set_header X-SSL-Client-DN "";
+            proxy_set_header X-SSL-Client-Fingerprint "";
+
+`
@@ -0,0 +1,88 @@
+package nginx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestClientAuthFor(t *testing.T) {
+	clients := config.ClientAuthConfig{CA: "/runtime/clients.ca.pem", Mode: config.ClientAuthRequired, VerifyDepth: 2}
+	partners := config.ClientAuthConfig{CA: "/runtime/partners.ca.pem", Mode: config.ClientAuthRequired, VerifyDepth: 1}
+	cfg := &config.Config{TLS: config.TLSConfig{ClientAuth: map[string]config.ClientAuthConfig{
+		"*.internal.example.com":   clients,
+		"app.example.com/admin":    clients,
+		"app.example.com/partners": partners,
+		"app.example.com/status":   {CA: clients.CA, Mode: config.ClientAuthOptional, VerifyDepth: 2},
+		"broken.example.com":       {Mode: config.ClientAuthRequired},
+	}}}
+
+	tests := []struct {
+		name   string
+		domain string
+		tls    bool
+		want   clientAuth
+	}{
+		{"wildcard domain", "db.internal.example.com", true, clientAuth{Verify: "on", CA: clients.CA, Depth: 2}},
+		{"no certificate", "db.internal.example.com", false, clientAuth{DenyAll: true}},
+		{"wildcard covers one label", "a.db.internal.example.com", true, clientAuth{}},
+		{"unusable CA", "broken.example.com", true, clientAuth{DenyAll: true}},
+		{"paths", "app.example.com", true, clientAuth{
+			Verify: "optional", CA: clients.CA, Depth: 2,
+			RequiredPaths: []string{"/admin"},
+			DeniedPaths:   []string{"/partners"}, // second CA bundle in one server
+		}},
+		{"paths without certificate", "app.example.com", false, clientAuth{DeniedPaths: []string{"/admin", "/partners"}}},
+		{"not configured", "other.example.com", true, clientAuth{}},
+	}
+	for _, tt := range tests {
+		if got := clientAuthFor(cfg, tt.domain, tt.tls); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: clientAuthFor(%q) = %+v, want %+v", tt.name, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateConfig_ClientAuth(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"app.example.com", "db.example.com", "plain.example.com"}},
+		TLS: config.TLSConfig{ClientAuth: map[string]config.ClientAuthConfig{
+			"db.example.com":        {CA: "/runtime/clients.ca.pem", CRL: "/runtime/clients.crl.pem", Mode: config.ClientAuthRequired, VerifyDepth: 1},
+			"app.example.com/admin": {CA: "/runtime/clients.ca.pem", Mode: config.ClientAuthRequired, VerifyDepth: 1},
+			"plain.example.com":     {CA: "/runtime/clients.ca.pem", Mode: config.ClientAuthRequired, VerifyDepth: 1},
+		}},
+	}
+	certs := map[string]ssl.Certificate{
+		"app.example.com": {CertPath: "/certs/app.pem", KeyPath: "/certs/app.key"},
+		"db.example.com":  {CertPath: "/certs/db.pem", KeyPath: "/certs/db.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	for _, want := range []string{
+		"ssl_client_certificate /runtime/clients.ca.pem;\n        ssl_crl /runtime/clients.crl.pem;\n        ssl_verify_client on;\n        ssl_verify_depth 1;\n",
+		"ssl_verify_client optional;\n",
+		`if ($uri ~ "^(/admin)(/|$)") {`,
+		`if ($sslly_client_auth = "unverified:protected") {`,
+		"proxy_set_header X-SSL-Client-Verify $ssl_client_verify;",
+	} {
+		if !strings.Contains(ng, want) {
+			t.Errorf("expected %q in config:\n%s", want, ng)
+		}
+	}
+
+	// plain.example.com has no certificate: its HTTP server (after the HTTPS redirect) refuses every request.
+	plain := ng[strings.LastIndex(ng, "server_name plain.example.com;"):]
+	plain = plain[:strings.Index(plain, "\n    }\n")]
+	if !strings.Contains(plain, "return 403;") || strings.Contains(plain, "ssl_client_certificate") {
+		t.Errorf("expected plain.example.com to be refused:\n%s", plain)
+	}
+	if strings.Count(ng, "X-SSL-Client-Verify $ssl_client_verify;") != 2 {
+		t.Errorf("client certificate headers belong to the verifying servers only:\n%s", ng)
+	}
+	// Other servers clear them, so clients cannot forge them for a shared backend.
+	if !strings.Contains(ng, `proxy_set_header X-SSL-Client-Verify "";`) || !strings.Contains(ng, `proxy_set_header X-SSL-Client-Fingerprint "";`) {
+		t.Errorf("expected the client certificate headers cleared on other servers:\n%s", ng)
+	}
+}
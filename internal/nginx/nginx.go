@@ -1,11 +1,15 @@
 package nginx
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,16 +18,73 @@ import (
 	"github.com/hnrobert/sslly-nginx/internal/ssl"
 )
 
+// Supervision defaults: restarts back off exponentially from restartBackoff up to
+// maxRestartBackoff, and supervision gives up after maxRestarts consecutive failures.
+// A master that stayed up for stableUptime resets the failure count.
+const (
+	defaultRestartBackoff    = 1 * time.Second
+	defaultMaxRestartBackoff = 30 * time.Second
+	defaultMaxRestarts       = 5
+	defaultStableUptime      = 60 * time.Second
+)
+
+// Shutdown defaults: nginx gets drainTimeout to finish in-flight requests after SIGQUIT,
+// then termTimeout after SIGTERM before it is killed.
+const (
+	defaultDrainTimeout = 30 * time.Second
+	defaultTermTimeout  = 5 * time.Second
+	drainProgressEvery  = 5 * time.Second
+)
+
+// ACMEChallengeDir holds HTTP-01 challenge responses; nginx serves it under
+// /.well-known/acme-challenge/ on the HTTP port when ACME is enabled.
+const ACMEChallengeDir = "/tmp/sslly-acme-challenge"
+
 type Manager struct {
-	cmd *exec.Cmd
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	done     chan struct{} // closed when cmd exits
+	bindErrs *bindErrorWatcher
+	stopping bool
+	stopCh   chan struct{}
+	exitCh   chan processExit
+	failedCh chan error
+
+	// newCmd builds the nginx master command (replaceable in tests)
+	newCmd func() *exec.Cmd
+
+	// BeforeRestart runs before the supervisor restarts a crashed master,
+	// e.g. to restore the last-good runtime snapshot.
+	BeforeRestart func() error
+
+	restartBackoff    time.Duration
+	maxRestartBackoff time.Duration
+	maxRestarts       int
+	stableUptime      time.Duration
+	drainTimeout      time.Duration
+	termTimeout       time.Duration
+	readyTimeout      time.Duration
+
+	pidPath  string
+	confPath string
+}
+
+// processExit reports the end of one nginx master process
+type processExit struct {
+	cmd    *exec.Cmd
+	err    error
+	uptime time.Duration
 }
 
-// RouteConfig represents a routing configuration for a domain/path combination
+// RouteConfig represents a routing configuration for a domain/path combination.
+// Upstreams lists every backend feeding the route; when more than one is present
+// (or balancing parameters are set) the route is served through a named upstream pool.
 type RouteConfig struct {
-	Upstream   config.Upstream
+	Upstreams  []config.Upstream
 	DomainPath string
 	BaseDomain string
 	Path       string
+	Pool       string // Name of the upstream block; set by generateUpstreamPools for pooled routes
 }
 
 // StaticRouteConfig represents a static site routing configuration
@@ -35,15 +96,102 @@ type StaticRouteConfig struct {
 	HasIndex   bool
 }
 
+// serverKey identifies one generated HTTP/HTTPS server block
+type serverKey struct {
+	Domain string // server_name; empty for a port-only (catch-all) listener
+	Port   string
+	SSL    bool
+}
+
+// serverBlock collects everything served by one HTTP/HTTPS server block
+type serverBlock struct {
+	serverKey
+	Cert         ssl.Certificate
+	HasCert      bool
+	Routes       []RouteConfig
+	StaticRoutes []StaticRouteConfig
+}
+
+func protocolName(ssl bool) string {
+	if ssl {
+		return "HTTPS"
+	}
+	return "HTTP"
+}
+
 func NewManager() *Manager {
-	return &Manager{}
+	return &Manager{
+		stopCh:   make(chan struct{}),
+		exitCh:   make(chan processExit, 1),
+		failedCh: make(chan error, 1),
+		newCmd: func() *exec.Cmd {
+			return exec.Command("nginx", "-g", "daemon off;")
+		},
+		restartBackoff:    defaultRestartBackoff,
+		maxRestartBackoff: defaultMaxRestartBackoff,
+		maxRestarts:       defaultMaxRestarts,
+		stableUptime:      defaultStableUptime,
+		drainTimeout:      drainTimeoutFromEnv(),
+		termTimeout:       defaultTermTimeout,
+		readyTimeout:      defaultReadyTimeout,
+		pidPath:           defaultPidPath,
+		confPath:          defaultConfPath,
+	}
+}
+
+// drainTimeoutFromEnv reads SSLLY_SHUTDOWN_DRAIN_TIMEOUT (e.g. "30s", "2m")
+func drainTimeoutFromEnv() time.Duration {
+	v := os.Getenv("SSLLY_SHUTDOWN_DRAIN_TIMEOUT")
+	if v == "" {
+		return defaultDrainTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logger.Warn("Invalid SSLLY_SHUTDOWN_DRAIN_TIMEOUT %q, using %s", v, defaultDrainTimeout)
+		return defaultDrainTimeout
+	}
+	return d
 }
 
+// Start launches the nginx master and supervises it: when the master exits unexpectedly
+// it is restarted with exponential backoff until Stop is called or restarts keep failing.
 func (m *Manager) Start() error {
 	logger.Info("Starting nginx...")
 
+	if err := m.startProcess(); err != nil {
+		return err
+	}
+
+	if err := m.waitReady(m.readyTimeout); err != nil {
+		// Do not leave a half-started master behind (e.g. retrying a busy port).
+		if proc := m.process(); proc != nil {
+			_ = proc.Kill()
+		}
+		return err
+	}
+	logger.Info("nginx is ready")
+
+	go m.supervise()
+	return nil
+}
+
+// Failed is signalled once supervision gives up restarting nginx
+func (m *Manager) Failed() <-chan error {
+	return m.failedCh
+}
+
+// errStopping is returned by startProcess once Stop has been called
+var errStopping = errors.New("nginx is stopping")
+
+// startProcess starts one nginx master process and reports its exit on exitCh. A master
+// started while Stop runs is killed, since Stop only waits for the one it saw.
+func (m *Manager) startProcess() error {
+	if m.isStopping() {
+		return errStopping
+	}
+
 	// Remove stale PID file if it exists (we use /tmp for non-root compatibility)
-	_ = os.Remove("/tmp/nginx.pid")
+	_ = os.Remove(m.pidPath)
 
 	// Ensure nginx temp directories are writable in non-root containers.
 	_ = os.MkdirAll("/tmp/nginx/client_body", 0777)
@@ -52,29 +200,211 @@ func (m *Manager) Start() error {
 	_ = os.MkdirAll("/tmp/nginx/uwsgi", 0777)
 	_ = os.MkdirAll("/tmp/nginx/scgi", 0777)
 
-	cmd := exec.Command("nginx", "-g", "daemon off;")
+	cmd := m.newCmd()
 	// Important: by default, os/exec discards child stdout/stderr.
 	// Pipe nginx logs through our logger with [NGINX-PROCS] prefix.
 	cmd.Stdout = logger.NewNginxStdoutWriter()
-	cmd.Stderr = logger.NewNginxStderrWriter()
+	bindErrs := &bindErrorWatcher{next: logger.NewNginxStderrWriter()}
+	cmd.Stderr = bindErrs
 
 	// Start nginx in background
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start nginx: %w", err)
 	}
-
+	started := time.Now()
+	done := make(chan struct{})
+
+	go func() {
+		err := cmd.Wait()
+		close(done)
+		select {
+		case m.exitCh <- processExit{cmd: cmd, err: err, uptime: time.Since(started)}:
+		case <-m.stopCh:
+		}
+	}()
+
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		_ = cmd.Process.Kill()
+		<-done
+		return errStopping
+	}
 	m.cmd = cmd
+	m.done = done
+	m.bindErrs = bindErrs
+	m.mu.Unlock()
+	return nil
+}
 
-	// Wait a moment for nginx to start.
-	time.Sleep(2 * time.Second)
+// supervise restarts the nginx master whenever it exits while not stopping
+func (m *Manager) supervise() {
+	backoff := m.restartBackoff
+	failures := 0
+
+	for {
+		var exit processExit
+		select {
+		case exit = <-m.exitCh:
+		case <-m.stopCh:
+			return
+		}
+		if m.isStopping() {
+			return
+		}
 
-	return nil
+		logger.NginxError("nginx master (pid %d) exited after %s: %s", exit.cmd.Process.Pid, exit.uptime.Round(time.Second), describeExit(exit.cmd, exit.err))
+		if exit.uptime >= m.stableUptime {
+			backoff = m.restartBackoff
+			failures = 0
+		}
+
+		for {
+			failures++
+			if failures > m.maxRestarts {
+				err := fmt.Errorf("nginx failed %d consecutive restarts, giving up", m.maxRestarts)
+				logger.Error("%v", err)
+				m.failedCh <- err
+				return
+			}
+
+			logger.Warn("Restarting nginx in %s (attempt %d/%d)", backoff, failures, m.maxRestarts)
+			select {
+			case <-time.After(backoff):
+			case <-m.stopCh:
+				return
+			}
+			backoff *= 2
+			if backoff > m.maxRestartBackoff {
+				backoff = m.maxRestartBackoff
+			}
+			if m.isStopping() {
+				return
+			}
+
+			if m.BeforeRestart != nil {
+				if err := m.BeforeRestart(); err != nil {
+					logger.Warn("Failed to prepare nginx restart: %v", err)
+				}
+			}
+			if err := m.startProcess(); err != nil {
+				if errors.Is(err, errStopping) {
+					return
+				}
+				logger.Error("%v", err)
+				continue
+			}
+			if err := m.waitReady(m.readyTimeout); err != nil {
+				logger.Warn("nginx restarted but is not ready: %v", err)
+			} else {
+				logger.Info("nginx restarted")
+			}
+			break
+		}
+	}
+}
+
+// describeExit renders how an nginx master process ended
+func describeExit(cmd *exec.Cmd, err error) string {
+	if state := cmd.ProcessState; state != nil {
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return fmt.Sprintf("killed by signal %s", ws.Signal())
+		}
+		return fmt.Sprintf("exit status %d", state.ExitCode())
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "exited"
+}
+
+func (m *Manager) isStopping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopping
+}
+
+// process returns the current nginx master process, if any
+func (m *Manager) process() *os.Process {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cmd == nil {
+		return nil
+	}
+	return m.cmd.Process
 }
 
+// Stop shuts nginx down gracefully. SIGQUIT lets workers finish in-flight requests
+// (uploads, WebSocket sessions); if the master is still running after the drain timeout
+// it gets SIGTERM, then SIGKILL.
 func (m *Manager) Stop() {
-	if m.cmd != nil && m.cmd.Process != nil {
-		logger.Info("Stopping nginx...")
-		m.cmd.Process.Kill()
+	m.mu.Lock()
+	if !m.stopping {
+		m.stopping = true
+		close(m.stopCh)
+	}
+	var proc *os.Process
+	if m.cmd != nil {
+		proc = m.cmd.Process
+	}
+	done := m.done
+	m.mu.Unlock()
+
+	if proc == nil || done == nil {
+		return
+	}
+	select {
+	case <-done:
+		return
+	default:
+	}
+
+	logger.Info("Stopping nginx gracefully (drain timeout %s)...", m.drainTimeout)
+	if err := proc.Signal(syscall.SIGQUIT); err != nil {
+		logger.Warn("Failed to send SIGQUIT to nginx: %v", err)
+	}
+	if waitForExit(done, m.drainTimeout, true) {
+		logger.Info("nginx stopped gracefully")
+		return
+	}
+
+	logger.Warn("nginx still running after %s, sending SIGTERM", m.drainTimeout)
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		logger.Warn("Failed to send SIGTERM to nginx: %v", err)
+	}
+	if waitForExit(done, m.termTimeout, false) {
+		logger.Info("nginx stopped")
+		return
+	}
+
+	logger.Warn("nginx still running after SIGTERM, sending SIGKILL")
+	_ = proc.Kill()
+	if waitForExit(done, m.termTimeout, false) {
+		logger.Info("nginx killed")
+		return
+	}
+	logger.Error("nginx did not exit after SIGKILL")
+}
+
+// waitForExit waits up to timeout for done to close, optionally logging drain progress
+func waitForExit(done <-chan struct{}, timeout time.Duration, logProgress bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	progress := time.NewTicker(drainProgressEvery)
+	defer progress.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-done:
+			return true
+		case <-deadline.C:
+			return false
+		case <-progress.C:
+			if logProgress {
+				logger.Info("Waiting for nginx to drain connections (%s elapsed)", time.Since(start).Round(time.Second))
+			}
+		}
 	}
 }
 
@@ -90,8 +420,14 @@ func (m *Manager) Reload() error {
 
 	// Use kill -HUP to reload nginx gracefully instead of nginx -s reload
 	// This is more reliable when nginx is running in non-daemon mode
-	if m.cmd != nil && m.cmd.Process != nil {
-		if err := m.cmd.Process.Signal(os.Signal(syscall.SIGHUP)); err != nil {
+	if proc := m.process(); proc != nil {
+		// Only bind failures caused by this reload should fail the health check.
+		m.mu.Lock()
+		if m.bindErrs != nil {
+			_ = m.bindErrs.take()
+		}
+		m.mu.Unlock()
+		if err := proc.Signal(os.Signal(syscall.SIGHUP)); err != nil {
 			return fmt.Errorf("failed to send SIGHUP to nginx: %w", err)
 		}
 	} else {
@@ -101,6 +437,18 @@ func (m *Manager) Reload() error {
 	return nil
 }
 
+// TestConfig runs nginx -t against the given configuration file without touching the live one
+func (m *Manager) TestConfig(path string) error {
+	cmd := exec.Command("nginx", "-t", "-c", path)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nginx configuration test failed: %s", string(output))
+	}
+	return nil
+}
+
+// CheckHealth verifies the configuration and that the running master is serving
+// every listen socket of it.
 func (m *Manager) CheckHealth() error {
 	// Test nginx configuration
 	cmd := exec.Command("nginx", "-t")
@@ -109,6 +457,9 @@ func (m *Manager) CheckHealth() error {
 		return fmt.Errorf("nginx health check failed: %s", string(output))
 	}
 
+	if err := m.waitReady(m.readyTimeout); err != nil {
+		return fmt.Errorf("nginx health check failed: %w", err)
+	}
 	return nil
 }
 
@@ -209,6 +560,45 @@ func splitDomainPath(domainPath string) (string, string) {
 	return domainPath, ""
 }
 
+// writeCertificateDirectives writes one pair per key algorithm (e.g. ECDSA and RSA);
+// nginx picks per client.
+func writeCertificateDirectives(sb *strings.Builder, certs []ssl.Certificate) {
+	for _, c := range certs {
+		sb.WriteString(fmt.Sprintf(`        ssl_certificate %s;
+        ssl_certificate_key %s;
+`, c.CertPath, c.KeyPath))
+	}
+}
+
+// writeStaplingDirectives staples the cached OCSP response of the served certificate.
+// nginx staples the same file for every certificate of a server, so servers with
+// several key algorithms are not stapled.
+func writeStaplingDirectives(sb *strings.Builder, serverName string, certs []ssl.Certificate) {
+	if len(certs) == 1 {
+		if certs[0].OCSPPath != "" {
+			sb.WriteString(fmt.Sprintf(`        ssl_stapling on;
+        ssl_stapling_file %s;
+`, certs[0].OCSPPath))
+		}
+		return
+	}
+	for _, c := range certs {
+		if c.OCSPPath != "" {
+			logger.Warn("OCSP stapling disabled for %s: nginx cannot staple a separate response for each of its %d certificates", serverName, len(certs))
+			return
+		}
+	}
+}
+
+// formatServerName writes an IPv6 server name in brackets, as nginx sees it in the
+// Host header.
+func formatServerName(domain string) string {
+	if strings.Contains(domain, ":") {
+		return "[" + domain + "]"
+	}
+	return domain
+}
+
 // formatUpstreamAddr formats upstream address properly for nginx
 // IPv6 addresses need to be wrapped in brackets
 func formatUpstreamAddr(upstream config.Upstream) string {
@@ -230,6 +620,9 @@ func GenerateConfig(cfg *config.Config, certMap map[string]ssl.Certificate) stri
 		noTrailingSlash[p] = true
 	}
 
+	// Invalid tls.yaml entries are reported by CheckTLSConfig.
+	tlsPol, _ := newTLSPolicy(cfg.TLS)
+
 	var sb strings.Builder
 
 	// Read ports from environment with sensible defaults
@@ -257,33 +650,36 @@ func GenerateConfig(cfg *config.Config, certMap map[string]ssl.Certificate) stri
 	var streamMappings []StreamMapping
 	httpPorts := make(map[string]bool)
 
-	// First pass: identify stream mappings, HTTP ports, and static sites
-	for portKey, domainPaths := range cfg.Ports {
+	// First pass: identify HTTP ports and static sites
+	for _, portKey := range sortedPortKeys(cfg.Ports) {
 		// Check if it's a static site key - they use HTTP/HTTPS ports
 		if config.IsStaticSiteKey(portKey) {
 			httpPorts[httpPort] = true
 			httpPorts[httpsPort] = true
 			continue
 		}
-
-		listenConfig := config.ParseListenKey(portKey)
-
-		if listenConfig.Protocol.IsStream() {
-			// TCP/UDP mapping - get the upstream target from the first domain path
-			if len(domainPaths) > 0 {
-				upstream := config.ParseUpstream(domainPaths[0])
-				streamMappings = append(streamMappings, StreamMapping{
-					ListenConfig: listenConfig,
-					Upstream:     upstream,
-				})
-			}
-		} else {
+		if !config.IsStreamKey(portKey) {
 			// HTTP/HTTPS mapping
 			upstream := config.ParseUpstream(portKey)
 			httpPorts[upstream.Port] = true
 		}
 	}
 
+	// TCP/UDP mappings, merged per listener. Unusable targets are reported by the
+	// domain summary.
+	for _, l := range config.ResolveStreams(cfg.Ports) {
+		for _, p := range l.Problems {
+			logger.Warn("Stream mapping %s", p)
+		}
+		if len(l.Targets) > 0 {
+			streamMappings = append(streamMappings, StreamMapping{
+				ListenConfig: l.Listen,
+				Upstreams:    l.Targets,
+				Balance:      l.Balance,
+			})
+		}
+	}
+
 	// Nginx base configuration
 	// NOTE: We intentionally omit the "user" directive to avoid warnings in non-root containers.
 	sb.WriteString(fmt.Sprintf(`
@@ -342,13 +738,66 @@ events {
 
 `)
 
-	// Map: baseDomain -> []RouteConfig (for proxy routes)
-	domainRoutes := make(map[string][]RouteConfig)
-	// Map: baseDomain -> []StaticRouteConfig (for static sites)
-	staticRoutes := make(map[string][]StaticRouteConfig)
+	// Group proxy routes and static routes into server blocks. A server block is
+	// identified by server_name, listen port and protocol, so the same domain can be
+	// served on several ports (e.g. the public site on 443 and an admin UI on 8443).
+	servers := make(map[serverKey]*serverBlock)
+	// Map: listen port -> whether it is an SSL port. A port cannot mix both.
+	portSSL := map[string]bool{httpPort: false, httpsPort: true}
+	// Map: server + path -> index into serverBlock.Routes, used to merge pool members
+	routeIndex := make(map[string]int)
+
+	resolveServer := func(listenerKey string) (*serverBlock, config.HTTPListener, bool) {
+		listener := config.ParseHTTPListener(listenerKey)
+		cert, hasCert := ssl.FindCertificate(certMap, listener.Domain)
+		if hasCert && cert.KeyPath == "" {
+			hasCert = false
+		}
+
+		// Smart mode: HTTPS when a certificate is available, otherwise HTTP.
+		useSSL := hasCert
+		switch listener.Protocol {
+		case "":
+		case config.ProtocolHTTPS:
+			useSSL = true
+		case config.ProtocolHTTP:
+			useSSL = false
+		default:
+			logger.Warn("Listener %q ignored: listen protocol '%s' is not valid for HTTP mappings", listenerKey, listener.Protocol)
+			return nil, listener, false
+		}
+
+		port := listener.Port
+		if port == "" {
+			port = httpPort
+			if useSSL {
+				port = httpsPort
+			}
+		}
+		if claimedSSL, ok := portSSL[port]; ok && claimedSSL != useSSL {
+			logger.Warn("Listener %q ignored: port %s is already used for %s", listenerKey, port, protocolName(claimedSSL))
+			return nil, listener, false
+		}
+		portSSL[port] = useSSL
+
+		key := serverKey{Domain: listener.Domain, Port: port, SSL: useSSL}
+		srv, ok := servers[key]
+		if !ok {
+			srv = &serverBlock{serverKey: key}
+			if useSSL && hasCert {
+				srv.Cert = cert
+				srv.HasCert = true
+			}
+			servers[key] = srv
+		}
+		return srv, listener, true
+	}
+
+	// Parse all routes and group them by server block. Keys are visited in sorted order
+	// so pool membership and member order are stable across reloads.
+	for _, portKey := range sortedPortKeys(cfg.Ports) {
+		domainPaths := cfg.Ports[portKey]
 
-	// Parse all routes and group by base domain
-	for portKey, domainPaths := range cfg.Ports {
 		// Handle static sites
 		if config.IsStaticSiteKey(portKey) {
 			staticSpec, hasSpec := cfg.RuntimeStaticSites[portKey]
@@ -368,15 +817,19 @@ events {
 			}
 
 			for _, domainPath := range domainPaths {
-				baseDomain, path := splitDomainPath(domainPath)
+				srv, listener, ok := resolveServer(domainPath)
+				if !ok {
+					continue
+				}
+				path := listener.Path
 				// If route path is specified in config and domain doesn't already have a path, use it
 				if staticSpec.RoutePath != "" && path == "" {
 					path = staticSpec.RoutePath
 				}
-				staticRoutes[baseDomain] = append(staticRoutes[baseDomain], StaticRouteConfig{
+				srv.StaticRoutes = append(srv.StaticRoutes, StaticRouteConfig{
 					StaticSite: staticSpec,
 					DomainPath: domainPath,
-					BaseDomain: baseDomain,
+					BaseDomain: srv.Domain,
 					Path:       path,
 					HasIndex:   hasIndex,
 				})
@@ -384,70 +837,155 @@ events {
 			continue
 		}
 
-		listenConfig := config.ParseListenKey(portKey)
-
 		// Skip TCP/UDP mappings - they're handled in stream block
-		if listenConfig.Protocol.IsStream() {
+		if config.IsStreamKey(portKey) {
 			continue
 		}
 
-		upstream := config.ParseUpstream(portKey)
+		targets, err := config.ParseUpstreamTargets(portKey)
+		if err != nil {
+			logger.Warn("Upstream %q: %v", portKey, err)
+		}
 
 		for _, domainPath := range domainPaths {
-			baseDomain, path := splitDomainPath(domainPath)
+			srv, listener, ok := resolveServer(domainPath)
+			if !ok {
+				continue
+			}
 
-			domainRoutes[baseDomain] = append(domainRoutes[baseDomain], RouteConfig{
-				Upstream:   upstream,
-				DomainPath: domainPath,
-				BaseDomain: baseDomain,
-				Path:       path,
-			})
+			// Several upstream keys feeding the same server and path are merged into one pool.
+			routeKey := fmt.Sprintf("%s|%s|%t|%s", srv.Domain, srv.Port, srv.SSL, listener.Path)
+			idx, exists := routeIndex[routeKey]
+			if !exists {
+				idx = len(srv.Routes)
+				routeIndex[routeKey] = idx
+				srv.Routes = append(srv.Routes, RouteConfig{
+					DomainPath: domainPath,
+					BaseDomain: srv.Domain,
+					Path:       listener.Path,
+				})
+			}
+			route := &srv.Routes[idx]
+			for _, target := range targets {
+				route.Upstreams = addPoolMember(route.Upstreams, target, domainPath)
+			}
 		}
 	}
 
-	// Collect domains with and without certificates
-	var domainsWithCerts []string
-	var domainsWithoutCerts []string
-	allDomains := make(map[string]bool)
-	for baseDomain := range domainRoutes {
-		allDomains[baseDomain] = true
+	sortedServers := make([]*serverBlock, 0, len(servers))
+	for _, srv := range servers {
+		sortedServers = append(sortedServers, srv)
 	}
-	for baseDomain := range staticRoutes {
-		allDomains[baseDomain] = true
+	sort.Slice(sortedServers, func(i, j int) bool {
+		a, b := sortedServers[i], sortedServers[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return !a.SSL && b.SSL
+	})
+
+	// Generate named upstream pools for load-balanced routes
+	sb.WriteString(generateUpstreamPools(sortedServers))
+
+	// A server without server_name (port-only listener) becomes the default server of its port.
+	catchAllPorts := make(map[string]bool)
+	for _, srv := range sortedServers {
+		if srv.Domain == "" {
+			catchAllPorts[srv.Port] = true
+		}
 	}
-	for baseDomain := range allDomains {
-		cert, hasCert := ssl.FindCertificate(certMap, baseDomain)
-		if hasCert && cert.KeyPath != "" {
-			domainsWithCerts = append(domainsWithCerts, baseDomain)
-		} else {
-			domainsWithoutCerts = append(domainsWithoutCerts, baseDomain)
+
+	// Clients connecting by IP address send no SNI, so nginx answers them with the
+	// certificate of the port's default server; on ports with an IP listener that has a
+	// certificate, the default server uses it.
+	ipServers := make(map[string]*serverBlock)
+	for _, srv := range sortedServers {
+		if !srv.SSL || !srv.HasCert || net.ParseIP(srv.Domain) == nil {
+			continue
+		}
+		if first, ok := ipServers[srv.Port]; ok {
+			logger.Warn("Port %s: clients connecting by IP send no SNI, so only the certificate of %s can be served; clients of %s will see a certificate mismatch", srv.Port, first.Domain, srv.Domain)
+			continue
+		}
+		if catchAllPorts[srv.Port] {
+			logger.Warn("Port %s: clients connecting to %s by IP get the certificate of the port-only listener (no SNI)", srv.Port, srv.Domain)
+			continue
 		}
+		ipServers[srv.Port] = srv
 	}
 
-	// Generate default server blocks to handle unconfigured domains
-	sb.WriteString(`    # Default server for HTTP - reject unconfigured domains
+	// Generate default server blocks to reject unconfigured domains on every listen port
+	ports := make([]string, 0, len(portSSL))
+	for port := range portSSL {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		if catchAllPorts[port] {
+			continue
+		}
+		if !portSSL[port] {
+			sb.WriteString(`    # Default server for HTTP - reject unconfigured domains
     server {
-        listen ` + httpPort + ` default_server;
+        listen ` + port + ` default_server;
         server_name _;
         return 444;
     }
 
-    # Default server for HTTPS - reject unconfigured domains
+`)
+			continue
+		}
+		sb.WriteString(`    # Default server for HTTPS - reject unconfigured domains
     server {
-        listen ` + httpsPort + ` ssl default_server;
+        listen ` + port + ` ssl default_server;
         server_name _;
 
-        # Use a dummy self-signed certificate
+`)
+		defaultTLS := tlsPol.def
+		if ipSrv, ok := ipServers[port]; ok {
+			defaultTLS = tlsPol.forDomain(ipSrv.Domain)
+			sb.WriteString("        # Certificate for clients connecting to " + ipSrv.Domain + " (no SNI)\n")
+			ipCerts := append([]ssl.Certificate{ipSrv.Cert}, ipSrv.Cert.Additional...)
+			writeCertificateDirectives(&sb, ipCerts)
+			writeStaplingDirectives(&sb, formatServerName(ipSrv.Domain), ipCerts)
+		} else {
+			sb.WriteString(`        # Use a dummy self-signed certificate
         ssl_certificate /etc/nginx/ssl/dummy.crt;
         ssl_certificate_key /etc/nginx/ssl/dummy.key;
-
-        ssl_protocols TLSv1.2 TLSv1.3;
-        ssl_ciphers HIGH:!aNULL:!MD5;
-
+`)
+		}
+		sb.WriteString("\n")
+		writeTLSDirectives(&sb, defaultTLS, cfg.TLS.DHParamPath)
+		sb.WriteString(`
         return 444;
     }
 
 `)
+	}
+
+	// Domains served over HTTPS on the default port get an HTTP -> HTTPS redirect, and
+	// domains served over HTTP on the default port get an HTTPS -> HTTP redirect, unless
+	// the other default port already has its own server for that domain.
+	var domainsWithCerts []string
+	var domainsWithoutCerts []string
+	for _, srv := range sortedServers {
+		if srv.Domain == "" {
+			continue
+		}
+		if srv.SSL && srv.Port == httpsPort {
+			if _, taken := servers[serverKey{Domain: srv.Domain, Port: httpPort, SSL: false}]; !taken {
+				domainsWithCerts = append(domainsWithCerts, formatServerName(srv.Domain))
+			}
+		}
+		if !srv.SSL && srv.Port == httpPort {
+			if _, taken := servers[serverKey{Domain: srv.Domain, Port: httpsPort, SSL: true}]; !taken {
+				domainsWithoutCerts = append(domainsWithoutCerts, formatServerName(srv.Domain))
+			}
+		}
+	}
 
 	// Generate HTTP → HTTPS redirect for domains with certificates
 	if len(domainsWithCerts) > 0 {
@@ -456,7 +994,11 @@ events {
         listen ` + httpPort + `;
         server_name ` + strings.Join(domainsWithCerts, " ") + `;
 
-        location / {
+`)
+		if cfg.ACME.Enabled {
+			sb.WriteString(acmeChallengeLocation())
+		}
+		sb.WriteString(`        location / {
             return 301 https://$host$request_uri;
         }
     }
@@ -475,9 +1017,9 @@ events {
         ssl_certificate /etc/nginx/ssl/dummy.crt;
         ssl_certificate_key /etc/nginx/ssl/dummy.key;
 
-        ssl_protocols TLSv1.2 TLSv1.3;
-        ssl_ciphers HIGH:!aNULL:!MD5;
-
+`)
+		writeTLSDirectives(&sb, tlsPol.def, cfg.TLS.DHParamPath)
+		sb.WriteString(`
         location / {
             return 301 http://$host$request_uri;
         }
@@ -486,64 +1028,60 @@ events {
 `)
 	}
 
-	// Generate server blocks for each base domain (combining proxy routes and static routes)
-	for baseDomain := range allDomains {
-		routes := domainRoutes[baseDomain]
-		staticSiteRoutes := staticRoutes[baseDomain]
-
-		cert, hasCert := ssl.FindCertificate(certMap, baseDomain)
-		if hasCert && cert.KeyPath == "" {
-			hasCert = false
+	// Generate server blocks (combining proxy routes and static routes)
+	for _, srv := range sortedServers {
+		serverName := formatServerName(srv.Domain)
+		listen := srv.Port
+		if serverName == "" {
+			serverName = "_"
+			listen += " default_server"
 		}
-		corsConfig := getCORSConfig(cfg, baseDomain)
+		corsConfig := getCORSConfig(cfg, srv.Domain)
+		clientAuth := clientAuthFor(cfg, srv.Domain, srv.SSL)
 
-		if !hasCert {
-			// No certificate found - create HTTP-only server block
+		if !srv.SSL {
+			// No certificate found (or HTTP forced) - create HTTP-only server block
 			sb.WriteString(fmt.Sprintf(`    # HTTP server block for %s (no SSL)
     server {
         listen %s;
         server_name %s;
 
-`, baseDomain, httpPort, baseDomain))
-
-			// Generate location blocks for static sites
-			if len(staticSiteRoutes) > 0 {
-				generateStaticSiteLocations(&sb, staticSiteRoutes, corsConfig, noTrailingSlash)
+`, serverName, listen, serverName))
+			writeClientAuthDirectives(&sb, clientAuth, cfg.ACME.Enabled && srv.Port == httpPort)
+			if cfg.ACME.Enabled && srv.Port == httpPort {
+				sb.WriteString(acmeChallengeLocation())
 			}
-
-			// Generate location blocks for proxy routes
-			if len(routes) > 0 {
-				generateProxyLocations(&sb, routes, corsConfig, noTrailingSlash)
+		} else {
+			certs := append([]ssl.Certificate{srv.Cert}, srv.Cert.Additional...)
+			if !srv.HasCert {
+				// HTTPS forced by <https> without a matching certificate.
+				logger.Warn("HTTPS forced for %s on port %s but no certificate matches; using the dummy certificate", serverName, srv.Port)
+				certs = []ssl.Certificate{{CertPath: "/etc/nginx/ssl/dummy.crt", KeyPath: "/etc/nginx/ssl/dummy.key"}}
 			}
 
-			sb.WriteString(`    }
-
-`)
-			continue
-		}
-
-		// Certificate found - create HTTPS server block
-		sb.WriteString(fmt.Sprintf(`    # HTTPS server block for %s
+			// Certificate found - create HTTPS server block
+			sb.WriteString(fmt.Sprintf(`    # HTTPS server block for %s
     server {
         listen %s ssl;
         server_name %s;
-        ssl_certificate %s;
-        ssl_certificate_key %s;
-
-        ssl_protocols TLSv1.2 TLSv1.3;
-        ssl_ciphers HIGH:!aNULL:!MD5;
-        ssl_prefer_server_ciphers on;
-
-`, baseDomain, httpsPort, baseDomain, cert.CertPath, cert.KeyPath))
+`, serverName, listen, serverName))
+			writeCertificateDirectives(&sb, certs)
+			writeStaplingDirectives(&sb, serverName, certs)
+			sb.WriteString("\n")
+			writeTLSDirectives(&sb, tlsPol.forDomain(srv.Domain), cfg.TLS.DHParamPath)
+			sb.WriteString("\n")
+			writeClientAuthDirectives(&sb, clientAuth, false)
+		}
 
 		// Generate location blocks for static sites
-		if len(staticSiteRoutes) > 0 {
-			generateStaticSiteLocations(&sb, staticSiteRoutes, corsConfig, noTrailingSlash)
+		if len(srv.StaticRoutes) > 0 {
+			generateStaticSiteLocations(&sb, srv.StaticRoutes, corsConfig, noTrailingSlash)
 		}
 
 		// Generate location blocks for proxy routes
-		if len(routes) > 0 {
-			generateProxyLocations(&sb, routes, corsConfig, noTrailingSlash)
+		if len(srv.Routes) > 0 {
+			earlyData := srv.SSL && tlsPol.forDomain(srv.Domain).EarlyData
+			generateProxyLocations(&sb, srv.Routes, corsConfig, noTrailingSlash, clientAuth.Verify != "", earlyData, tlsPol.upstreams)
 		}
 
 		sb.WriteString(`    }
@@ -556,6 +1094,17 @@ events {
 	return sb.String()
 }
 
+// acmeChallengeLocation serves the HTTP-01 challenge responses written by the ACME client
+func acmeChallengeLocation() string {
+	return `        # ACME HTTP-01 challenges
+        location ^~ /.well-known/acme-challenge/ {
+            alias ` + ACMEChallengeDir + `/;
+            default_type text/plain;
+        }
+
+`
+}
+
 // generateStaticSiteLocations generates nginx location blocks for static sites
 // Uses root directive for "/" path, alias directive for non-root paths
 func generateStaticSiteLocations(sb *strings.Builder, routes []StaticRouteConfig, corsConfig *config.CORSConfig, noTrailingSlash map[string]bool) {
@@ -640,22 +1189,36 @@ func generateStaticSiteLocations(sb *strings.Builder, routes []StaticRouteConfig
 }
 
 // generateProxyLocations generates nginx location blocks for proxy routes
-func generateProxyLocations(sb *strings.Builder, routes []RouteConfig, corsConfig *config.CORSConfig, noTrailingSlash map[string]bool) {
+func generateProxyLocations(sb *strings.Builder, routes []RouteConfig, corsConfig *config.CORSConfig, noTrailingSlash map[string]bool, clientCert, earlyData bool, upstreamTLS map[string]config.UpstreamTLSConfig) {
 	corsHeaders := generateCORSHeaders(corsConfig)
+	extraHeaders := noClientCertHeaders
+	if clientCert {
+		extraHeaders = clientCertHeaders
+	}
+	if earlyData {
+		extraHeaders += earlyDataHeader
+	}
 
 	// Sort routes by path length (longest first)
 	sortRoutesByPathLength(routes)
 
 	for _, route := range routes {
-		upstreamAddr := formatUpstreamAddr(route.Upstream)
+		if len(route.Upstreams) == 0 {
+			continue
+		}
+		primary := route.Upstreams[0]
 		locationPath := route.Path
 		if locationPath == "" {
 			locationPath = "/"
 		}
 
-		proxyPass := fmt.Sprintf("%s://%s", route.Upstream.Scheme, upstreamAddr)
-		if route.Upstream.Path != "" {
-			proxyPass += route.Upstream.Path
+		target := formatUpstreamAddr(primary)
+		if route.Pool != "" {
+			target = route.Pool
+		}
+		proxyPass := fmt.Sprintf("%s://%s", primary.Scheme, target)
+		if primary.Path != "" {
+			proxyPass += primary.Path
 		}
 
 		// For non-root paths, optionally add redirect and use trailing slash
@@ -673,6 +1236,21 @@ func generateProxyLocations(sb *strings.Builder, routes []RouteConfig, corsConfi
 			}
 		}
 
+		var upstreamSSL strings.Builder
+		if primary.Scheme == "https" {
+			entry := upstreamTLSFor(upstreamTLS, route)
+			if entry.Refused {
+				sb.WriteString(fmt.Sprintf(`        location %s {
+            # Upstream TLS settings not usable (see the tls.yaml warnings)
+            return 502;
+        }
+
+`, locationPath))
+				continue
+			}
+			writeUpstreamTLSDirectives(&upstreamSSL, entry)
+		}
+
 		sb.WriteString(fmt.Sprintf(`        location %s {
             proxy_pass %s;
             proxy_http_version 1.1;
@@ -684,7 +1262,7 @@ func generateProxyLocations(sb *strings.Builder, routes []RouteConfig, corsConfi
             proxy_set_header X-Forwarded-Host $http_host;
             proxy_set_header X-Forwarded-Proto $scheme;
 
-            # WebSocket support
+%s%s            # WebSocket support
             proxy_set_header Upgrade $http_upgrade;
             proxy_set_header Connection "upgrade";
 
@@ -696,8 +1274,109 @@ func generateProxyLocations(sb *strings.Builder, routes []RouteConfig, corsConfi
 %s
         }
 
-`, locationPath, proxyPass, corsHeaders))
+`, locationPath, proxyPass, extraHeaders, upstreamSSL.String(), corsHeaders))
+	}
+}
+
+// addPoolMember appends target to a route's upstream pool. Members must share the
+// scheme and path of the first member, since they are served by a single proxy_pass.
+func addPoolMember(pool []config.Upstream, target config.Upstream, domainPath string) []config.Upstream {
+	if len(pool) == 0 {
+		return append(pool, target)
+	}
+	primary := pool[0]
+	if target.Scheme != primary.Scheme || target.Path != primary.Path {
+		logger.Warn("Upstream %s://%s%s for %s ignored: pool members must share scheme and path with %s://%s%s",
+			target.Scheme, formatUpstreamAddr(target), target.Path, domainPath,
+			primary.Scheme, formatUpstreamAddr(primary), primary.Path)
+		return pool
+	}
+	for _, existing := range pool {
+		if formatUpstreamAddr(existing) == formatUpstreamAddr(target) {
+			logger.Warn("Upstream %s listed more than once for %s; keeping the first entry", formatUpstreamAddr(target), domainPath)
+			return pool
+		}
+	}
+	return append(pool, target)
+}
+
+// needsUpstreamPool reports whether a route must be proxied through a named upstream block
+func needsUpstreamPool(upstreams []config.Upstream) bool {
+	if len(upstreams) > 1 {
+		return true
+	}
+	for _, up := range upstreams {
+		if up.HasBalanceParams() {
+			return true
+		}
 	}
+	return false
+}
+
+// upstreamPoolName builds a valid nginx upstream name for a route of srv, e.g.
+// https://example.com/api -> "pool_https_example_com_443_api". Names are made unique by
+// generateUpstreamPools, since sanitizing can map different routes to the same name.
+func upstreamPoolName(srv *serverBlock, route RouteConfig) string {
+	domain := route.BaseDomain
+	if domain == "" {
+		domain = "any"
+	}
+	scheme := "http"
+	if srv.SSL {
+		scheme = "https"
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSuffix(strings.ToLower(scheme+"_"+domain+"_"+srv.Port+route.Path), "/"))
+	return "pool_" + name
+}
+
+// generateUpstreamPools generates named upstream blocks for every load-balanced route
+// and records their names in the routes
+func generateUpstreamPools(servers []*serverBlock) string {
+	var sb strings.Builder
+	used := make(map[string]bool)
+	for _, srv := range servers {
+		for i := range srv.Routes {
+			route := &srv.Routes[i]
+			if !needsUpstreamPool(route.Upstreams) {
+				continue
+			}
+			name := upstreamPoolName(srv, *route)
+			for n := 2; used[name]; n++ {
+				name = fmt.Sprintf("%s_%d", upstreamPoolName(srv, *route), n)
+			}
+			used[name] = true
+			route.Pool = name
+
+			sb.WriteString(fmt.Sprintf("    # Load-balanced upstream pool for %s\n", route.DomainPath))
+			sb.WriteString(fmt.Sprintf("    upstream %s {\n", name))
+			for _, up := range route.Upstreams {
+				server := formatUpstreamAddr(up)
+				if params := up.ServerParams(); params != "" {
+					server += " " + params
+				}
+				sb.WriteString(fmt.Sprintf("        server %s;\n", server))
+			}
+			sb.WriteString("    }\n\n")
+		}
+	}
+	return sb.String()
+}
+
+// sortedPortKeys returns the proxy.yaml mapping keys in a stable order
+func sortedPortKeys(ports map[string][]string) []string {
+	keys := make([]string, 0, len(ports))
+	for k := range ports {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // sortRoutesByPathLength sorts routes by path length (longest first) for proper nginx matching
@@ -722,10 +1401,22 @@ func sortStaticRoutesByPathLength(routes []StaticRouteConfig) {
 	}
 }
 
-// StreamMapping represents a TCP/UDP stream mapping
+// StreamMapping represents the TCP/UDP forwarding of one listener
 type StreamMapping struct {
 	ListenConfig config.ListenConfig
-	Upstream     config.Upstream
+	Upstreams    []config.Upstream
+	Balance      config.StreamBalance
+}
+
+// streamUpstreamName returns the nginx upstream name for a stream listener
+func streamUpstreamName(listen config.ListenConfig) string {
+	if listen.Host != "" {
+		// Replace dots and colons for valid upstream name
+		hostSafe := strings.ReplaceAll(listen.Host, ".", "_")
+		hostSafe = strings.ReplaceAll(hostSafe, ":", "_")
+		return fmt.Sprintf("stream_%s_%s_%s", listen.Protocol, hostSafe, listen.Port)
+	}
+	return fmt.Sprintf("stream_%s_%s", listen.Protocol, listen.Port)
 }
 
 // generateStreamBlock generates the nginx stream block for TCP/UDP forwarding
@@ -742,31 +1433,22 @@ func generateStreamBlock(mappings []StreamMapping, httpPort, httpsPort string) s
 		}
 	}
 
-	// Group mappings by listen port to detect conflicts
-	portMappings := make(map[string][]StreamMapping)
+	// Generate upstreams
 	for _, m := range mappings {
-		key := m.ListenConfig.Port
-		if m.ListenConfig.Host != "" {
-			key = m.ListenConfig.Host + ":" + m.ListenConfig.Port
+		sb.WriteString(fmt.Sprintf("    upstream %s {\n", streamUpstreamName(m.ListenConfig)))
+		switch m.Balance {
+		case config.StreamBalanceHash:
+			sb.WriteString("        hash $remote_addr consistent;\n")
+		case config.StreamBalanceLeastConn:
+			sb.WriteString("        least_conn;\n")
 		}
-		portMappings[key] = append(portMappings[key], m)
-	}
-
-	// Generate upstreams and servers
-	for _, m := range mappings {
-		// Generate upstream
-		upstreamName := fmt.Sprintf("stream_%s_%s", m.ListenConfig.Protocol, m.ListenConfig.Port)
-		if m.ListenConfig.Host != "" {
-			// Replace dots and colons for valid upstream name
-			hostSafe := strings.ReplaceAll(m.ListenConfig.Host, ".", "_")
-			hostSafe = strings.ReplaceAll(hostSafe, ":", "_")
-			upstreamName = fmt.Sprintf("stream_%s_%s_%s", m.ListenConfig.Protocol, hostSafe, m.ListenConfig.Port)
+		for _, up := range m.Upstreams {
+			server := formatUpstreamAddr(up)
+			if params := up.ServerParams(); params != "" {
+				server += " " + params
+			}
+			sb.WriteString(fmt.Sprintf("        server %s;\n", server))
 		}
-
-		upstreamAddr := formatUpstreamAddr(m.Upstream)
-
-		sb.WriteString(fmt.Sprintf("    upstream %s {\n", upstreamName))
-		sb.WriteString(fmt.Sprintf("        server %s;\n", upstreamAddr))
 		sb.WriteString("    }\n\n")
 	}
 
@@ -793,12 +1475,7 @@ func generateStreamBlock(mappings []StreamMapping, httpPort, httpsPort string) s
 			continue
 		}
 
-		upstreamName := fmt.Sprintf("stream_%s_%s", m.ListenConfig.Protocol, m.ListenConfig.Port)
-		if m.ListenConfig.Host != "" {
-			hostSafe := strings.ReplaceAll(m.ListenConfig.Host, ".", "_")
-			hostSafe = strings.ReplaceAll(hostSafe, ":", "_")
-			upstreamName = fmt.Sprintf("stream_%s_%s_%s", m.ListenConfig.Protocol, hostSafe, m.ListenConfig.Port)
-		}
+		upstreamName := streamUpstreamName(m.ListenConfig)
 
 		sb.WriteString("    server {\n")
 
@@ -2,9 +2,13 @@ package nginx
 
 import (
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hnrobert/sslly-nginx/internal/config"
 	"github.com/hnrobert/sslly-nginx/internal/ssl"
@@ -308,3 +312,506 @@ func TestGenerateConfig_StaticSitesNoIndex(t *testing.T) {
 	// Should NOT have try_files (no SPA support without index.html)
 	// Just check that the config doesn't crash
 }
+
+func TestGenerateConfig_UpstreamPoolFromSeveralKeys(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"10.0.0.1:8080 weight=3":           {"app.example.com"},
+			"10.0.0.2:8080":                    {"app.example.com"},
+			"10.0.0.3:8080 max_fails=2 backup": {"app.example.com"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	if !strings.Contains(ng, "upstream pool_http_app_example_com_80 {") {
+		t.Fatalf("expected upstream pool block, got:\n%s", ng)
+	}
+	for _, line := range []string{
+		"server 10.0.0.1:8080 weight=3;",
+		"server 10.0.0.2:8080;",
+		"server 10.0.0.3:8080 max_fails=2 backup;",
+	} {
+		if !strings.Contains(ng, line) {
+			t.Errorf("expected %q in pool", line)
+		}
+	}
+	if !strings.Contains(ng, "proxy_pass http://pool_http_app_example_com_80;") {
+		t.Error("expected proxy_pass to the pool")
+	}
+	if n := strings.Count(ng, "proxy_pass "); n != 1 {
+		t.Errorf("expected a single proxy location, got %d", n)
+	}
+}
+
+func TestGenerateConfig_UpstreamPoolFromOneKeyWithPath(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"10.0.0.1:8080/api, 10.0.0.2:8080/api": {"example.com/api"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	if !strings.Contains(ng, "upstream pool_http_example_com_80_api {") {
+		t.Fatalf("expected upstream pool block, got:\n%s", ng)
+	}
+	if !strings.Contains(ng, "proxy_pass http://pool_http_example_com_80_api/api/;") {
+		t.Error("expected proxy_pass to pool with upstream path")
+	}
+}
+
+func TestGenerateConfig_UpstreamPoolNamesAreUnique(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"10.0.0.1:1, 10.0.0.2:1": {"example.com"},
+			"10.0.0.3:2, 10.0.0.4:2": {"<http>example.com"},
+			"10.0.0.5:3, 10.0.0.6:3": {"example.com/v1.0"},
+			"10.0.0.7:4, 10.0.0.8:4": {"example.com/v1/0"},
+		},
+	}
+	certs := map[string]ssl.Certificate{"example.com": {CertPath: "/certs/example.pem", KeyPath: "/certs/example.key"}}
+
+	ng := GenerateConfig(cfg, certs)
+	for _, name := range []string{"pool_https_example_com_443", "pool_http_example_com_80", "pool_https_example_com_443_v1_0", "pool_https_example_com_443_v1_0_2"} {
+		if n := strings.Count(ng, "upstream "+name+" {"); n != 1 {
+			t.Errorf("expected upstream %s once, got %d:\n%s", name, n, ng)
+		}
+		if !strings.Contains(ng, "proxy_pass http://"+name) {
+			t.Errorf("expected a location proxying to %s", name)
+		}
+	}
+}
+
+func TestGenerateConfig_SingleUpstreamHasNoPool(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"8080": {"example.com"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	if strings.Contains(ng, "upstream pool_") {
+		t.Error("single upstream without parameters should not create a pool")
+	}
+	if !strings.Contains(ng, "proxy_pass http://127.0.0.1:8080;") {
+		t.Error("expected bare proxy_pass for single upstream")
+	}
+}
+
+func TestGenerateConfig_PoolRejectsMismatchedScheme(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"10.0.0.1:8080":        {"example.com"},
+			"<https>10.0.0.2:8443": {"example.com"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	if strings.Contains(ng, "10.0.0.2:8443") {
+		t.Error("member with a different scheme should be dropped from the pool")
+	}
+}
+
+func TestGenerateConfig_ListenerPortAddsServer(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"example.com"},
+			"9000": {"example.com|8443"},
+		},
+	}
+	certs := map[string]ssl.Certificate{
+		"example.com": {CertPath: "/certs/example.com.crt", KeyPath: "/certs/example.com.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	if !strings.Contains(ng, "listen 443 ssl;\n        server_name example.com;") {
+		t.Fatalf("expected HTTPS server on 443, got:\n%s", ng)
+	}
+	if !strings.Contains(ng, "listen 8443 ssl;\n        server_name example.com;") {
+		t.Fatalf("expected HTTPS server on 8443, got:\n%s", ng)
+	}
+	if !strings.Contains(ng, "listen 8443 ssl default_server;") {
+		t.Fatalf("expected default reject server on 8443")
+	}
+	if !strings.Contains(ng, "proxy_pass http://127.0.0.1:9000") {
+		t.Fatalf("expected 8443 server to proxy to 9000")
+	}
+}
+
+func TestGenerateConfig_ForcedHTTPSkipsRedirect(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"<http>example.com"},
+		},
+	}
+	certs := map[string]ssl.Certificate{
+		"example.com": {CertPath: "/certs/example.com.crt", KeyPath: "/certs/example.com.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	if !strings.Contains(ng, "# HTTP server block for example.com (no SSL)") {
+		t.Fatalf("expected HTTP server block, got:\n%s", ng)
+	}
+	if strings.Contains(ng, "return 301 https://") {
+		t.Fatalf("did not expect HTTP -> HTTPS redirect for forced HTTP listener")
+	}
+}
+
+func TestGenerateConfig_ForcedHTTPSWithoutCertUsesDummy(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"<https>example.com"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+	if !strings.Contains(ng, "# HTTPS server block for example.com") {
+		t.Fatalf("expected HTTPS server block, got:\n%s", ng)
+	}
+	if !strings.Contains(ng, "server_name example.com;\n        ssl_certificate /etc/nginx/ssl/dummy.crt;") {
+		t.Fatalf("expected dummy certificate for forced HTTPS listener")
+	}
+	if !strings.Contains(ng, "return 301 https://") {
+		t.Fatalf("expected HTTP -> HTTPS redirect")
+	}
+}
+
+func TestGenerateConfig_PortOnlyListenerIsCatchAll(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"<http>8080"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+	if !strings.Contains(ng, "listen 8080 default_server;\n        server_name _;\n\n") {
+		t.Fatalf("expected catch-all server on 8080, got:\n%s", ng)
+	}
+	if strings.Count(ng, "listen 8080 ") != 1 {
+		t.Fatalf("expected no separate reject server on 8080")
+	}
+}
+
+func TestGenerateConfig_ListenerProtocolConflictIgnored(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"<http>example.com|443"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+	if strings.Contains(ng, "server_name example.com;") {
+		t.Fatalf("expected plain HTTP listener on the HTTPS port to be ignored")
+	}
+}
+
+func TestGenerateConfig_ACMEChallengeLocation(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"3000": {"secure.example.com", "plain.example.com", "plain.example.com|8080"},
+		},
+		ACME: config.ACMEConfig{Enabled: true},
+	}
+	certs := map[string]ssl.Certificate{
+		"secure.example.com": {CertPath: "/certs/secure.pem", KeyPath: "/certs/secure.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	location := "location ^~ /.well-known/acme-challenge/ {\n            alias " + ACMEChallengeDir + "/;"
+	// Redirect server for secure.example.com and port 80 server for plain.example.com;
+	// the 8080 server is not used for HTTP-01.
+	if got := strings.Count(ng, location); got != 2 {
+		t.Fatalf("expected 2 challenge locations, got %d:\n%s", got, ng)
+	}
+	redirect := ng[strings.Index(ng, "# HTTP to HTTPS redirect"):]
+	if strings.Index(redirect, location) > strings.Index(redirect, "return 301 https://") {
+		t.Fatalf("expected challenge location before the redirect")
+	}
+
+	cfg.ACME.Enabled = false
+	if ng := GenerateConfig(cfg, certs); strings.Contains(ng, "acme-challenge") {
+		t.Fatalf("did not expect challenge locations with ACME disabled")
+	}
+}
+
+func TestGenerateConfig_DualCertificates(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"example.com"}},
+	}
+	certs := map[string]ssl.Certificate{
+		"example.com": {
+			CertPath:   "/certs/ec.pem",
+			KeyPath:    "/certs/ec.key",
+			Additional: []ssl.Certificate{{CertPath: "/certs/rsa.pem", KeyPath: "/certs/rsa.key"}},
+		},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	want := "        ssl_certificate /certs/ec.pem;\n        ssl_certificate_key /certs/ec.key;\n" +
+		"        ssl_certificate /certs/rsa.pem;\n        ssl_certificate_key /certs/rsa.key;\n"
+	if !strings.Contains(ng, want) {
+		t.Fatalf("expected both certificate pairs in the server block:\n%s", ng)
+	}
+}
+
+func TestGenerateConfig_IPCertificates(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"192.168.50.2", "[FD00::2]|8443", "example.com"}},
+	}
+	certs := map[string]ssl.Certificate{
+		"192.168.50.2": {CertPath: "/certs/ip4.pem", KeyPath: "/certs/ip4.key"},
+		"fd00::2":      {CertPath: "/certs/ip6.pem", KeyPath: "/certs/ip6.key"},
+		"example.com":  {CertPath: "/certs/example.pem", KeyPath: "/certs/example.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	for _, want := range []string{
+		"listen 443 ssl;\n        server_name 192.168.50.2;\n        ssl_certificate /certs/ip4.pem;",
+		"listen 8443 ssl;\n        server_name [fd00::2];\n        ssl_certificate /certs/ip6.pem;",
+		// No SNI for IP clients: the default server presents the IP certificate.
+		"listen 443 ssl default_server;\n        server_name _;\n\n        # Certificate for clients connecting to 192.168.50.2 (no SNI)\n        ssl_certificate /certs/ip4.pem;",
+		"listen 8443 ssl default_server;\n        server_name _;\n\n        # Certificate for clients connecting to fd00::2 (no SNI)\n        ssl_certificate /certs/ip6.pem;",
+	} {
+		if !strings.Contains(ng, want) {
+			t.Errorf("expected %q in config:\n%s", want, ng)
+		}
+	}
+}
+
+func TestGenerateConfig_OCSPStapling(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"a.example.com", "b.example.com", "c.example.com"}},
+	}
+	certs := map[string]ssl.Certificate{
+		"a.example.com": {CertPath: "/certs/a.pem", KeyPath: "/certs/a.key", OCSPPath: "/certs/a.ocsp"},
+		"b.example.com": {CertPath: "/certs/b.pem", KeyPath: "/certs/b.key"},
+		"c.example.com": {
+			CertPath: "/certs/c.pem", KeyPath: "/certs/c.key", OCSPPath: "/certs/c.ocsp",
+			Additional: []ssl.Certificate{{CertPath: "/certs/c.rsa.pem", KeyPath: "/certs/c.rsa.key", OCSPPath: "/certs/c.rsa.ocsp"}},
+		},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	want := "ssl_certificate_key /certs/a.key;\n        ssl_stapling on;\n        ssl_stapling_file /certs/a.ocsp;\n"
+	if !strings.Contains(ng, want) {
+		t.Fatalf("expected %q in config:\n%s", want, ng)
+	}
+	if strings.Count(ng, "ssl_stapling on;") != 1 {
+		t.Fatalf("only a.example.com should be stapled (b has no response, c has several certificates):\n%s", ng)
+	}
+}
+
+func TestGenerateConfig_StreamMultipleTargets(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"<tcp>9122 balance=least_conn": {"192.168.50.1|22 weight=2", "192.168.50.2|22"},
+			"<udp>27015 balance=hash":      {"10.0.0.1:27015", "10.0.0.2:27015"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	for _, want := range []string{
+		"upstream stream_tcp_9122 {\n        least_conn;\n        server 192.168.50.1:22 weight=2;\n        server 192.168.50.2:22;\n    }",
+		"upstream stream_udp_27015 {\n        hash $remote_addr consistent;\n        server 10.0.0.1:27015;\n        server 10.0.0.2:27015;\n    }",
+		"listen 27015 udp;",
+		"proxy_pass stream_tcp_9122;",
+	} {
+		if !strings.Contains(ng, want) {
+			t.Errorf("expected %q in stream block, got:\n%s", want, ng)
+		}
+	}
+	if strings.Contains(ng, "server_name 192.168.50.1") {
+		t.Error("stream targets must not be treated as HTTP domains")
+	}
+}
+
+func TestGenerateConfig_StreamKeysMergedPerListener(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"<udp>53 balance=HASH":       {"10.0.0.1:53", "10.0.0.2:53 backup"},
+			"<udp>53 balance=hash":       {"10.0.0.1:53", "10.0.0.3:53"},
+			"<udp>53 balance=least_conn": {"10.0.0.4:53"},
+		},
+	}
+
+	ng := GenerateConfig(cfg, map[string]ssl.Certificate{})
+
+	want := "upstream stream_udp_53 {\n        hash $remote_addr consistent;\n        server 10.0.0.1:53;\n        server 10.0.0.3:53;\n    }"
+	if !strings.Contains(ng, want) {
+		t.Errorf("expected %q in stream block, got:\n%s", want, ng)
+	}
+	if strings.Count(ng, "upstream stream_udp_53 {") != 1 {
+		t.Errorf("expected one upstream per listener, got:\n%s", ng)
+	}
+}
+
+func newTestManager(t *testing.T, newCmd func() *exec.Cmd) *Manager {
+	m := NewManager()
+	m.newCmd = newCmd
+	m.pidPath = filepath.Join(t.TempDir(), "nginx.pid")
+	m.confPath = filepath.Join(t.TempDir(), "nginx.conf")
+	m.restartBackoff = 10 * time.Millisecond
+	m.maxRestartBackoff = 20 * time.Millisecond
+	m.maxRestarts = 2
+	return m
+}
+
+func TestManager_SupervisorGivesUpAfterRepeatedFailures(t *testing.T) {
+	m := newTestManager(t, func() *exec.Cmd { return exec.Command("sh", "-c", "exit 3") })
+	var restarts int32
+	m.BeforeRestart = func() error {
+		atomic.AddInt32(&restarts, 1)
+		return nil
+	}
+
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	go m.supervise()
+
+	select {
+	case err := <-m.Failed():
+		if err == nil {
+			t.Fatal("expected a supervision error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+	if got := atomic.LoadInt32(&restarts); got != 2 {
+		t.Fatalf("expected 2 restart attempts, got %d", got)
+	}
+}
+
+func TestManager_SupervisorRestartsCrashedMaster(t *testing.T) {
+	var starts int32
+	m := newTestManager(t, func() *exec.Cmd {
+		if atomic.AddInt32(&starts, 1) == 1 {
+			return exec.Command("sh", "-c", "exit 1")
+		}
+		return exec.Command("sleep", "30")
+	})
+
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	go m.supervise()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&starts) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&starts) != 2 {
+		t.Fatalf("expected nginx to be restarted once, got %d starts", starts)
+	}
+
+	m.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&starts); got != 2 {
+		t.Fatalf("expected no restart after Stop, got %d starts", got)
+	}
+	select {
+	case err := <-m.Failed():
+		t.Fatalf("unexpected supervision failure: %v", err)
+	default:
+	}
+}
+
+func TestManager_StopDuringRestartLeavesNoMaster(t *testing.T) {
+	tests := []struct {
+		name      string
+		stopEarly bool // in BeforeRestart, else while the new master starts
+	}{
+		{name: "stop in BeforeRestart", stopEarly: true},
+		{name: "stop while starting"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m *Manager
+			var restarted *exec.Cmd
+			var starts int32
+			m = newTestManager(t, func() *exec.Cmd {
+				if atomic.AddInt32(&starts, 1) == 1 {
+					return exec.Command("sh", "-c", "exit 1")
+				}
+				m.Stop() // the old master is gone, so Stop returns at once
+				restarted = exec.Command("sleep", "30")
+				return restarted
+			})
+			if tt.stopEarly {
+				m.BeforeRestart = func() error {
+					m.Stop()
+					return nil
+				}
+			}
+
+			if err := m.startProcess(); err != nil {
+				t.Fatalf("startProcess: %v", err)
+			}
+			supervised := make(chan struct{})
+			go func() {
+				m.supervise()
+				close(supervised)
+			}()
+			select {
+			case <-supervised:
+			case <-time.After(5 * time.Second):
+				t.Fatal("supervisor did not return after Stop")
+			}
+
+			if tt.stopEarly {
+				if got := atomic.LoadInt32(&starts); got != 1 {
+					t.Fatalf("expected no restart after Stop, got %d starts", got)
+				}
+				return
+			}
+			if restarted == nil || restarted.ProcessState == nil {
+				t.Fatal("expected the master started during Stop to be killed")
+			}
+			if m.cmd == restarted {
+				t.Fatal("the killed master must not become the current one")
+			}
+		})
+	}
+}
+
+func TestManager_StopDrainsWithSIGQUIT(t *testing.T) {
+	m := newTestManager(t, func() *exec.Cmd {
+		return exec.Command("sh", "-c", `trap "exit 0" QUIT; while :; do sleep 0.05; done`)
+	})
+	m.drainTimeout = 5 * time.Second
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond) // let the shell install its trap
+
+	start := time.Now()
+	m.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected graceful stop well before the drain timeout, took %s", elapsed)
+	}
+	if ws, ok := m.cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || ws.Signaled() || ws.ExitStatus() != 0 {
+		t.Fatalf("expected clean exit after SIGQUIT, got %v", m.cmd.ProcessState)
+	}
+}
+
+func TestManager_StopEscalatesToSIGKILL(t *testing.T) {
+	m := newTestManager(t, func() *exec.Cmd {
+		return exec.Command("sh", "-c", `trap "" QUIT TERM; while :; do sleep 0.05; done`)
+	})
+	m.drainTimeout = 100 * time.Millisecond
+	m.termTimeout = 100 * time.Millisecond
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	m.Stop()
+	ws, ok := m.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		t.Fatalf("expected SIGKILL, got %v", m.cmd.ProcessState)
+	}
+}
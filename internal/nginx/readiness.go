@@ -0,0 +1,176 @@
+package nginx
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPidPath      = "/tmp/nginx.pid"
+	defaultConfPath     = "/etc/nginx/nginx.conf"
+	defaultReadyTimeout = 10 * time.Second
+	readyPollEvery      = 100 * time.Millisecond
+	dialTimeout         = 200 * time.Millisecond
+)
+
+var (
+	// listenDirectivePattern matches the argument list of a listen directive
+	listenDirectivePattern = regexp.MustCompile(`(?m)^\s*listen\s+([^;]+);`)
+	// bindFailurePattern matches nginx's "bind() to 0.0.0.0:80 failed (98: Address already in use)"
+	bindFailurePattern = regexp.MustCompile(`bind\(\) to (\S+) failed[^\n]*`)
+)
+
+// bindErrorWatcher passes nginx stderr through and remembers the first bind failure,
+// so startup can fail fast instead of waiting for nginx to give up on its own.
+type bindErrorWatcher struct {
+	next io.Writer
+
+	mu   sync.Mutex
+	msg  string
+	addr string
+}
+
+func (w *bindErrorWatcher) Write(p []byte) (int, error) {
+	if match := bindFailurePattern.FindSubmatch(p); match != nil {
+		w.mu.Lock()
+		if w.msg == "" {
+			w.msg = string(match[0])
+			w.addr = string(match[1])
+		}
+		w.mu.Unlock()
+	}
+	return w.next.Write(p)
+}
+
+// take returns the recorded bind failure as an error, if any, and clears it
+func (w *bindErrorWatcher) take() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.msg == "" {
+		return nil
+	}
+	port := w.addr
+	if _, p, err := net.SplitHostPort(w.addr); err == nil {
+		port = p
+	}
+	err := fmt.Errorf("nginx could not bind port %s: %s", port, w.msg)
+	w.msg, w.addr = "", ""
+	return err
+}
+
+// listenAddrs returns the dialable TCP addresses of every listen directive in an
+// nginx.conf (HTTP and HTTPS servers as well as stream servers). UDP listeners and
+// unix sockets are skipped because they cannot be probed with a TCP connect.
+func listenAddrs(conf string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, match := range listenDirectivePattern.FindAllStringSubmatch(conf, -1) {
+		fields := strings.Fields(match[1])
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "unix:") {
+			continue
+		}
+		udp := false
+		for _, f := range fields[1:] {
+			if f == "udp" {
+				udp = true
+			}
+		}
+		if udp {
+			continue
+		}
+
+		addr := dialAddr(fields[0])
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		out = append(out, addr)
+	}
+	return out
+}
+
+// dialAddr turns a listen address ("80", "0.0.0.0:80", "[::]:443", "10.0.0.5:22")
+// into an address that can be dialed locally.
+func dialAddr(listen string) string {
+	if _, err := strconv.Atoi(listen); err == nil {
+		return net.JoinHostPort("127.0.0.1", listen)
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	switch host {
+	case "", "*", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// waitReady waits until the running nginx master is serving: the pid file names the
+// master, the master is alive and every listen socket accepts connections.
+func (m *Manager) waitReady(timeout time.Duration) error {
+	m.mu.Lock()
+	cmd, done, bindErrs := m.cmd, m.done, m.bindErrs
+	m.mu.Unlock()
+	if cmd == nil || done == nil {
+		return fmt.Errorf("nginx is not running")
+	}
+
+	conf, err := os.ReadFile(m.confPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", m.confPath, err)
+	}
+	addrs := listenAddrs(string(conf))
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if bindErrs != nil {
+			if err := bindErrs.take(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-done:
+			return fmt.Errorf("nginx master exited: %s", describeExit(cmd, nil))
+		default:
+		}
+
+		pending := m.notReadyReason(cmd.Process.Pid, addrs)
+		if pending == "" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nginx not ready after %s: %s", timeout, pending)
+		}
+		time.Sleep(readyPollEvery)
+	}
+}
+
+// notReadyReason describes the first readiness condition that is not met yet
+func (m *Manager) notReadyReason(pid int, addrs []string) string {
+	data, err := os.ReadFile(m.pidPath)
+	if err != nil {
+		return fmt.Sprintf("pid file %s not written", m.pidPath)
+	}
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(pid) {
+		return fmt.Sprintf("pid file %s names pid %q, expected %d", m.pidPath, got, pid)
+	}
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			_, port, _ := net.SplitHostPort(addr)
+			return fmt.Sprintf("port %s (%s) is not accepting connections", port, addr)
+		}
+		_ = conn.Close()
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package nginx
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenAddrs(t *testing.T) {
+	conf := `
+http {
+    server {
+        listen 80 default_server;
+    }
+    server {
+        listen 443 ssl;
+        listen 443 ssl default_server;
+        listen [::]:8443 ssl;
+    }
+}
+stream {
+    server {
+        listen 192.168.50.1:22;
+        listen 27015 udp;
+    }
+}
+`
+	got := listenAddrs(conf)
+	want := []string{"127.0.0.1:80", "127.0.0.1:443", "[::1]:8443", "192.168.50.1:22"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("listenAddrs() = %v, want %v", got, want)
+	}
+}
+
+// fakeMaster writes its own pid to the pid file, then runs script
+func fakeMaster(m *Manager, script string) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		return exec.Command("sh", "-c", `echo $$ > "`+m.pidPath+`"; `+script)
+	}
+}
+
+func TestManager_WaitReady(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	m := newTestManager(t, nil)
+	m.newCmd = fakeMaster(m, "exec sleep 30")
+	if err := os.WriteFile(m.confPath, []byte("server {\n    listen "+port+";\n}\n"), 0644); err != nil {
+		t.Fatalf("write conf: %v", err)
+	}
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	defer m.process().Kill()
+
+	if err := m.waitReady(2 * time.Second); err != nil {
+		t.Fatalf("waitReady: %v", err)
+	}
+}
+
+func TestManager_WaitReadyNamesPortThatFailedToBind(t *testing.T) {
+	m := newTestManager(t, nil)
+	m.newCmd = fakeMaster(m, `echo "nginx: [emerg] bind() to 0.0.0.0:8081 failed (98: Address already in use)" >&2; exec sleep 30`)
+	if err := os.WriteFile(m.confPath, []byte("server {\n    listen 8081;\n}\n"), 0644); err != nil {
+		t.Fatalf("write conf: %v", err)
+	}
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	defer m.process().Kill()
+
+	start := time.Now()
+	err := m.waitReady(5 * time.Second)
+	if err == nil || !strings.Contains(err.Error(), "could not bind port 8081") {
+		t.Fatalf("expected bind failure naming port 8081, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("expected to fail fast on bind failure")
+	}
+}
+
+func TestManager_WaitReadyDetectsExitedMaster(t *testing.T) {
+	m := newTestManager(t, nil)
+	m.newCmd = fakeMaster(m, "exit 1")
+	if err := os.WriteFile(m.confPath, []byte(""), 0644); err != nil {
+		t.Fatalf("write conf: %v", err)
+	}
+	if err := m.startProcess(); err != nil {
+		t.Fatalf("startProcess: %v", err)
+	}
+	<-m.done
+
+	err := m.waitReady(time.Second)
+	if err == nil || !strings.Contains(err.Error(), "exit status 1") {
+		t.Fatalf("expected exited master error, got %v", err)
+	}
+}
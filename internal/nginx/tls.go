@@ -0,0 +1,281 @@
+package nginx
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+// Built-in TLS profiles, after the Mozilla Server Side TLS guidelines (v5.7)
+const (
+	TLSProfileModern       = "modern"
+	TLSProfileIntermediate = "intermediate"
+	TLSProfileOld          = "old"
+)
+
+// tlsProfile is a resolved profile, as written into an HTTPS server block
+type tlsProfile struct {
+	Name                string
+	Protocols           []string
+	Ciphers             string // empty: nginx default (TLS 1.3 suites are not configurable)
+	PreferServerCiphers bool
+	ECDHCurve           string
+	DHParam             bool
+	SessionCache        string // shared cache size; empty: no cache
+	SessionTimeout      string
+	SessionTickets      bool
+	EarlyData           bool
+}
+
+const mozillaIntermediateCiphers = "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:" +
+	"ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305"
+
+var builtinTLSProfiles = map[string]tlsProfile{
+	TLSProfileModern: {
+		Name:           TLSProfileModern,
+		Protocols:      []string{"TLSv1.3"},
+		ECDHCurve:      "X25519:prime256v1:secp384r1",
+		SessionCache:   "10m",
+		SessionTimeout: "1d",
+	},
+	TLSProfileIntermediate: {
+		Name:           TLSProfileIntermediate,
+		Protocols:      []string{"TLSv1.2", "TLSv1.3"},
+		Ciphers:        mozillaIntermediateCiphers,
+		ECDHCurve:      "X25519:prime256v1:secp384r1",
+		DHParam:        true,
+		SessionCache:   "10m",
+		SessionTimeout: "1d",
+	},
+	TLSProfileOld: {
+		Name:      TLSProfileOld,
+		Protocols: []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"},
+		// OpenSSL 3 refuses TLS 1.0/1.1 and SHA-1 at the default security level.
+		Ciphers: mozillaIntermediateCiphers + ":ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:" +
+			"ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:" +
+			"AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA:@SECLEVEL=0",
+		PreferServerCiphers: true,
+		ECDHCurve:           "X25519:prime256v1:secp384r1",
+		DHParam:             true,
+		SessionCache:        "10m",
+		SessionTimeout:      "1d",
+	},
+}
+
+var (
+	validTLSProtocols = map[string]bool{"TLSv1": true, "TLSv1.1": true, "TLSv1.2": true, "TLSv1.3": true}
+	tlsProfileNameRe  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	nginxSizeRe       = regexp.MustCompile(`^[0-9]+[kKmM]?$`)
+	nginxTimeRe       = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|M|y)?)+$`)
+)
+
+// tlsPolicy picks the TLS profile of each domain from tls.yaml
+type tlsPolicy struct {
+	profiles map[string]tlsProfile
+	def      tlsProfile
+	domains  map[string]string // lowercased domain or "*." pattern -> profile name
+	patterns []string          // keys of domains
+
+	upstreams map[string]config.UpstreamTLSConfig // by upstream address, see resolveUpstreamTLS
+}
+
+// newTLSPolicy resolves tls.yaml on top of the built-in profiles. Invalid profiles and
+// references are left out (falling back to the default profile) and returned as problems.
+func newTLSPolicy(tc config.TLSConfig) (tlsPolicy, []string) {
+	var problems []string
+	p := tlsPolicy{profiles: make(map[string]tlsProfile, len(builtinTLSProfiles)+len(tc.Profiles))}
+	for name, prof := range builtinTLSProfiles {
+		p.profiles[name] = prof
+	}
+
+	names := make([]string, 0, len(tc.Profiles))
+	for name := range tc.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prof, err := resolveTLSProfile(name, tc.Profiles[name])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("profile %s: %v", name, err))
+			continue
+		}
+		p.profiles[name] = prof
+	}
+
+	p.def = p.profiles[TLSProfileIntermediate]
+	if tc.Default != "" {
+		if prof, ok := p.profiles[tc.Default]; ok {
+			p.def = prof
+		} else {
+			problems = append(problems, fmt.Sprintf("default: unknown profile %q, using %s", tc.Default, TLSProfileIntermediate))
+		}
+	}
+
+	p.domains = make(map[string]string, len(tc.Domains))
+	domains := make([]string, 0, len(tc.Domains))
+	for domain := range tc.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		name := tc.Domains[domain]
+		if _, ok := p.profiles[name]; !ok {
+			problems = append(problems, fmt.Sprintf("domains: %s: unknown profile %q, using the default", domain, name))
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(domain))
+		p.domains[key] = name
+		p.patterns = append(p.patterns, key)
+	}
+
+	var upstreamProblems []string
+	p.upstreams, upstreamProblems = resolveUpstreamTLS(tc.Upstreams)
+	return p, append(problems, upstreamProblems...)
+}
+
+// resolveTLSProfile applies a custom profile to its base. A profile named like a
+// built-in one starts from it.
+func resolveTLSProfile(name string, custom config.TLSProfile) (tlsProfile, error) {
+	if !tlsProfileNameRe.MatchString(name) {
+		return tlsProfile{}, fmt.Errorf("name may only contain letters, digits, '-' and '_'")
+	}
+	base := custom.Base
+	if base == "" {
+		base = TLSProfileIntermediate
+		if _, ok := builtinTLSProfiles[name]; ok {
+			base = name
+		}
+	}
+	prof, ok := builtinTLSProfiles[base]
+	if !ok {
+		return tlsProfile{}, fmt.Errorf("unknown base %q (expected %s, %s or %s)", base, TLSProfileModern, TLSProfileIntermediate, TLSProfileOld)
+	}
+	prof.Name = name
+
+	if len(custom.Protocols) > 0 {
+		for _, proto := range custom.Protocols {
+			if !validTLSProtocols[proto] {
+				return tlsProfile{}, fmt.Errorf("unknown protocol %q (expected TLSv1, TLSv1.1, TLSv1.2 or TLSv1.3)", proto)
+			}
+		}
+		prof.Protocols = custom.Protocols
+	}
+	for _, f := range []struct{ field, value string }{{"ciphers", custom.Ciphers}, {"ecdh_curve", custom.ECDHCurve}} {
+		if strings.ContainsAny(f.value, " \t\r\n;{}'\"") {
+			return tlsProfile{}, fmt.Errorf("%s must be a single ':'-separated list", f.field)
+		}
+	}
+	if custom.Ciphers != "" {
+		prof.Ciphers = custom.Ciphers
+	}
+	if custom.ECDHCurve != "" {
+		prof.ECDHCurve = custom.ECDHCurve
+	}
+	switch cache := strings.TrimSpace(custom.SessionCache); {
+	case cache == "":
+	case cache == "off" || cache == "none":
+		prof.SessionCache = ""
+	case nginxSizeRe.MatchString(cache):
+		prof.SessionCache = cache
+	default:
+		return tlsProfile{}, fmt.Errorf("invalid session_cache %q (expected a size like 10m, or off)", custom.SessionCache)
+	}
+	if custom.SessionTimeout != "" {
+		if !nginxTimeRe.MatchString(custom.SessionTimeout) {
+			return tlsProfile{}, fmt.Errorf("invalid session_timeout %q (expected a time like 1d or 4h)", custom.SessionTimeout)
+		}
+		prof.SessionTimeout = custom.SessionTimeout
+	}
+	if custom.PreferServerCiphers != nil {
+		prof.PreferServerCiphers = *custom.PreferServerCiphers
+	}
+	if custom.DHParam != nil {
+		prof.DHParam = *custom.DHParam
+	}
+	if custom.SessionTickets != nil {
+		prof.SessionTickets = *custom.SessionTickets
+	}
+	if custom.EarlyData != nil {
+		prof.EarlyData = *custom.EarlyData
+	}
+	return prof, nil
+}
+
+// forDomain returns the profile of domain: an exact entry, else the wildcard pattern
+// covering it, else the default. Servers without a name use the default.
+func (p tlsPolicy) forDomain(domain string) tlsProfile {
+	if key, ok := matchDomainKey(p.patterns, domain); ok {
+		return p.profiles[p.domains[key]]
+	}
+	return p.def
+}
+
+// matchDomainKey returns the key of keys that applies to domain: the domain itself, else
+// the wildcard pattern covering it (one label, see ssl.WildcardPattern)
+func matchDomainKey(keys []string, domain string) (string, bool) {
+	domain = strings.ToLower(domain)
+	pattern := ssl.WildcardPattern(domain)
+	found := false
+	for _, key := range keys {
+		if key == domain {
+			return key, true
+		}
+		found = found || (pattern != "" && key == pattern)
+	}
+	return pattern, found
+}
+
+// CheckTLSConfig reports the problems of tls.yaml; GenerateConfig skips the invalid
+// entries.
+func CheckTLSConfig(tc config.TLSConfig) error {
+	if _, problems := newTLSPolicy(tc); len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// writeTLSDirectives writes the protocol, cipher and session settings of a profile.
+// ssl_dhparam is only written when the runtime directory holds the parameters.
+func writeTLSDirectives(sb *strings.Builder, p tlsProfile, dhParamPath string) {
+	sb.WriteString("        ssl_protocols " + strings.Join(p.Protocols, " ") + ";\n")
+	if p.Ciphers != "" {
+		sb.WriteString("        ssl_ciphers " + p.Ciphers + ";\n")
+	}
+	sb.WriteString("        ssl_prefer_server_ciphers " + onOff(p.PreferServerCiphers) + ";\n")
+	if p.ECDHCurve != "" {
+		sb.WriteString("        ssl_ecdh_curve " + p.ECDHCurve + ";\n")
+	}
+	if p.DHParam && dhParamPath != "" {
+		sb.WriteString("        ssl_dhparam " + dhParamPath + ";\n")
+	}
+	if p.SessionCache != "" {
+		// One zone per profile: nginx rejects a zone declared with two sizes.
+		sb.WriteString("        ssl_session_cache shared:SSL_" + p.Name + ":" + p.SessionCache + ";\n")
+	}
+	if p.SessionTimeout != "" {
+		sb.WriteString("        ssl_session_timeout " + p.SessionTimeout + ";\n")
+	}
+	sb.WriteString("        ssl_session_tickets " + onOff(p.SessionTickets) + ";\n")
+	if p.EarlyData {
+		sb.WriteString("        ssl_early_data on;\n")
+	}
+}
+
+// earlyDataHeader tells backends which requests arrived as TLS 1.3 early data, so they
+// can answer 425 Too Early to those that are not safe to replay (RFC 8470). The header is
+// empty, and so not sent, for other requests.
+const earlyDataHeader = `            # TLS 1.3 early data (RFC 8470)
+            proxy_set_header Early-Data $ssl_early_data;
+
+`
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
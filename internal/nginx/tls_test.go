@@ -0,0 +1,125 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/ssl"
+)
+
+func TestNewTLSPolicy(t *testing.T) {
+	on := true
+	tc := config.TLSConfig{
+		Default: "strict",
+		Domains: map[string]string{
+			"printer.lan":   TLSProfileOld,
+			"*.example.com": "fast",
+			"a.example.com": TLSProfileIntermediate,
+			"b.example.com": "missing",
+		},
+		Profiles: map[string]config.TLSProfile{
+			"strict": {Base: TLSProfileModern},
+			"fast":   {EarlyData: &on, SessionCache: "20m"},
+			"bad":    {Protocols: []string{"SSLv3"}},
+			"inject": {Ciphers: "HIGH; return 200"},
+		},
+	}
+
+	p, problems := newTLSPolicy(tc)
+	want := []string{
+		`profile bad: unknown protocol "SSLv3"`,
+		"profile inject: ciphers must be a single ':'-separated list",
+		`domains: b.example.com: unknown profile "missing"`,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("unexpected problems: %q", problems)
+	}
+	for i, w := range want {
+		if !strings.Contains(problems[i], w) {
+			t.Errorf("problem %d = %q, want %q", i, problems[i], w)
+		}
+	}
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"printer.lan", TLSProfileOld},
+		{"a.example.com", TLSProfileIntermediate},
+		{"x.example.com", "fast"},
+		{"x.y.example.com", "strict"}, // a wildcard covers one label
+		{"example.com", "strict"},
+		{"b.example.com", "fast"}, // unknown profile: the wildcard still applies
+		{"other.org", "strict"},
+		{"", "strict"},
+	}
+	for _, tt := range tests {
+		if got := p.forDomain(tt.domain).Name; got != tt.want {
+			t.Errorf("forDomain(%q) = %s, want %s", tt.domain, got, tt.want)
+		}
+	}
+
+	fast := p.profiles["fast"]
+	if !fast.EarlyData || fast.SessionCache != "20m" || fast.Ciphers != mozillaIntermediateCiphers {
+		t.Errorf("custom profile should extend intermediate: %+v", fast)
+	}
+}
+
+func TestGenerateConfig_TLSProfiles(t *testing.T) {
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"app.example.com", "printer.lan"}},
+		TLS: config.TLSConfig{
+			Domains:     map[string]string{"printer.lan": TLSProfileOld},
+			DHParamPath: "/runtime/dhparam.pem",
+		},
+	}
+	certs := map[string]ssl.Certificate{
+		"app.example.com": {CertPath: "/certs/app.pem", KeyPath: "/certs/app.key"},
+		"printer.lan":     {CertPath: "/certs/printer.pem", KeyPath: "/certs/printer.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	for _, want := range []string{
+		"ssl_certificate_key /certs/app.key;\n\n        ssl_protocols TLSv1.2 TLSv1.3;\n        ssl_ciphers " + mozillaIntermediateCiphers + ";\n        ssl_prefer_server_ciphers off;\n" +
+			"        ssl_ecdh_curve X25519:prime256v1:secp384r1;\n        ssl_dhparam /runtime/dhparam.pem;\n" +
+			"        ssl_session_cache shared:SSL_intermediate:10m;\n        ssl_session_timeout 1d;\n        ssl_session_tickets off;\n",
+		"ssl_certificate_key /certs/printer.key;\n\n        ssl_protocols TLSv1 TLSv1.1 TLSv1.2 TLSv1.3;\n",
+		"ssl_session_cache shared:SSL_old:10m;",
+	} {
+		if !strings.Contains(ng, want) {
+			t.Errorf("expected %q in config:\n%s", want, ng)
+		}
+	}
+	if strings.Count(ng, "TLSv1.1") != 1 {
+		t.Errorf("only printer.lan should allow TLS 1.1:\n%s", ng)
+	}
+}
+
+func TestGenerateConfig_EarlyDataHeader(t *testing.T) {
+	on := true
+	cfg := &config.Config{
+		Ports: map[string][]string{"3000": {"api.example.com", "app.example.com"}},
+		TLS: config.TLSConfig{
+			Domains:  map[string]string{"api.example.com": "fast"},
+			Profiles: map[string]config.TLSProfile{"fast": {EarlyData: &on}},
+		},
+	}
+	certs := map[string]ssl.Certificate{
+		"api.example.com": {CertPath: "/certs/api.pem", KeyPath: "/certs/api.key"},
+		"app.example.com": {CertPath: "/certs/app.pem", KeyPath: "/certs/app.key"},
+	}
+
+	ng := GenerateConfig(cfg, certs)
+	const header = "proxy_set_header Early-Data $ssl_early_data;"
+	if strings.Count(ng, header) != 1 || strings.Count(ng, "ssl_early_data on;") != 1 {
+		t.Fatalf("expected early data and its header once, for api.example.com:\n%s", ng)
+	}
+	api := ng[strings.Index(ng, "server_name api.example.com;"):]
+	if end := strings.Index(api, "server {"); end >= 0 {
+		api = api[:end]
+	}
+	if !strings.Contains(api, header) {
+		t.Errorf("expected the header in the api.example.com server:\n%s", ng)
+	}
+}
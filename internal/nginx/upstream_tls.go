@@ -0,0 +1,145 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+)
+
+// defaultUpstreamVerifyDepth allows a backend chain of leaf, intermediate and root
+const defaultUpstreamVerifyDepth = 2
+
+// upstreamTLSNameRe limits proxy_ssl_name to host names
+var upstreamTLSNameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// resolveUpstreamTLS keys tls.yaml upstreams by the address nginx connects to, as
+// formatted by formatUpstreamAddr. Entries with invalid settings are refused rather than
+// dropped, so their backends are not reached with weaker settings than configured.
+func resolveUpstreamTLS(entries map[string]config.UpstreamTLSConfig) (map[string]config.UpstreamTLSConfig, []string) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	out := make(map[string]config.UpstreamTLSConfig, len(entries))
+	for _, key := range keys {
+		entry := entries[key]
+		targets, err := config.ParseUpstreamTargets("<https>" + strings.TrimPrefix(strings.TrimSpace(key), "<https>"))
+		if err != nil || len(targets) != 1 || targets[0].Path != "" || targets[0].HasBalanceParams() || targets[0].Protocol != config.ProtocolHTTPS {
+			problems = append(problems, fmt.Sprintf("upstreams: %s: expected a single target like 10.0.0.5:8443 or api.internal; entry ignored", key))
+			continue
+		}
+		switch {
+		case entry.Name != "" && !upstreamTLSNameRe.MatchString(entry.Name):
+			problems = append(problems, fmt.Sprintf("upstreams: %s: invalid name %q; requests are refused", key, entry.Name))
+			entry.Refused = true
+		case entry.VerifyDepth < 0:
+			problems = append(problems, fmt.Sprintf("upstreams: %s: verify_depth must be positive; requests are refused", key))
+			entry.Refused = true
+		case entry.Key != "" && entry.Cert == "":
+			problems = append(problems, fmt.Sprintf("upstreams: %s: key needs cert; requests are refused", key))
+			entry.Refused = true
+		}
+		out[strings.ToLower(formatUpstreamAddr(targets[0]))] = entry
+	}
+	return out, problems
+}
+
+// upstreamTLSFor returns the tls.yaml settings of a route's upstreams, with Name set to
+// the name sent as SNI and verified: the configured name, else the upstream host. The
+// directives apply to the whole location, so a pool uses the entry and host of its first
+// member. nginx verifies against a DNS name only, so a verified route without name whose
+// upstream is an IP address, or whose pool members have different hosts, is refused.
+func upstreamTLSFor(entries map[string]config.UpstreamTLSConfig, route RouteConfig) config.UpstreamTLSConfig {
+	primary := route.Upstreams[0]
+	entry, ok := entries[strings.ToLower(formatUpstreamAddr(primary))]
+	var hosts []string // hosts of pool members other than the primary's
+	seen := map[string]bool{strings.ToLower(primary.Host): true}
+	for _, up := range route.Upstreams[1:] {
+		other, otherOK := entries[strings.ToLower(formatUpstreamAddr(up))]
+		if otherOK != ok || !sameUpstreamTLS(other, entry) {
+			logger.Warn("tls.yaml: upstreams: %s of %s is connected to with the settings of %s; nginx uses one TLS setting per location",
+				formatUpstreamAddr(up), route.DomainPath, formatUpstreamAddr(primary))
+		}
+		if h := strings.ToLower(up.Host); !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, up.Host)
+		}
+	}
+	if entry.Name != "" || entry.Refused {
+		return entry
+	}
+
+	isIP := net.ParseIP(primary.Host) != nil
+	switch {
+	case boolOr(entry.Verify, entry.CA != "") && (isIP || len(hosts) > 0):
+		logger.Warn("tls.yaml: upstreams: %s verifies %s without a DNS name to check the certificate against; set name on %s; requests are refused",
+			route.DomainPath, strings.Join(append([]string{primary.Host}, hosts...), ", "), formatUpstreamAddr(primary))
+		entry.Refused = true
+	case !isIP && len(hosts) > 0 && boolOr(entry.SNI, true):
+		logger.Warn("tls.yaml: upstreams: the pool of %s sends SNI %s to %s too; set name on %s if they need another",
+			route.DomainPath, primary.Host, strings.Join(hosts, ", "), formatUpstreamAddr(primary))
+	}
+	if !isIP {
+		entry.Name = primary.Host
+	}
+	return entry
+}
+
+func sameUpstreamTLS(a, b config.UpstreamTLSConfig) bool {
+	return boolOr(a.Verify, a.CA != "") == boolOr(b.Verify, b.CA != "") && boolOr(a.SNI, true) == boolOr(b.SNI, true) &&
+		a.CA == b.CA && a.VerifyDepth == b.VerifyDepth && a.Name == b.Name && a.Cert == b.Cert && a.Key == b.Key && a.Refused == b.Refused
+}
+
+// boolOr returns *b, or def when b is unset
+func boolOr(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// writeUpstreamTLSDirectives writes the proxy_ssl_* settings of an <https> location for
+// an entry returned by upstreamTLSFor. Without a tls.yaml entry the upstream host is
+// still sent as SNI, so name-based backends present the right certificate; verification
+// needs an entry.
+func writeUpstreamTLSDirectives(sb *strings.Builder, entry config.UpstreamTLSConfig) {
+	name := entry.Name
+	sni := name != "" && boolOr(entry.SNI, true)
+	verify := boolOr(entry.Verify, entry.CA != "")
+	if !sni && !verify && entry.Cert == "" {
+		return
+	}
+
+	sb.WriteString("            # Upstream TLS\n")
+	if name != "" {
+		// Also the name the backend certificate is verified against.
+		sb.WriteString("            proxy_ssl_name " + name + ";\n")
+	}
+	if sni {
+		sb.WriteString("            proxy_ssl_server_name on;\n")
+	}
+	if verify {
+		sb.WriteString("            proxy_ssl_verify on;\n")
+		if entry.CA != "" {
+			sb.WriteString("            proxy_ssl_trusted_certificate " + entry.CA + ";\n")
+		}
+		depth := entry.VerifyDepth
+		if depth == 0 {
+			depth = defaultUpstreamVerifyDepth
+		}
+		sb.WriteString(fmt.Sprintf("            proxy_ssl_verify_depth %d;\n", depth))
+	}
+	if entry.Cert != "" {
+		sb.WriteString("            proxy_ssl_certificate " + entry.Cert + ";\n")
+		sb.WriteString("            proxy_ssl_certificate_key " + entry.Key + ";\n")
+	}
+	sb.WriteString("\n")
+}
@@ -0,0 +1,104 @@
+package nginx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hnrobert/sslly-nginx/internal/config"
+)
+
+func TestResolveUpstreamTLS(t *testing.T) {
+	got, problems := resolveUpstreamTLS(map[string]config.UpstreamTLSConfig{
+		"API.internal":          {CA: "/rt/ca.pem"},
+		"<https>10.0.0.5:8443":  {Name: "svc.internal"},
+		"8443":                  {},
+		"[fd00::5]:8443":        {},
+		"10.0.0.6/api":          {},
+		"10.0.0.7:8443":         {Name: "svc; return 200"},
+		"10.0.0.8 weight=2, :1": {},
+	})
+	for _, key := range []string{"api.internal:443", "10.0.0.5:8443", "127.0.0.1:8443", "[fd00::5]:8443"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("expected an entry for %s, got %v", key, got)
+		}
+	}
+	if !got["10.0.0.7:8443"].Refused {
+		t.Errorf("an entry with an invalid name must be refused: %+v", got["10.0.0.7:8443"])
+	}
+	if len(problems) != 3 || !strings.HasPrefix(problems[0], "upstreams: 10.0.0.6/api: expected a single target") ||
+		!strings.Contains(problems[1], `invalid name "svc; return 200"`) || !strings.HasPrefix(problems[2], "upstreams: 10.0.0.8 weight=2, :1:") {
+		t.Errorf("unexpected problems: %q", problems)
+	}
+}
+
+func TestGenerateConfig_UpstreamTLS(t *testing.T) {
+	off := false
+	cfg := &config.Config{
+		Ports: map[string][]string{
+			"<https>api.internal:8443":                       {"a.example.com"},
+			"<https>10.0.0.5:8443":                           {"b.example.com"},
+			"<https>10.0.0.6:8443":                           {"c.example.com"},
+			"<https>10.0.0.7:8443":                           {"d.example.com"},
+			"<https>10.0.0.8:8443":                           {"e.example.com"},
+			"<https>10.0.0.10:8443, <https>10.0.0.11:8443":   {"f.example.com"},
+			"10.0.0.9:8080":                                  {"g.example.com"},
+			"<https>10.0.0.12:8443, <https>10.0.0.13:8443":   {"h.example.com"},
+			"<https>10.0.0.14:8443":                          {"i.example.com"},
+			"<https>a.internal:8443, <https>b.internal:8443": {"j.example.com"},
+		},
+		TLS: config.TLSConfig{Upstreams: map[string]config.UpstreamTLSConfig{
+			"api.internal:8443": {CA: "/rt/ca.pem", Cert: "/rt/client.pem", Key: "/rt/client.key"},
+			"10.0.0.5:8443":     {Name: "svc.internal", CA: "/rt/ca.pem", VerifyDepth: 3},
+			"10.0.0.6:8443":     {Name: "svc.internal", SNI: &off, CA: "/rt/ca.pem"},
+			"10.0.0.7:8443":     {Refused: true},
+			"10.0.0.10:8443":    {CA: "/rt/ca.pem"},
+			"10.0.0.12:8443":    {Name: "pool.internal", CA: "/rt/ca.pem"},
+			"10.0.0.13:8443":    {Name: "pool.internal", CA: "/rt/ca.pem"},
+			"10.0.0.14:8443":    {CA: "/rt/ca.pem"},
+		}},
+	}
+
+	ng := GenerateConfig(cfg, nil)
+	for _, want := range []string{
+		"proxy_pass https://api.internal:8443;",
+		"            # Upstream TLS\n            proxy_ssl_name api.internal;\n            proxy_ssl_server_name on;\n            proxy_ssl_verify on;\n" +
+			"            proxy_ssl_trusted_certificate /rt/ca.pem;\n            proxy_ssl_verify_depth 2;\n" +
+			"            proxy_ssl_certificate /rt/client.pem;\n            proxy_ssl_certificate_key /rt/client.key;\n",
+		"proxy_ssl_name svc.internal;\n            proxy_ssl_server_name on;\n            proxy_ssl_verify on;\n            proxy_ssl_trusted_certificate /rt/ca.pem;\n            proxy_ssl_verify_depth 3;\n",
+		"proxy_ssl_name svc.internal;\n            proxy_ssl_verify on;\n", // sni: false keeps the verified name only
+		"# Upstream TLS settings not usable (see the tls.yaml warnings)\n            return 502;",
+	} {
+		if !strings.Contains(ng, want) {
+			t.Errorf("expected %q in config:\n%s", want, ng)
+		}
+	}
+	if strings.Contains(ng, "proxy_pass https://10.0.0.7:8443") {
+		t.Errorf("a refused upstream must not be proxied:\n%s", ng)
+	}
+	location := func(proxyPass string) string {
+		i := strings.Index(ng, "proxy_pass "+proxyPass+";")
+		if i < 0 {
+			return ""
+		}
+		return ng[i : i+strings.Index(ng[i:], "}")]
+	}
+	// A verified pool of different hosts has no name to verify against without one.
+	if location("https://pool_http_f_example_com_80") != "" {
+		t.Errorf("a verified pool without name must not be proxied:\n%s", ng)
+	}
+	// Pools use the settings and name of their first member.
+	if pool := location("https://pool_http_h_example_com_80"); !strings.Contains(pool, "proxy_ssl_name pool.internal;\n            proxy_ssl_server_name on;\n            proxy_ssl_verify on;\n") {
+		t.Errorf("expected the pool to be verified against its name:\n%s", pool)
+	}
+	if pool := location("https://pool_http_j_example_com_80"); !strings.Contains(pool, "proxy_ssl_name a.internal;\n            proxy_ssl_server_name on;\n") {
+		t.Errorf("expected the pool to send the first member's host as SNI:\n%s", pool)
+	}
+	// nginx cannot verify an IP address upstream without a name.
+	if location("https://10.0.0.14:8443") != "" {
+		t.Errorf("a verified IP upstream without name must not be proxied:\n%s", ng)
+	}
+	// IP upstreams without entry get no SNI; plain HTTP upstreams get nothing.
+	if strings.Count(ng, "# Upstream TLS\n") != 5 {
+		t.Errorf("expected upstream TLS settings for five locations:\n%s", ng)
+	}
+}
@@ -0,0 +1,261 @@
+package ssl
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/fsutil"
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+)
+
+// scanCacheVersion changes whenever fileContent does; older cache files are discarded.
+const scanCacheVersion = 1
+
+// fileContent is what a file below the SSL directory holds, as far as the scan can tell
+// without passwords. It is what ScanCache stores.
+type fileContent struct {
+	Certs         [][]byte `json:"certs,omitempty"`          // DER, in file order
+	PublicKey     []byte   `json:"public_key,omitempty"`     // PKIX, of an unencrypted private key
+	NeedsPassword bool     `json:"needs_password,omitempty"` // encrypted key or PKCS#12 bundle
+	Unrecognized  string   `json:"unrecognized,omitempty"`   // see unrecognizedFileReason
+
+	parsed []*x509.Certificate // Certs, parsed once per process
+}
+
+// ScanCache keeps the parsed content of every file below the SSL directory between
+// scans, keyed by path, size and modification time, so only changed files are read
+// again. Files that need a password are re-read on every scan; only their kind is kept.
+// Parsed certificates and chain/OCSP results are kept in memory only. A nil *ScanCache
+// disables caching.
+type ScanCache struct {
+	path    string
+	entries map[string]cacheEntry
+	next    map[string]cacheEntry // entries of the running scan
+	dirty   bool
+
+	tree   [32]byte               // fingerprint of entries, see treeFingerprint
+	chains map[string]cachedChain // by CertPath; valid for tree only
+}
+
+// chainCacheTTL bounds how long a chain result is reused, so changes to the system
+// roots are picked up without a file change.
+const chainCacheTTL = time.Hour
+
+// cachedChain is a chain/OCSP result, valid for [from, until) while the certificate's
+// OCSP response file keeps its stamp.
+type cachedChain struct {
+	res         chainResult
+	ocsp        fileStamp
+	from, until time.Time
+}
+
+// fileStamp identifies a version of a file that is not in the scan cache
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime int64
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+type cacheEntry struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"` // UnixNano
+	Content fileContent `json:"content"`
+}
+
+type cacheFile struct {
+	Version int                   `json:"version"`
+	Files   map[string]cacheEntry `json:"files"`
+}
+
+// OpenScanCache loads the cache stored at path. A missing, unreadable or outdated file
+// starts an empty cache.
+func OpenScanCache(path string) *ScanCache {
+	c := &ScanCache{
+		path:    path,
+		entries: make(map[string]cacheEntry),
+		next:    make(map[string]cacheEntry),
+		chains:  make(map[string]cachedChain),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Debug("SSL scan: cache %s not loaded: %v", path, err)
+		}
+		return c
+	}
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != scanCacheVersion {
+		logger.Debug("SSL scan: discarding cache %s (unreadable or from another version)", path)
+		return c
+	}
+	if f.Files != nil {
+		c.entries = f.Files
+	}
+	return c
+}
+
+func (c *ScanCache) get(path string, info os.FileInfo) (fileContent, bool) {
+	if c == nil {
+		return fileContent{}, false
+	}
+	e, ok := c.entries[path]
+	if !ok || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+		return fileContent{}, false
+	}
+	if e.Content.parsed == nil {
+		e.Content.parsed = parseDERCertificates(e.Content.Certs)
+	}
+	c.next[path] = e
+	return e.Content, true
+}
+
+func (c *ScanCache) put(path string, info os.FileInfo, content fileContent) {
+	if c == nil {
+		return
+	}
+	c.next[path] = cacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Content: content}
+	c.dirty = true
+}
+
+// finish keeps the entries of the scan that just ended (dropping deleted files) and
+// saves them when anything changed. Chain results are dropped when any file changed:
+// an added or removed intermediate or root can change every chain.
+func (c *ScanCache) finish() {
+	if c == nil {
+		return
+	}
+	if len(c.next) != len(c.entries) {
+		c.dirty = true
+	}
+	c.entries, c.next = c.next, make(map[string]cacheEntry)
+	if tree := treeFingerprint(c.entries); tree != c.tree {
+		c.tree = tree
+		c.chains = make(map[string]cachedChain)
+	}
+	if !c.dirty {
+		return
+	}
+	if err := c.save(); err != nil {
+		logger.Warn("SSL scan: failed to save cache %s: %v", c.path, err)
+		return
+	}
+	c.dirty = false
+}
+
+// chain returns the stored chain result of certPath when it still holds at now
+func (c *ScanCache) chain(certPath string, now time.Time) (chainResult, bool) {
+	if c == nil {
+		return chainResult{}, false
+	}
+	e, ok := c.chains[certPath]
+	if !ok || now.Before(e.from) || !now.Before(e.until) || e.ocsp != stampFile(certPath+OCSPExt) {
+		return chainResult{}, false
+	}
+	return e.res, true
+}
+
+func (c *ScanCache) putChain(certPath string, res chainResult, now, until time.Time) {
+	if c == nil {
+		return
+	}
+	if limit := now.Add(chainCacheTTL); until.IsZero() || until.After(limit) {
+		until = limit
+	}
+	c.chains[certPath] = cachedChain{res: res, ocsp: stampFile(certPath + OCSPExt), from: now, until: until}
+}
+
+// treeFingerprint hashes the path, size and modification time of every entry
+func treeFingerprint(entries map[string]cacheEntry) [32]byte {
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	var buf [16]byte
+	for _, p := range paths {
+		e := entries[p]
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+		binary.BigEndian.PutUint64(buf[:8], uint64(e.Size))
+		binary.BigEndian.PutUint64(buf[8:], uint64(e.ModTime))
+		h.Write(buf[:])
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func (c *ScanCache) save() error {
+	data, err := json.Marshal(cacheFile{Version: scanCacheVersion, Files: c.entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(c.path, data, 0644)
+}
+
+// readFileContent reads path and classifies what it holds
+func readFileContent(path string) (fileContent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fileContent{}, err
+	}
+
+	var c fileContent
+	if certs, err := parseCertificates(data); err == nil && len(certs) > 0 {
+		for _, cert := range certs {
+			c.Certs = append(c.Certs, cert.Raw)
+		}
+		c.parsed = certs
+	}
+	if findEncryptedKeyBlock(data) != nil {
+		c.NeedsPassword = true
+	} else if key, err := parsePrivateKey(data); err == nil {
+		if pub := publicKeyFromPrivate(key); pub != nil {
+			c.PublicKey, _ = publicKeyBytes(pub)
+		}
+	}
+	if len(c.Certs) == 0 && c.PublicKey == nil && !c.NeedsPassword {
+		if looksLikePKCS12(data) {
+			c.NeedsPassword = true
+		} else {
+			c.Unrecognized = unrecognizedFileReason(path, data)
+		}
+	}
+	return c, nil
+}
+
+// certificates returns the stored certificates, parsing them unless that was done already
+func (c fileContent) certificates() []*x509.Certificate {
+	if c.parsed != nil {
+		return c.parsed
+	}
+	return parseDERCertificates(c.Certs)
+}
+
+func parseDERCertificates(ders [][]byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, der := range ders {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
@@ -0,0 +1,146 @@
+package ssl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanCertificatesCached_OnlyChangedFilesAreRead(t *testing.T) {
+	root := t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "scan-cache.json")
+	certPath := writeTestLeaf(t, filepath.Join(root, "site"), "site", "cached.example.com", testLeaf{})
+	writeTestLeaf(t, filepath.Join(root, "other"), "site", "other.example.com", testLeaf{})
+
+	if _, _, err := ScanCertificatesCached(root, SelectionPolicy{}, OpenScanCache(cachePath)); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Fatalf("expected the cache to be saved: %v", err)
+	}
+
+	// Same size and modification time: the stored content is used, not the file.
+	info, err := os.Stat(certPath)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.WriteFile(certPath, []byte(strings.Repeat("x", int(info.Size()))), 0644); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	if err := os.Chtimes(certPath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	cache := OpenScanCache(cachePath)
+	certMap, _, err := ScanCertificatesCached(root, SelectionPolicy{}, cache)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, ok := certMap["cached.example.com"]; !ok {
+		t.Fatalf("expected the cached certificate, got %v", certMap)
+	}
+
+	// A new modification time makes the scan read the file again.
+	later := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(certPath, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	certMap, _, err = ScanCertificatesCached(root, SelectionPolicy{}, cache)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, ok := certMap["cached.example.com"]; ok {
+		t.Fatal("expected the changed file to be parsed again")
+	}
+
+	// Deleted files are dropped from the cache.
+	if err := os.RemoveAll(filepath.Join(root, "other")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, _, err := ScanCertificatesCached(root, SelectionPolicy{}, cache); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if n := len(OpenScanCache(cachePath).entries); n != 2 {
+		t.Fatalf("expected 2 cached files after the removal, got %d", n)
+	}
+}
+
+func TestScanCertificatesCached_ReusesChainResultsUntilAFileChanges(t *testing.T) {
+	root := newTestCA(t, "Test Root")
+	inter := newTestIntermediate(t, root, "Test Intermediate")
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+	leafPath := writeTestLeaf(t, filepath.Join(dir, "site"), "example.com", "example.com", testLeaf{ca: &inter})
+	cache := OpenScanCache(filepath.Join(t.TempDir(), "scan-cache.json"))
+
+	scan := func() Certificate {
+		t.Helper()
+		certMap, _, err := ScanCertificatesCached(dir, SelectionPolicy{}, cache)
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		return certMap["example.com"]
+	}
+	mark := func() {
+		t.Helper()
+		e, ok := cache.chains[leafPath]
+		if !ok {
+			t.Fatal("expected the chain result to be cached")
+		}
+		e.res.issue = "cached"
+		cache.chains[leafPath] = e
+	}
+
+	if got := scan().ChainIssue; !strings.Contains(got, "not found") {
+		t.Fatalf("ChainIssue = %q, want a missing intermediate", got)
+	}
+	if cache.entries[leafPath].Content.parsed == nil {
+		t.Fatal("expected the parsed certificates to be kept")
+	}
+	mark()
+	if got := scan().ChainIssue; got != "cached" {
+		t.Fatalf("ChainIssue = %q, want the cached result", got)
+	}
+
+	// A new OCSP response is read again.
+	writeFile(t, leafPath+OCSPExt, "not a response")
+	if got := scan(); got.ChainIssue == "cached" || got.OCSPIssue == "" {
+		t.Fatalf("expected the OCSP response to be checked, got %q / %q", got.ChainIssue, got.OCSPIssue)
+	}
+
+	// Any new file below ssl/ may complete a chain.
+	mark()
+	writeFile(t, filepath.Join(dir, "intermediates", "int.pem"), pemOf(inter.cert))
+	if got := scan().ChainIssue; !strings.Contains(got, "completed with intermediates/int.pem") {
+		t.Fatalf("ChainIssue = %q, want the chain completed", got)
+	}
+}
+
+func TestOpenScanCache_DiscardsOtherVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan-cache.json")
+	writeFile(t, path, `{"version":0,"files":{"/ssl/a.pem":{"size":1,"mtime":1,"content":{}}}}`)
+	if n := len(OpenScanCache(path).entries); n != 0 {
+		t.Fatalf("expected an empty cache, got %d entries", n)
+	}
+}
+
+func TestScanCertificates_SkipsLargeAndUnrelatedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTestLeaf(t, root, "site", "ok.example.com", testLeaf{})
+	large := filepath.Join(root, "huge.pem")
+	writeFile(t, large, strings.Repeat("A", maxScanFileSize+1))
+	writeFile(t, filepath.Join(root, "huge.log"), strings.Repeat("A", maxScanFileSize+1))
+	writeFile(t, filepath.Join(root, "notes.md"), "-----BEGIN CERTIFICATE-----\n")
+
+	certMap, report, err := ScanCertificatesWithReport(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, ok := certMap["ok.example.com"]; !ok {
+		t.Fatalf("expected ok.example.com, got %v", certMap)
+	}
+	if len(report.Unused) != 1 || report.Unused[0].Path != large || !strings.Contains(report.Unused[0].Reason, "too large") {
+		t.Fatalf("expected only the large .pem to be reported, got %+v", report.Unused)
+	}
+}
@@ -0,0 +1,276 @@
+package ssl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+)
+
+// CADir holds extra trusted roots (e.g. a corporate root CA), relative to the SSL
+// directory. Certificates there are trusted in addition to the system roots.
+const CADir = "ca"
+
+// maxChainLength bounds chain building; real chains have 2-4 certificates.
+const maxChainLength = 10
+
+// chainChecker verifies that selected certificates chain to a trusted root and completes
+// their chains with intermediates found anywhere below the SSL directory.
+type chainChecker struct {
+	sslDir  string
+	roots   *x509.CertPool
+	found   []foundCert                    // every certificate seen in the scan, in scan order
+	files   map[string][]*x509.Certificate // certificates per file, as stored
+	checked map[string]chainResult         // by CertPath
+	cache   *ScanCache                     // results of earlier scans; may be nil
+}
+
+type foundCert struct {
+	cert *x509.Certificate
+	path string
+}
+
+type chainResult struct {
+	certPEM   []byte // fullchain to serve; nil when the file is served as-is
+	issue     string
+	untrusted bool
+	ocsp      ocspResult
+	until     time.Time // when a validity period in the chain or the OCSP response ends
+}
+
+func newChainChecker(sslDir string) *chainChecker {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		logger.Debug("SSL scan: system roots unavailable: %v", err)
+		roots = x509.NewCertPool()
+	}
+	return &chainChecker{
+		sslDir:  sslDir,
+		roots:   roots,
+		files:   make(map[string][]*x509.Certificate),
+		checked: make(map[string]chainResult),
+	}
+}
+
+// collect records the certificates of a scanned file; those in ssl/ca/ become roots.
+func (ch *chainChecker) collect(path string, certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+	ch.files[path] = certs
+	if rel, err := filepath.Rel(ch.sslDir, path); err == nil && strings.HasPrefix(filepath.ToSlash(rel), CADir+"/") {
+		for _, c := range certs {
+			ch.roots.AddCert(c)
+		}
+		return
+	}
+	for _, c := range certs {
+		ch.found = append(ch.found, foundCert{cert: c, path: path})
+	}
+}
+
+// check fills in the served chain (CertPEM), ChainIssue and OCSP response of c
+func (ch *chainChecker) check(c Certificate, now time.Time) Certificate {
+	res, ok := ch.checked[c.CertPath]
+	if !ok {
+		if res, ok = ch.cache.chain(c.CertPath, now); !ok {
+			res = ch.evaluate(c, now)
+			ch.cache.putChain(c.CertPath, res, now, res.until)
+		}
+		ch.checked[c.CertPath] = res
+	}
+	if res.certPEM != nil {
+		c.CertPEM = res.certPEM
+	}
+	c.ChainIssue, c.untrusted = res.issue, res.untrusted
+	c.OCSPPath, c.OCSPNextUpdate, c.OCSPIssue = res.ocsp.path, res.ocsp.nextUpdate, res.ocsp.issue
+	return c
+}
+
+func (ch *chainChecker) evaluate(c Certificate, now time.Time) chainResult {
+	fileCerts := ch.files[c.CertPath]
+	leaf := pickLeafCertificate(fileCerts)
+	if leaf == nil || isSelfSigned(leaf) {
+		// Nothing to chain (development or internal self-signed certificate).
+		return chainResult{}
+	}
+
+	chain, sources := ch.build(c.CertPath, leaf, fileCerts)
+	served := withoutRoot(chain)
+
+	var res chainResult
+	switch {
+	case sameCertificates(served, withoutRoot(fileCerts)):
+		// Complete and in order.
+	case len(sources) == 0:
+		res.certPEM = encodeCertificates(served)
+		res.issue = "chain in file is misordered or has extra certificates; serving it reordered"
+	default:
+		res.certPEM = encodeCertificates(served)
+		res.issue = "incomplete chain in file; completed with " + strings.Join(sources, ", ")
+	}
+
+	verified, err := ch.verify(leaf, chain, now)
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	} else if len(verified) > 0 && len(verified[0]) > 1 {
+		issuer = verified[0][1] // issued directly by a trusted root
+	}
+	res.ocsp = checkOCSP(c.CertPath, leaf, issuer, now)
+	res.until = nextChange(now, chain, verified, res.ocsp.nextUpdate)
+
+	if err != nil {
+		last := chain[len(chain)-1]
+		problem := fmt.Sprintf("does not chain to a trusted root: %v", err)
+		if isSelfSigned(last) {
+			problem = fmt.Sprintf("chains to untrusted root %q (put it in ssl/%s/ to trust it)", last.Subject.String(), CADir)
+		} else if errors.As(err, new(x509.UnknownAuthorityError)) {
+			problem = fmt.Sprintf("incomplete chain: issuer %q not found in ssl/ or the trusted roots", last.Issuer.String())
+		}
+		if res.issue != "" {
+			problem = res.issue + "; " + problem
+		}
+		res.issue = problem
+		res.untrusted = true
+	}
+	return res
+}
+
+// build follows issuers from leaf, preferring certificates from the same file. It
+// returns the chain (leaf first) and the files other than certPath it used.
+func (ch *chainChecker) build(certPath string, leaf *x509.Certificate, fileCerts []*x509.Certificate) ([]*x509.Certificate, []string) {
+	chain := []*x509.Certificate{leaf}
+	var sources []string
+	for len(chain) < maxChainLength {
+		cur := chain[len(chain)-1]
+		if isSelfSigned(cur) {
+			break
+		}
+
+		var issuer *x509.Certificate
+		source := ""
+		for _, cand := range fileCerts {
+			if issuedBy(cur, cand) && !containsCertificate(chain, cand) {
+				issuer = cand
+				break
+			}
+		}
+		if issuer == nil {
+			for _, f := range ch.found {
+				if issuedBy(cur, f.cert) && !containsCertificate(chain, f.cert) {
+					issuer, source = f.cert, f.path
+					break
+				}
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		if source != "" && source != certPath {
+			if rel, err := filepath.Rel(ch.sslDir, source); err == nil {
+				source = rel
+			}
+			sources = appendUniqueString(sources, source)
+		}
+	}
+	return chain, sources
+}
+
+func (ch *chainChecker) verify(leaf *x509.Certificate, chain []*x509.Certificate, now time.Time) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	// Check the chain, not the leaf's validity period (reported separately).
+	at := now
+	if at.Before(leaf.NotBefore) {
+		at = leaf.NotBefore
+	}
+	if at.After(leaf.NotAfter) {
+		at = leaf.NotAfter
+	}
+	return leaf.Verify(x509.VerifyOptions{
+		Roots:         ch.roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+}
+
+// nextChange returns the first validity boundary after now among the certificates of
+// chain and verified and the OCSP nextUpdate, or zero when there is none.
+func nextChange(now time.Time, chain []*x509.Certificate, verified [][]*x509.Certificate, nextUpdate time.Time) time.Time {
+	var next time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	consider(nextUpdate)
+	for _, certs := range append([][]*x509.Certificate{chain}, verified...) {
+		for _, c := range certs {
+			consider(c.NotBefore)
+			consider(c.NotAfter)
+		}
+	}
+	return next
+}
+
+// issuedBy reports whether cert was signed by issuer
+func issuedBy(cert, issuer *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, issuer.RawSubject) && cert.CheckSignatureFrom(issuer) == nil
+}
+
+// withoutRoot drops a trailing self-signed root: clients have it, servers need not send it.
+func withoutRoot(chain []*x509.Certificate) []*x509.Certificate {
+	if n := len(chain); n > 1 && isSelfSigned(chain[n-1]) {
+		return chain[:n-1]
+	}
+	return chain
+}
+
+func containsCertificate(certs []*x509.Certificate, c *x509.Certificate) bool {
+	for _, x := range certs {
+		if x.Equal(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameCertificates(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, c := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return out
+}
+
+func appendUniqueString(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,164 @@
+package ssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestIntermediate issues an intermediate CA below parent
+func newTestIntermediate(t *testing.T, parent testCA, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(5 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent.cert, &key.PublicKey, parent.key)
+	if err != nil {
+		t.Fatalf("create intermediate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse intermediate: %v", err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+func pemOf(certs ...*x509.Certificate) string {
+	return string(encodeCertificates(certs))
+}
+
+func readFirstPEM(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestScanCertificates_ChainValidation(t *testing.T) {
+	root := newTestCA(t, "Test Root")
+	inter := newTestIntermediate(t, root, "Test Intermediate")
+
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, dir, leafPath string)
+		wantIssue string // substring; "" for no issue
+		wantChain bool   // served chain is leaf + intermediate
+	}{
+		{
+			name: "complete",
+			setup: func(t *testing.T, dir, leafPath string) {
+				writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+				writeFile(t, leafPath, readFirstPEM(t, leafPath)+pemOf(inter.cert))
+			},
+		},
+		{
+			name: "complete with root in file",
+			setup: func(t *testing.T, dir, leafPath string) {
+				writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+				writeFile(t, leafPath, readFirstPEM(t, leafPath)+pemOf(inter.cert, root.cert))
+			},
+		},
+		{
+			name: "intermediate elsewhere in ssl",
+			setup: func(t *testing.T, dir, leafPath string) {
+				writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+				writeFile(t, filepath.Join(dir, "intermediates", "int.pem"), pemOf(inter.cert))
+			},
+			wantIssue: "completed with intermediates/int.pem",
+			wantChain: true,
+		},
+		{
+			name: "misordered",
+			setup: func(t *testing.T, dir, leafPath string) {
+				writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+				writeFile(t, leafPath, pemOf(inter.cert)+readFirstPEM(t, leafPath))
+			},
+			wantIssue: "misordered",
+			wantChain: true,
+		},
+		{
+			name:      "missing intermediate",
+			setup:     func(t *testing.T, dir, leafPath string) {},
+			wantIssue: `issuer "CN=Test Intermediate" not found`,
+		},
+		{
+			name: "untrusted root",
+			setup: func(t *testing.T, dir, leafPath string) {
+				writeFile(t, filepath.Join(dir, "chain", "full.pem"), pemOf(inter.cert, root.cert))
+			},
+			wantIssue: `untrusted root "CN=Test Root,O=Test Root"`,
+			wantChain: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			leafPath := writeTestLeaf(t, filepath.Join(dir, "site"), "example.com", "example.com", testLeaf{ca: &inter})
+			tt.setup(t, dir, leafPath)
+
+			certMap, err := ScanCertificates(dir)
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			cert, ok := certMap["example.com"]
+			if !ok {
+				t.Fatalf("expected example.com, got %v", certMap)
+			}
+			if (tt.wantIssue == "" && cert.ChainIssue != "") || !strings.Contains(cert.ChainIssue, tt.wantIssue) {
+				t.Fatalf("ChainIssue = %q, want %q", cert.ChainIssue, tt.wantIssue)
+			}
+			if tt.wantChain {
+				certs, err := parseCertificates(cert.CertPEM)
+				if err != nil || len(certs) != 2 || certs[0].Subject.CommonName != "example.com" || !certs[1].Equal(inter.cert) {
+					t.Fatalf("expected leaf + intermediate to be served, got %d certs (%v)", len(certs), err)
+				}
+			} else if cert.CertPEM != nil {
+				t.Fatalf("expected the file to be served as-is")
+			}
+		})
+	}
+}
+
+func TestScanCertificates_PrefersFullchainOfSameLeaf(t *testing.T) {
+	root := newTestCA(t, "Test Root")
+	inter := newTestIntermediate(t, root, "Test Intermediate")
+	dir := t.TempDir()
+
+	// certbot live/ layout: cert.pem, chain.pem, fullchain.pem, privkey.pem
+	live := filepath.Join(dir, "live", "example.com")
+	leafPath := writeTestLeaf(t, live, "cert", "example.com", testLeaf{ca: &inter})
+	writeFile(t, filepath.Join(live, "chain.pem"), pemOf(inter.cert))
+	fullchain := filepath.Join(live, "fullchain.pem")
+	writeFile(t, fullchain, readFirstPEM(t, leafPath)+pemOf(inter.cert))
+
+	certMap, report, err := ScanCertificatesWithReport(dir)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if got := certMap["example.com"].CertPath; got != fullchain {
+		t.Fatalf("expected %s, got %s (%v)", fullchain, got, report.Multiple["example.com"].Decisions)
+	}
+}
@@ -0,0 +1,99 @@
+package ssl
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ClientCA is a bundle of CA certificates that issue client certificates, with its
+// optional revocation list, encoded for nginx.
+type ClientCA struct {
+	PEM   []byte // ssl_client_certificate
+	Count int    // certificates in the bundle
+
+	CRL           []byte // ssl_crl (PEM); nil without a CRL
+	CRLNextUpdate time.Time
+}
+
+// LoadClientCA reads a CA bundle (PEM or DER, parsed like the scanned files) and, when
+// crlPath is set, its revocation lists: one DER CRL or concatenated PEM CRLs. nginx
+// checks revocation for every certificate of a client's chain (CRL_CHECK_ALL), so each
+// CA of the bundle needs a CRL it signed; without one every client would be rejected.
+func LoadClientCA(caPath, crlPath string) (ClientCA, error) {
+	data, err := os.ReadFile(caPath)
+	if err != nil {
+		return ClientCA{}, err
+	}
+	cas, err := parseCertificates(data)
+	if err != nil {
+		return ClientCA{}, fmt.Errorf("%s holds no certificate", caPath)
+	}
+	for _, c := range cas {
+		if !c.IsCA {
+			return ClientCA{}, fmt.Errorf("%s: %q is not a CA certificate", caPath, c.Subject.String())
+		}
+	}
+	out := ClientCA{PEM: encodeCertificates(cas), Count: len(cas)}
+	if crlPath == "" {
+		return out, nil
+	}
+
+	data, err = os.ReadFile(crlPath)
+	if err != nil {
+		return ClientCA{}, err
+	}
+	ders, err := crlBlocks(crlPath, data)
+	if err != nil {
+		return ClientCA{}, err
+	}
+	covered := make([]bool, len(cas))
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return ClientCA{}, fmt.Errorf("%s: %w", crlPath, err)
+		}
+		signed := false
+		for i, c := range cas {
+			if crl.CheckSignatureFrom(c) == nil {
+				covered[i], signed = true, true
+			}
+		}
+		if !signed {
+			return ClientCA{}, fmt.Errorf("%s: CRL of %q is not signed by a CA of the bundle", crlPath, crl.Issuer.String())
+		}
+		out.CRL = append(out.CRL, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})...)
+		if out.CRLNextUpdate.IsZero() || (!crl.NextUpdate.IsZero() && crl.NextUpdate.Before(out.CRLNextUpdate)) {
+			out.CRLNextUpdate = crl.NextUpdate
+		}
+	}
+	for i, c := range cas {
+		if !covered[i] {
+			return ClientCA{}, fmt.Errorf("%s has no CRL signed by %q; nginx checks every CA of the chain, so add its CRL to the file", crlPath, c.Subject.String())
+		}
+	}
+	return out, nil
+}
+
+// crlBlocks returns the DER of the CRLs in data: concatenated PEM blocks, or one DER CRL
+func crlBlocks(path string, data []byte) ([][]byte, error) {
+	var ders [][]byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("%s: unexpected PEM block %q (expected X509 CRL)", path, block.Type)
+		}
+		ders = append(ders, block.Bytes)
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	return ders, nil
+}
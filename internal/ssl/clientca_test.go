@@ -0,0 +1,100 @@
+package ssl
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestCRL(t *testing.T, path string, ca testCA, nextUpdate time.Time) {
+	t.Helper()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("create CRL: %v", err)
+	}
+	if err := os.WriteFile(path, der, 0644); err != nil {
+		t.Fatalf("write CRL: %v", err)
+	}
+}
+
+func TestLoadClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "Clients CA")
+	other := newTestCA(t, "Other CA")
+	nextUpdate := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	caPath := filepath.Join(dir, "clients-ca.pem")
+	writeFile(t, caPath, pemOf(ca.cert))
+	writeTestCRL(t, filepath.Join(dir, "clients.crl"), ca, nextUpdate)
+	writeTestCRL(t, filepath.Join(dir, "other.crl"), other, nextUpdate)
+	leafPath := writeTestLeaf(t, dir, "leaf", "client.example.com", testLeaf{ca: &ca})
+
+	got, err := LoadClientCA(caPath, filepath.Join(dir, "clients.crl"))
+	if err != nil {
+		t.Fatalf("LoadClientCA: %v", err)
+	}
+	if got.Count != 1 || string(got.PEM) != pemOf(ca.cert) || !got.CRLNextUpdate.Equal(nextUpdate) {
+		t.Fatalf("unexpected bundle: count=%d next=%s", got.Count, got.CRLNextUpdate)
+	}
+	if block, _ := pem.Decode(got.CRL); block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("expected the DER CRL to be converted to PEM, got %q", got.CRL)
+	}
+
+	for _, tt := range []struct {
+		name, ca, crl, want string
+	}{
+		{"CRL of another CA", caPath, filepath.Join(dir, "other.crl"), "is not signed by a CA of the bundle"},
+		{"leaf instead of CA", leafPath, "", "is not a CA certificate"},
+		{"CRL is a certificate", caPath, caPath, "unexpected PEM block"},
+		{"missing bundle", filepath.Join(dir, "missing.pem"), "", "no such file"},
+	} {
+		if _, err := LoadClientCA(tt.ca, tt.crl); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadClientCA_NeedsCRLOfEveryCA(t *testing.T) {
+	dir := t.TempDir()
+	root := newTestCA(t, "Clients Root CA")
+	issuing := newTestCA(t, "Clients Issuing CA")
+	soon := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	later := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+
+	caPath := filepath.Join(dir, "clients-ca.pem")
+	writeFile(t, caPath, pemOf(root.cert)+pemOf(issuing.cert))
+	writeTestCRL(t, filepath.Join(dir, "root.crl"), root, later)
+	writeTestCRL(t, filepath.Join(dir, "issuing.crl"), issuing, soon)
+
+	if _, err := LoadClientCA(caPath, filepath.Join(dir, "root.crl")); err == nil || !strings.Contains(err.Error(), `has no CRL signed by "CN=Clients Issuing CA`) {
+		t.Fatalf("expected the missing CRL of the issuing CA to be reported, got %v", err)
+	}
+
+	var both []byte
+	for _, name := range []string{"root.crl", "issuing.crl"} {
+		der, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		both = append(both, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})...)
+	}
+	writeFile(t, filepath.Join(dir, "all.crl"), string(both))
+
+	got, err := LoadClientCA(caPath, filepath.Join(dir, "all.crl"))
+	if err != nil {
+		t.Fatalf("LoadClientCA: %v", err)
+	}
+	if string(got.CRL) != string(both) || !got.CRLNextUpdate.Equal(soon) {
+		t.Fatalf("expected both CRLs, due at the earliest next update; next=%s", got.CRLNextUpdate)
+	}
+}
@@ -0,0 +1,136 @@
+package ssl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestFile binds domains to certificate and key files explicitly, relative to the
+// SSL directory. Bound domains skip automatic selection.
+const ManifestFile = "manifest.yaml"
+
+// manifestEntry is one binding; Key may be omitted for PKCS#12 bundles and for keys
+// that can be found by their public key.
+type manifestEntry struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// loadManifest reads manifest.yaml from sslDir. A missing file is not an error.
+//
+//	example.com:
+//	  cert: certs/example.com.pem
+//	  key: private/example.com.key
+func loadManifest(sslDir string) (map[string]manifestEntry, error) {
+	data, err := os.ReadFile(filepath.Join(sslDir, ManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var raw map[string]manifestEntry
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ManifestFile, err)
+	}
+	out := make(map[string]manifestEntry, len(raw))
+	for domain, entry := range raw {
+		out[strings.ToLower(strings.TrimSpace(domain))] = entry
+	}
+	return out, nil
+}
+
+// resolveManifest loads the bound certificate of every manifest entry. Entries that
+// cannot be used are logged and left to automatic selection.
+func resolveManifest(sslDir string, manifest map[string]manifestEntry, pw passwords, keys *keyFiles, chains *chainChecker) map[string]Certificate {
+	domains := make([]string, 0, len(manifest))
+	for domain := range manifest {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	pinned := make(map[string]Certificate, len(manifest))
+	for _, domain := range domains {
+		cert, names, err := resolveManifestEntry(sslDir, manifest[domain], pw, keys, chains)
+		if err != nil {
+			logger.Warn("SSL scan: %s: %s: %v", ManifestFile, domain, err)
+			continue
+		}
+		if !coversDomain(names, domain) {
+			logger.Warn("SSL scan: %s: %s: %s does not list this name (has %s); serving it as bound", ManifestFile, domain, cert.CertPath, strings.Join(names, ", "))
+		}
+		pinned[domain] = cert
+	}
+	return pinned
+}
+
+func resolveManifestEntry(sslDir string, entry manifestEntry, pw passwords, keys *keyFiles, chains *chainChecker) (Certificate, []string, error) {
+	if entry.Cert == "" {
+		return Certificate{}, nil, errors.New("cert is required")
+	}
+	sc, err := readScannedCert(manifestPath(sslDir, entry.Cert), pw)
+	if errors.Is(err, errNotPKCS12) {
+		return Certificate{}, nil, fmt.Errorf("%s is not a certificate", entry.Cert)
+	}
+	if err != nil {
+		return Certificate{}, nil, fmt.Errorf("%s: %v%s", entry.Cert, err, passwordHint(sc.path, err))
+	}
+	if sc.leaf == nil {
+		return Certificate{}, nil, fmt.Errorf("%s has no certificate", entry.Cert)
+	}
+	if _, ok := chains.files[sc.path]; !ok {
+		// Outside the SSL directory: not collected by the walk.
+		chains.collect(sc.path, sc.certs)
+	}
+
+	switch {
+	case entry.Key != "":
+		keyPath := manifestPath(sslDir, entry.Key)
+		kf := keys.read(keyPath)
+		if kf.problem != "" {
+			return Certificate{}, nil, fmt.Errorf("%s: %s", entry.Key, kf.problem)
+		}
+		if kf.pub == nil {
+			return Certificate{}, nil, fmt.Errorf("%s is not a private key", entry.Key)
+		}
+		certPub, err := publicKeyBytes(sc.leaf.PublicKey)
+		if err != nil || !bytes.Equal(certPub, kf.pub) {
+			return Certificate{}, nil, fmt.Errorf("%s does not match %s", entry.Key, entry.Cert)
+		}
+		keys.used[keyPath] = true
+		sc.keyPath, sc.keyPEM = keyPath, kf.decrypted
+	case sc.keyPath == "":
+		p, decrypted, ok := keys.findMatching(sc.path, sc.leaf)
+		if !ok {
+			return Certificate{}, nil, fmt.Errorf("no private key for %s found in ssl/ (set key)", entry.Cert)
+		}
+		sc.keyPath, sc.keyPEM = p, decrypted
+	}
+	return sc.certificate(), sc.domains, nil
+}
+
+// manifestPath resolves a manifest path relative to the SSL directory
+func manifestPath(sslDir, p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(sslDir, filepath.FromSlash(p))
+}
+
+// coversDomain reports whether a certificate with the given names is valid for domain
+func coversDomain(names []string, domain string) bool {
+	m := make(map[string]Certificate, len(names))
+	for _, n := range names {
+		m[n] = Certificate{}
+	}
+	_, ok := FindCertificate(m, domain)
+	return ok
+}
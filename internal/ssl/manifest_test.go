@@ -0,0 +1,63 @@
+package ssl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanCertificates_Manifest(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+
+	// Automatic selection would pick the later expiry; the manifest binds the other one.
+	writeTestLeaf(t, filepath.Join(root, "auto"), "site", "example.com", testLeaf{notAfter: now.Add(300 * 24 * time.Hour)})
+	bound := writeTestLeaf(t, filepath.Join(root, "certs"), "example", "example.com", testLeaf{notAfter: now.Add(30 * 24 * time.Hour)})
+	if err := os.MkdirAll(filepath.Join(root, "private"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	boundKey := filepath.Join(root, "private", "example.key")
+	if err := os.Rename(filepath.Join(root, "certs", "example.key"), boundKey); err != nil {
+		t.Fatalf("move key: %v", err)
+	}
+
+	// Key omitted: found by its public key.
+	other := writeTestLeaf(t, filepath.Join(root, "certs"), "other", "other.example.com", testLeaf{ecdsa: true})
+
+	// Mismatched key: the entry is ignored and automatic selection applies.
+	mismatch := writeTestLeaf(t, filepath.Join(root, "mismatch"), "site", "mismatch.example.com", testLeaf{})
+
+	writeFile(t, filepath.Join(root, ManifestFile), strings.Join([]string{
+		"Example.com:",
+		"  cert: certs/example.pem",
+		"  key: private/example.key",
+		"other.example.com:",
+		"  cert: certs/other.pem",
+		"mismatch.example.com:",
+		"  cert: mismatch/site.pem",
+		"  key: private/example.key",
+		"",
+	}, "\n"))
+
+	certMap, report, err := ScanCertificatesWithReport(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	if cert := certMap["example.com"]; cert.CertPath != bound || cert.KeyPath != boundKey {
+		t.Fatalf("expected the bound certificate, got %+v", cert)
+	}
+	rep := report.Multiple["example.com"]
+	if rep == nil || rep.Selected.CertPath != bound || !strings.Contains(rep.Decisions[len(rep.Decisions)-1], "bound in "+ManifestFile) {
+		t.Fatalf("expected the manifest decision in the report, got %+v", rep)
+	}
+
+	if cert := certMap["other.example.com"]; cert.CertPath != other || cert.KeyPath != filepath.Join(root, "certs", "other.key") {
+		t.Fatalf("expected the bound certificate with its key, got %+v", cert)
+	}
+	if cert := certMap["mismatch.example.com"]; cert.CertPath != mismatch || cert.KeyPath != filepath.Join(root, "mismatch", "site.key") {
+		t.Fatalf("expected automatic selection for the mismatched entry, got %+v", cert)
+	}
+}
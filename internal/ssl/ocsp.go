@@ -0,0 +1,56 @@
+package ssl
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPExt is appended to a certificate file name to find its cached OCSP response,
+// e.g. example.com.pem.ocsp (DER, as written by `openssl ocsp -respout`).
+const OCSPExt = ".ocsp"
+
+// ocspResult is the outcome of checking a certificate's OCSP response file
+type ocspResult struct {
+	path       string // response to staple; empty when there is none or it is unusable
+	nextUpdate time.Time
+	issue      string
+}
+
+// checkOCSP validates the response next to certPath against leaf and its issuer. A
+// missing file is not an issue; stale, revoked and unverifiable responses are.
+func checkOCSP(certPath string, leaf, issuer *x509.Certificate, now time.Time) ocspResult {
+	path := certPath + OCSPExt
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ocspResult{}
+		}
+		return ocspResult{issue: fmt.Sprintf("%s unreadable: %v", path, err)}
+	}
+	if issuer == nil {
+		return ocspResult{issue: fmt.Sprintf("%s not used: issuer certificate not found in ssl/", path)}
+	}
+
+	resp, err := ocsp.ParseResponseForCert(data, leaf, issuer)
+	if err != nil {
+		return ocspResult{issue: fmt.Sprintf("%s not used: invalid response: %v", path, err)}
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return ocspResult{issue: fmt.Sprintf("%s: certificate revoked at %s", path, resp.RevokedAt.Format(time.RFC3339))}
+	default:
+		return ocspResult{issue: fmt.Sprintf("%s not used: responder does not know the certificate", path)}
+	}
+	if resp.ThisUpdate.After(now) {
+		return ocspResult{issue: fmt.Sprintf("%s not used: not valid before %s", path, resp.ThisUpdate.Format(time.RFC3339))}
+	}
+	if !resp.NextUpdate.IsZero() && !resp.NextUpdate.After(now) {
+		return ocspResult{issue: fmt.Sprintf("%s not used: stale since %s (fetch a fresh response)", path, resp.NextUpdate.Format(time.RFC3339))}
+	}
+	return ocspResult{path: path, nextUpdate: resp.NextUpdate}
+}
@@ -0,0 +1,112 @@
+package ssl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeTestOCSP writes a response for the leaf in certPath, signed by signer
+func writeTestOCSP(t *testing.T, certPath string, issuer, signer testCA, tmpl ocsp.Response) {
+	t.Helper()
+	certs, err := parseCertificates([]byte(readFirstPEM(t, certPath)))
+	if err != nil {
+		t.Fatalf("parse leaf: %v", err)
+	}
+	tmpl.SerialNumber = certs[0].SerialNumber
+	der, err := ocsp.CreateResponse(issuer.cert, signer.cert, tmpl, signer.key)
+	if err != nil {
+		t.Fatalf("create OCSP response: %v", err)
+	}
+	if err := os.WriteFile(certPath+OCSPExt, der, 0644); err != nil {
+		t.Fatalf("write OCSP response: %v", err)
+	}
+}
+
+func TestScanCertificates_OCSPResponses(t *testing.T) {
+	root := newTestCA(t, "Test Root")
+	other := newTestCA(t, "Other Root")
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, certPath string)
+		wantStaple bool
+		wantIssue  string // substring; "" for no issue
+	}{
+		{
+			name:  "no response",
+			setup: func(t *testing.T, certPath string) {},
+		},
+		{
+			name: "good",
+			setup: func(t *testing.T, certPath string) {
+				writeTestOCSP(t, certPath, root, root, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(72 * time.Hour)})
+			},
+			wantStaple: true,
+		},
+		{
+			name: "stale",
+			setup: func(t *testing.T, certPath string) {
+				writeTestOCSP(t, certPath, root, root, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-96 * time.Hour), NextUpdate: now.Add(-time.Hour)})
+			},
+			wantIssue: "stale since",
+		},
+		{
+			name: "revoked",
+			setup: func(t *testing.T, certPath string) {
+				writeTestOCSP(t, certPath, root, root, ocsp.Response{Status: ocsp.Revoked, RevokedAt: now.Add(-time.Hour), ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(72 * time.Hour)})
+			},
+			wantIssue: "certificate revoked",
+		},
+		{
+			name: "signed by another CA",
+			setup: func(t *testing.T, certPath string) {
+				writeTestOCSP(t, certPath, other, other, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-time.Hour), NextUpdate: now.Add(72 * time.Hour)})
+			},
+			wantIssue: "invalid response",
+		},
+		{
+			name: "garbage",
+			setup: func(t *testing.T, certPath string) {
+				writeFile(t, certPath+OCSPExt, "not an OCSP response")
+			},
+			wantIssue: "invalid response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, CADir, "root.pem"), pemOf(root.cert))
+			certPath := writeTestLeaf(t, filepath.Join(dir, "site"), "example.com", "example.com", testLeaf{ca: &root})
+			tt.setup(t, certPath)
+
+			certMap, report, err := ScanCertificatesWithReport(dir)
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			cert, ok := certMap["example.com"]
+			if !ok {
+				t.Fatalf("expected example.com, got %v", certMap)
+			}
+			if (tt.wantIssue == "" && cert.OCSPIssue != "") || !strings.Contains(cert.OCSPIssue, tt.wantIssue) {
+				t.Fatalf("OCSPIssue = %q, want %q", cert.OCSPIssue, tt.wantIssue)
+			}
+			if tt.wantStaple {
+				if cert.OCSPPath != certPath+OCSPExt || !cert.OCSPNextUpdate.After(now) {
+					t.Fatalf("expected %s to be stapled, got %q (next update %s)", certPath+OCSPExt, cert.OCSPPath, cert.OCSPNextUpdate)
+				}
+			} else if cert.OCSPPath != "" {
+				t.Fatalf("expected no staple, got %s", cert.OCSPPath)
+			}
+			if len(report.Unused) != 0 {
+				t.Fatalf("the response file must not be reported as unused: %+v", report.Unused)
+			}
+		})
+	}
+}
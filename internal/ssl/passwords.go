@@ -0,0 +1,91 @@
+package ssl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PasswordsFile lists passwords for PKCS#12 bundles and encrypted keys, relative to the
+// SSL directory.
+const PasswordsFile = "passwords.yaml"
+
+// passwordSidecarExts are appended to a bundle or key path to find its password file,
+// e.g. corp.pfx.pass next to corp.pfx.
+var passwordSidecarExts = []string{".pass", ".password"}
+
+// passwords resolves the password for a file below the SSL directory
+type passwords struct {
+	root     string
+	patterns map[string]string // slash-separated path or glob relative to root -> password
+}
+
+// loadPasswords reads passwords.yaml from sslDir. A missing file is not an error.
+//
+//	corp/bundle.pfx: secret
+//	'*.p12': other      # patterns without '/' also match the file name anywhere
+func loadPasswords(sslDir string) (passwords, error) {
+	p := passwords{root: sslDir}
+	data, err := os.ReadFile(filepath.Join(sslDir, PasswordsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return p, err
+	}
+	if err := yaml.Unmarshal(data, &p.patterns); err != nil {
+		return p, fmt.Errorf("failed to parse %s: %w", PasswordsFile, err)
+	}
+	return p, nil
+}
+
+// lookup returns the password for path: a sidecar file wins over passwords.yaml, where
+// an exact path wins over a pattern.
+func (p passwords) lookup(path string) (string, bool) {
+	for _, ext := range passwordSidecarExts {
+		if data, err := os.ReadFile(path + ext); err == nil {
+			return strings.TrimRight(string(data), "\r\n"), true
+		}
+	}
+	if len(p.patterns) == 0 {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(p.root, path)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if pw, ok := p.patterns[rel]; ok {
+		return pw, true
+	}
+
+	// Most specific (longest) matching pattern wins.
+	best, bestLen := "", -1
+	for pattern, pw := range p.patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(pattern, target); ok && len(pattern) > bestLen {
+			best, bestLen = pw, len(pattern)
+		}
+	}
+	return best, bestLen >= 0
+}
+
+// isPasswordFile reports whether path holds passwords rather than certificate material
+func isPasswordFile(path string) bool {
+	if filepath.Base(path) == PasswordsFile {
+		return true
+	}
+	for _, ext := range passwordSidecarExts {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package ssl
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Key types reported in Certificate.KeyType and accepted by Preference.KeyType
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// SelectionPolicy decides between certificates that cover the same domain.
+//
+// Candidates are ranked by, in order:
+//  1. validity at Now: valid, then not yet valid, then expired
+//  2. the domain's Preference (issuer and key type)
+//  3. CA-issued over self-signed
+//  4. latest NotAfter
+//  5. the file bundling more of the chain
+//  6. .pem over .crt, then path order
+type SelectionPolicy struct {
+	Now time.Time // validity reference time (default: time.Now())
+
+	// Prefer pins the issuer and/or key type per domain. Keys are a domain,
+	// a wildcard pattern ("*.example.com") or "*" for every domain.
+	Prefer map[string]Preference
+}
+
+// Preference pins the certificate a domain should use when several qualify
+type Preference struct {
+	Issuer  string // case-insensitive substring of the issuer DN, e.g. "Let's Encrypt"
+	KeyType string // rsa, ecdsa or ed25519
+}
+
+func (p SelectionPolicy) now() time.Time {
+	if p.Now.IsZero() {
+		return time.Now()
+	}
+	return p.Now
+}
+
+// preferenceFor returns the most specific preference for domain: its own entry, then the
+// wildcard pattern that covers it (one label, like the certificate), then "*".
+func (p SelectionPolicy) preferenceFor(domain string) (Preference, bool) {
+	if len(p.Prefer) == 0 {
+		return Preference{}, false
+	}
+	if pref, ok := p.Prefer[domain]; ok {
+		return pref, true
+	}
+	if pattern := WildcardPattern(domain); pattern != "" {
+		if pref, ok := p.Prefer[pattern]; ok {
+			return pref, true
+		}
+	}
+	pref, ok := p.Prefer["*"]
+	return pref, ok
+}
+
+// matches counts how many of the pinned attributes c has
+func (pref Preference) matches(c Certificate) int {
+	n := 0
+	if pref.Issuer != "" && strings.Contains(strings.ToLower(c.Issuer), strings.ToLower(pref.Issuer)) {
+		n++
+	}
+	if pref.KeyType != "" && strings.EqualFold(pref.KeyType, c.KeyType) {
+		n++
+	}
+	return n
+}
+
+func (pref Preference) String() string {
+	var parts []string
+	if pref.Issuer != "" {
+		parts = append(parts, fmt.Sprintf("issuer %q", pref.Issuer))
+	}
+	if pref.KeyType != "" {
+		parts = append(parts, "key type "+pref.KeyType)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Validity ranks, higher is better
+const (
+	rankExpired = iota
+	rankNotYetValid
+	rankValid
+)
+
+// validityRank orders candidates by usability at now: valid > not yet valid > expired
+func validityRank(c Certificate, now time.Time) int {
+	switch {
+	case !c.NotAfter.IsZero() && !c.NotAfter.After(now):
+		return rankExpired
+	case c.NotBefore.After(now):
+		return rankNotYetValid
+	default:
+		return rankValid
+	}
+}
+
+// trusted reports whether c is CA-issued and chains to a trusted root
+func (c Certificate) trusted() bool {
+	return !c.SelfSigned && !c.untrusted
+}
+
+func validityProblem(c Certificate, now time.Time) string {
+	if validityRank(c, now) == rankNotYetValid {
+		return "is not valid until " + c.NotBefore.UTC().Format(time.RFC3339)
+	}
+	return "expired at " + c.NotAfter.UTC().Format(time.RFC3339)
+}
+
+// compare reports whether candidate should replace existing for domain, and explains
+// the decision as "<selected> over <other>: <reason>".
+func (p SelectionPolicy) compare(domain string, existing, candidate Certificate) (bool, string) {
+	explain := func(replace bool, why string) (bool, string) {
+		winner, loser := existing, candidate
+		if replace {
+			winner, loser = candidate, existing
+		}
+		return replace, fmt.Sprintf("%s over %s: %s", winner.CertPath, loser.CertPath, why)
+	}
+
+	now := p.now()
+	if er, cr := validityRank(existing, now), validityRank(candidate, now); er != cr {
+		loser := candidate
+		if cr > er {
+			loser = existing
+		}
+		return explain(cr > er, "the other "+validityProblem(loser, now))
+	}
+
+	if existing.trusted() != candidate.trusted() {
+		loser := candidate
+		if candidate.trusted() {
+			loser = existing
+		}
+		why := "the other is self-signed"
+		if !loser.SelfSigned {
+			why = "the other has a broken chain: " + loser.ChainIssue
+		}
+		return explain(candidate.trusted(), why)
+	}
+
+	if pref, ok := p.preferenceFor(domain); ok {
+		if em, cm := pref.matches(existing), pref.matches(candidate); em != cm {
+			return explain(cm > em, "matches the preferred "+pref.String())
+		}
+	}
+
+	if existing.SelfSigned != candidate.SelfSigned {
+		return explain(existing.SelfSigned, "CA-issued preferred over self-signed")
+	}
+
+	if !candidate.NotAfter.Equal(existing.NotAfter) {
+		return explain(candidate.NotAfter.After(existing.NotAfter), "expires later")
+	}
+
+	// e.g. certbot's fullchain.pem over cert.pem
+	if candidate.bundled != existing.bundled {
+		return explain(candidate.bundled > existing.bundled, "same expiry, file includes more of the chain")
+	}
+
+	// Prefer pem > crt when everything else is equal.
+	existingPriority := certificatePathPriority(existing.CertPath)
+	candidatePriority := certificatePathPriority(candidate.CertPath)
+	if candidatePriority != existingPriority {
+		return explain(candidatePriority > existingPriority, "same expiry, .pem preferred over .crt")
+	}
+
+	// Deterministic tie-breakers.
+	if !strings.EqualFold(candidate.CertPath, existing.CertPath) {
+		return explain(strings.ToLower(candidate.CertPath) < strings.ToLower(existing.CertPath), "equivalent, first by path")
+	}
+	return explain(strings.ToLower(candidate.KeyPath) < strings.ToLower(existing.KeyPath), "equivalent, first by key path")
+}
+
+// combine picks the primary certificate for domain among the best certificate of each
+// key algorithm. The others are served alongside it when they are valid, the domain does
+// not pin a key type and they are as trustworthy as the primary (not self-signed or
+// untrusted next to a CA-issued or trusted one), since clients may pick either;
+// otherwise they are reported as ignored.
+func (p SelectionPolicy) combine(domain string, byKeyType map[string]Certificate, report *ScanReport) Certificate {
+	keyTypes := make([]string, 0, len(byKeyType))
+	for kt := range byKeyType {
+		keyTypes = append(keyTypes, kt)
+	}
+	sort.Strings(keyTypes)
+
+	primary := byKeyType[keyTypes[0]]
+	for _, kt := range keyTypes[1:] {
+		if replace, _ := p.compare(domain, primary, byKeyType[kt]); replace {
+			primary = byKeyType[kt]
+		}
+	}
+
+	pref, ok := p.preferenceFor(domain)
+	pinned := ok && pref.KeyType != ""
+	now := p.now()
+	for _, kt := range keyTypes {
+		c := byKeyType[kt]
+		if kt == primary.KeyType {
+			continue
+		}
+		var reason string
+		switch {
+		case pinned || validityRank(c, now) != rankValid:
+			_, reason = p.compare(domain, primary, c)
+		case c.SelfSigned && !primary.SelfSigned:
+			reason = fmt.Sprintf("%s over %s: not serving a self-signed certificate next to a CA-issued one", primary.CertPath, c.CertPath)
+		case c.untrusted && !primary.untrusted:
+			reason = fmt.Sprintf("%s over %s: not serving an untrusted certificate next to a trusted one", primary.CertPath, c.CertPath)
+		default:
+			primary.Additional = append(primary.Additional, c)
+			continue
+		}
+		report.recordCandidate(domain, primary, c, false, reason)
+	}
+
+	if rep, ok := report.Multiple[domain]; ok {
+		rep.Selected = primary
+	}
+	return primary
+}
+
+// keyType names the public key algorithm of cert
+func keyType(cert *x509.Certificate) string {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA
+	case *ecdsa.PublicKey:
+		return KeyTypeECDSA
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	default:
+		return ""
+	}
+}
+
+// isSelfSigned reports whether cert is signed by its own key
+func isSelfSigned(cert *x509.Certificate) bool {
+	if string(cert.RawIssuer) != string(cert.RawSubject) {
+		return false
+	}
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,335 @@
+package ssl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{name}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA: %v", err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+type testLeaf struct {
+	notBefore time.Time
+	notAfter  time.Time
+	ecdsa     bool
+	ca        *testCA // nil: self-signed
+}
+
+// writeTestLeaf writes <name>.pem and <name>.key for domain into dir
+func writeTestLeaf(t *testing.T, dir, name, domain string, opts testLeaf) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	var key crypto.Signer
+	var err error
+	if opts.ecdsa {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	if opts.notBefore.IsZero() {
+		opts.notBefore = time.Now().Add(-time.Hour)
+	}
+	if opts.notAfter.IsZero() {
+		opts.notAfter = time.Now().Add(90 * 24 * time.Hour)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    opts.notBefore,
+		NotAfter:     opts.notAfter,
+		DNSNames:     []string{domain},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := tmpl, key
+	if opts.ca != nil {
+		parent, signer = opts.ca.cert, opts.ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certPath
+}
+
+func TestScanCertificatesWithPolicy_SkipsNotYetValid(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	// The future certificate expires later, but cannot be served yet.
+	current := writeTestLeaf(t, filepath.Join(root, "a"), "current", "example.com", testLeaf{notAfter: now.Add(10 * 24 * time.Hour)})
+	writeTestLeaf(t, filepath.Join(root, "b"), "future", "example.com", testLeaf{notBefore: now.Add(24 * time.Hour), notAfter: now.Add(100 * 24 * time.Hour)})
+
+	certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if got := certMap["example.com"].CertPath; got != current {
+		t.Fatalf("expected %s, got %s", current, got)
+	}
+	rep := report.Multiple["example.com"]
+	if rep == nil || len(rep.Decisions) != 1 || !strings.Contains(rep.Decisions[0], "not valid until") {
+		t.Fatalf("expected a not-yet-valid decision, got %+v", rep)
+	}
+
+	// Once it becomes valid, the later expiry wins.
+	certMap, _, err = ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now.Add(48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if got := certMap["example.com"].CertPath; got == current {
+		t.Fatalf("expected the future certificate after its NotBefore, got %s", got)
+	}
+}
+
+func TestScanCertificatesWithPolicy_PrefersCAIssued(t *testing.T) {
+	root := t.TempDir()
+	ca := newTestCA(t, "Test Issuing CA")
+	issued := writeTestLeaf(t, filepath.Join(root, "a"), "issued", "example.com", testLeaf{ca: &ca, notAfter: time.Now().Add(30 * 24 * time.Hour)})
+	writeTestLeaf(t, filepath.Join(root, "b"), "selfsigned", "example.com", testLeaf{notAfter: time.Now().Add(300 * 24 * time.Hour)})
+
+	certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	cert := certMap["example.com"]
+	if cert.CertPath != issued || cert.SelfSigned || !strings.Contains(cert.Issuer, "Test Issuing CA") {
+		t.Fatalf("expected CA-issued certificate, got %+v", cert)
+	}
+	if d := report.Multiple["example.com"].Decisions; !strings.Contains(d[len(d)-1], "self-signed") {
+		t.Fatalf("unexpected decisions: %v", d)
+	}
+}
+
+func TestScanCertificatesWithPolicy_Preferences(t *testing.T) {
+	root := t.TempDir()
+	corp := newTestCA(t, "Corp CA")
+	public := newTestCA(t, "Public CA")
+	rsaCert := writeTestLeaf(t, filepath.Join(root, "a"), "rsa", "app.example.com", testLeaf{ca: &public, notAfter: time.Now().Add(60 * 24 * time.Hour)})
+	ecCert := writeTestLeaf(t, filepath.Join(root, "b"), "ec", "app.example.com", testLeaf{ca: &corp, ecdsa: true, notAfter: time.Now().Add(30 * 24 * time.Hour)})
+
+	tests := []struct {
+		name   string
+		prefer map[string]Preference
+		want   string
+	}{
+		{name: "no preference uses later expiry", want: rsaCert},
+		{name: "key type", prefer: map[string]Preference{"*": {KeyType: KeyTypeECDSA}}, want: ecCert},
+		{name: "issuer via wildcard", prefer: map[string]Preference{"*.example.com": {Issuer: "corp ca"}}, want: ecCert},
+		{name: "exact beats wildcard", prefer: map[string]Preference{"*.example.com": {KeyType: KeyTypeECDSA}, "app.example.com": {Issuer: "Public"}}, want: rsaCert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certMap, _, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Prefer: tt.prefer})
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if got := certMap["app.example.com"].CertPath; got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSelectionPolicy_PreferenceForWildcardCoversOneLabel(t *testing.T) {
+	policy := SelectionPolicy{Prefer: map[string]Preference{
+		"*":             {KeyType: KeyTypeRSA},
+		"*.example.com": {KeyType: KeyTypeECDSA},
+	}}
+	tests := map[string]string{
+		"app.example.com":   KeyTypeECDSA,
+		"*.example.com":     KeyTypeECDSA,
+		"a.b.example.com":   KeyTypeRSA,
+		"example.com":       KeyTypeRSA,
+		"app.other.example": KeyTypeRSA,
+	}
+	for domain, want := range tests {
+		if pref, ok := policy.preferenceFor(domain); !ok || pref.KeyType != want {
+			t.Errorf("preferenceFor(%s) = %+v, %v; want key type %s", domain, pref, ok, want)
+		}
+	}
+}
+
+func TestSelectionPolicyCompare_ExpiredLoses(t *testing.T) {
+	now := time.Now()
+	expired := Certificate{CertPath: "/ssl/old.pem", NotBefore: now.Add(-400 * 24 * time.Hour), NotAfter: now.Add(-time.Hour)}
+	valid := Certificate{CertPath: "/ssl/new.pem", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour), SelfSigned: true}
+
+	replace, reason := SelectionPolicy{Now: now}.compare("example.com", expired, valid)
+	if !replace {
+		t.Fatalf("expected the valid certificate to replace the expired one")
+	}
+	if !strings.HasPrefix(reason, "/ssl/new.pem over /ssl/old.pem: ") || !strings.Contains(reason, "expired at") {
+		t.Fatalf("unexpected reason: %s", reason)
+	}
+}
+
+func TestScanCertificatesWithPolicy_DualKeyTypes(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	ecCert := writeTestLeaf(t, filepath.Join(root, "ec"), "ec", "example.com", testLeaf{ecdsa: true, notAfter: now.Add(60 * 24 * time.Hour)})
+	rsaCert := writeTestLeaf(t, filepath.Join(root, "rsa"), "rsa", "example.com", testLeaf{notAfter: now.Add(30 * 24 * time.Hour)})
+	// An older RSA certificate competes with its RSA twin only.
+	writeTestLeaf(t, filepath.Join(root, "rsa-old"), "rsa-old", "example.com", testLeaf{notAfter: now.Add(10 * 24 * time.Hour)})
+
+	certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	cert := certMap["example.com"]
+	if cert.CertPath != ecCert || cert.KeyType != KeyTypeECDSA {
+		t.Fatalf("expected the ECDSA certificate as primary, got %+v", cert)
+	}
+	if len(cert.Additional) != 1 || cert.Additional[0].CertPath != rsaCert {
+		t.Fatalf("expected the newest RSA certificate served alongside, got %+v", cert.Additional)
+	}
+	rep := report.Multiple["example.com"]
+	if rep == nil || rep.Selected.CertPath != ecCert || len(rep.All) != 2 {
+		t.Fatalf("expected only the RSA duplicates in the report, got %+v", rep)
+	}
+
+	// Pinning a key type serves that type only.
+	certMap, report, err = ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now, Prefer: map[string]Preference{"*": {KeyType: KeyTypeRSA}}})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if cert := certMap["example.com"]; cert.CertPath != rsaCert || len(cert.Additional) != 0 {
+		t.Fatalf("expected only the RSA certificate, got %+v", cert)
+	}
+	if d := report.Multiple["example.com"].Decisions; !strings.Contains(d[len(d)-1], "preferred key type rsa") {
+		t.Fatalf("unexpected decisions: %v", d)
+	}
+}
+
+func TestScanCertificatesWithPolicy_InvalidKeyTypeNotServedAlongside(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	rsaCert := writeTestLeaf(t, filepath.Join(root, "rsa"), "rsa", "example.com", testLeaf{notAfter: now.Add(30 * 24 * time.Hour)})
+	writeTestLeaf(t, filepath.Join(root, "ec"), "ec", "example.com", testLeaf{ecdsa: true, notBefore: now.Add(-48 * time.Hour), notAfter: now.Add(-24 * time.Hour)})
+
+	certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if cert := certMap["example.com"]; cert.CertPath != rsaCert || len(cert.Additional) != 0 {
+		t.Fatalf("expected the expired ECDSA certificate to be ignored, got %+v", cert)
+	}
+	if rep := report.Multiple["example.com"]; rep == nil || len(rep.All) != 2 {
+		t.Fatalf("expected the expired certificate in the report, got %+v", rep)
+	}
+}
+
+func TestScanCertificatesWithPolicy_LessTrustedKeyTypeNotServedAlongside(t *testing.T) {
+	now := time.Now()
+	trusted := newTestCA(t, "Trusted CA")
+	untrusted := newTestCA(t, "Untrusted CA")
+
+	tests := []struct {
+		name string
+		ca   *testCA // of the RSA certificate
+		want string
+	}{
+		{name: "self-signed", want: "self-signed"},
+		{name: "untrusted", ca: &untrusted, want: "untrusted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFile(t, filepath.Join(root, CADir, "root.pem"), pemOf(trusted.cert))
+			ecCert := writeTestLeaf(t, filepath.Join(root, "ec"), "ec", "example.com", testLeaf{ca: &trusted, ecdsa: true, notAfter: now.Add(60 * 24 * time.Hour)})
+			writeTestLeaf(t, filepath.Join(root, "rsa"), "rsa", "example.com", testLeaf{ca: tt.ca, notAfter: now.Add(30 * 24 * time.Hour)})
+
+			certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now})
+			if err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			if cert := certMap["example.com"]; cert.CertPath != ecCert || cert.ChainIssue != "" || len(cert.Additional) != 0 {
+				t.Fatalf("expected the trusted ECDSA certificate alone, got %+v", cert)
+			}
+			rep := report.Multiple["example.com"]
+			if rep == nil || len(rep.All) != 2 || !strings.Contains(rep.Decisions[len(rep.Decisions)-1], tt.want) {
+				t.Fatalf("expected the %s RSA certificate as a losing candidate, got %+v", tt.name, rep)
+			}
+		})
+	}
+}
+
+func TestScanCertificatesWithPolicy_TrustedChainBeatsLaterExpiry(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	trusted := newTestCA(t, "Trusted Root CA")
+	unknown := newTestCA(t, "Unknown CA")
+	writeFile(t, filepath.Join(root, CADir, "root.pem"), pemOf(trusted.cert))
+	good := writeTestLeaf(t, filepath.Join(root, "a"), "good", "example.com", testLeaf{ca: &trusted, notAfter: now.Add(30 * 24 * time.Hour)})
+	broken := writeTestLeaf(t, filepath.Join(root, "b"), "broken", "example.com", testLeaf{ca: &unknown, notAfter: now.Add(300 * 24 * time.Hour)})
+
+	certMap, report, err := ScanCertificatesWithPolicy(root, SelectionPolicy{Now: now})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if cert := certMap["example.com"]; cert.CertPath != good || cert.ChainIssue != "" {
+		t.Fatalf("expected the certificate with a trusted chain, got %+v", cert)
+	}
+	d := report.Multiple["example.com"].Decisions
+	if want := good + " over " + broken + ": the other has a broken chain"; !strings.HasPrefix(d[len(d)-1], want) {
+		t.Fatalf("unexpected decisions: %v", d)
+	}
+}
@@ -6,33 +6,90 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/hnrobert/sslly-nginx/internal/logger"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type Certificate struct {
-	CertPath string
-	KeyPath  string
-	NotAfter time.Time
+	CertPath  string
+	KeyPath   string
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	Issuer     string // issuer DN of the leaf
+	KeyType    string // rsa, ecdsa or ed25519
+	SelfSigned bool
+
+	// Additional holds certificates with other key algorithms served alongside this
+	// one (e.g. RSA next to ECDSA); nginx picks per client.
+	Additional []Certificate
+
+	// CertPEM and KeyPEM hold converted material (PKCS#12 bundles, encrypted keys) to
+	// serve instead of the files; nil when the files can be used as they are.
+	CertPEM []byte
+	KeyPEM  []byte
+
+	// ChainIssue explains a chain that had to be completed or reordered, or that does
+	// not reach a trusted root; empty when the chain is fine.
+	ChainIssue string
+
+	// OCSPPath is the validated OCSP response to staple (<cert>.ocsp), fresh until
+	// OCSPNextUpdate. OCSPIssue explains a response that is not stapled.
+	OCSPPath       string
+	OCSPNextUpdate time.Time
+	OCSPIssue      string
+
+	bundled   int  // certificates in the file; a file that carries the chain wins a tie
+	untrusted bool // CA-issued, but does not chain to a trusted root; set by chainChecker.check
 }
 
 type MultipleCertificateReport struct {
 	Selected Certificate
 	All      []Certificate
+	// Decisions explains each comparison, e.g. "/a.pem over /b.pem: expires later".
+	// The last entry is the reason the selected certificate won.
+	Decisions []string
+}
+
+// FileIssue is a file below the SSL directory that is not served, and why
+type FileIssue struct {
+	Path    string
+	Reason  string
+	Domains []string // names of the certificate, if the file holds one
 }
 
 type ScanReport struct {
 	Multiple map[string]*MultipleCertificateReport
+	// Unused lists certificates without keys, keys without certificates and files
+	// that could not be read, sorted by path.
+	Unused []FileIssue
+	// Refused lists certificate names that TLS clients reject, sorted by path.
+	Refused []NameIssue
+}
+
+// NameIssue is a wildcard certificate name that TLS clients would refuse
+type NameIssue struct {
+	Path   string
+	Name   string
+	Reason string
 }
 
-func (r *ScanReport) recordCandidate(domain string, currentSelected Certificate, candidate Certificate, replaced bool) {
+func (r *ScanReport) addUnused(path, reason string, domains []string) {
+	r.Unused = append(r.Unused, FileIssue{Path: path, Reason: reason, Domains: domains})
+}
+
+func (r *ScanReport) recordCandidate(domain string, currentSelected Certificate, candidate Certificate, replaced bool, reason string) {
 	if r.Multiple == nil {
 		r.Multiple = make(map[string]*MultipleCertificateReport)
 	}
@@ -52,6 +109,7 @@ func (r *ScanReport) recordCandidate(domain string, currentSelected Certificate,
 	}
 
 	appendUnique(candidate)
+	rep.Decisions = append(rep.Decisions, reason)
 	if replaced {
 		rep.Selected = candidate
 	}
@@ -60,61 +118,189 @@ func (r *ScanReport) recordCandidate(domain string, currentSelected Certificate,
 // ScanCertificatesWithReport recursively scans the SSL directory for certificates and returns
 // a report of duplicate-certificate decisions.
 func ScanCertificatesWithReport(sslDir string) (map[string]Certificate, ScanReport, error) {
+	return ScanCertificatesWithPolicy(sslDir, SelectionPolicy{})
+}
+
+// ScanCertificatesWithPolicy is ScanCertificatesWithReport with an explicit policy for
+// choosing between certificates that cover the same domain.
+func ScanCertificatesWithPolicy(sslDir string, policy SelectionPolicy) (map[string]Certificate, ScanReport, error) {
+	return ScanCertificatesCached(sslDir, policy, nil)
+}
+
+// ScanCertificatesCached is ScanCertificatesWithPolicy that only reads files changed
+// since the scan that last used cache.
+func ScanCertificatesCached(sslDir string, policy SelectionPolicy, cache *ScanCache) (map[string]Certificate, ScanReport, error) {
 	// Convert sslDir to absolute path first
 	absSslDir, err := filepath.Abs(sslDir)
 	if err != nil {
 		return nil, ScanReport{}, fmt.Errorf("failed to get absolute path for SSL directory: %w", err)
 	}
 
-	certMap := make(map[string]Certificate)
+	pw, err := loadPasswords(absSslDir)
+	if err != nil {
+		logger.Warn("SSL scan: %v; using password sidecar files only", err)
+	}
+	manifest, err := loadManifest(absSslDir)
+	if err != nil {
+		logger.Warn("SSL scan: %v; selecting certificates automatically", err)
+	}
+	keys := &keyFiles{passwords: pw, cache: make(map[string]keyFile), index: make(map[[32]byte][]string), used: make(map[string]bool)}
+	chains := newChainChecker(absSslDir)
+	chains.cache = cache
 	report := ScanReport{}
 
-	err = filepath.Walk(absSslDir, func(path string, info os.FileInfo, err error) error {
+	// The same file can be reached through several links (certbot's live/ points into
+	// archive/); it is only considered once, under the first path walked.
+	seenFiles := make(map[string]bool)
+	// Certificates are paired with keys once every key in the tree is indexed; files
+	// that hold no certificate are classified after that.
+	var found []scannedCert
+	var others []otherFile
+
+	err = walkFilesFollowingSymlinks(absSslDir, func(path string) {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			if seenFiles[real] {
+				return
+			}
+			seenFiles[real] = true
+		}
+
+		if isPasswordFile(path) || path == filepath.Join(absSslDir, ManifestFile) {
+			return
+		}
+
+		info, err := os.Stat(path)
 		if err != nil {
-			return err
+			report.addUnused(path, fmt.Sprintf("unreadable: %v", err), nil)
+			return
 		}
-		if info.IsDir() {
-			return nil
+		if skip, reason := skipScanFile(path, info); skip {
+			if reason != "" {
+				report.addUnused(path, reason, nil)
+			}
+			return
+		}
+		content, ok := cache.get(path, info)
+		if !ok {
+			if content, err = readFileContent(path); err != nil {
+				report.addUnused(path, fmt.Sprintf("unreadable: %v", err), nil)
+				return
+			}
+			cache.put(path, info, content)
 		}
+		keys.add(path, content)
 
 		// Detect certificate files by *content*, not by filename.
-		domains, leaf, err := readCertificateDomains(path)
+		sc, err := scannedCertFrom(path, content, pw)
+		if errors.Is(err, errNotPKCS12) {
+			others = append(others, otherFile{path: path, unrecognized: content.Unrecognized})
+			return
+		}
 		if err != nil {
-			// Not a cert (or unreadable) -> ignore.
-			return nil
+			report.addUnused(path, fmt.Sprintf("PKCS#12 bundle: %v%s", err, passwordHint(path, err)), nil)
+			return
 		}
-		if leaf == nil || len(domains) == 0 {
-			return nil
+		// Intermediates and roots are collected for chain building even without a key.
+		chains.collect(path, sc.certs)
+		if sc.leaf == nil || len(sc.domains) == 0 {
+			if sc.leaf != nil && !isChainMaterial(sc.leaf) {
+				report.addUnused(path, "certificate has no DNS names or IP addresses", nil)
+			}
+			return
 		}
+		found = append(found, sc)
+	})
 
-		keyPath := ""
-		if p, ok := findMatchingPrivateKeyInDir(filepath.Dir(path), leaf); ok {
-			keyPath = p
+	if err != nil {
+		return nil, ScanReport{}, fmt.Errorf("failed to scan SSL directory: %w", err)
+	}
+	cache.finish()
+
+	pinned := resolveManifest(absSslDir, manifest, pw, keys, chains)
+	pinnedFiles := make(map[string]bool, len(pinned))
+	for _, c := range pinned {
+		pinnedFiles[c.CertPath] = true
+	}
+
+	// Best certificate per domain and key algorithm; merged into certMap below. Chains are
+	// checked before comparing, so a certificate with a broken chain loses to a trusted one.
+	now := policy.now()
+	byKeyType := make(map[string]map[string]Certificate)
+	for _, sc := range found {
+		if sc.keyPath == "" {
+			if p, decrypted, ok := keys.findMatching(sc.path, sc.leaf); ok {
+				sc.keyPath, sc.keyPEM = p, decrypted
+			}
 		}
 		// Requirement: must have a matching cert+key pair to be considered valid for TLS.
-		if keyPath == "" {
-			return nil
+		if sc.keyPath == "" {
+			if !isChainMaterial(sc.leaf) && !pinnedFiles[sc.path] {
+				report.addUnused(sc.path, "certificate without a matching private key in ssl/", sc.domains)
+			}
+			continue
 		}
 
-		candidate := Certificate{CertPath: path, KeyPath: keyPath, NotAfter: leaf.NotAfter}
+		var domains []string
+		for _, domain := range sc.domains {
+			if problem := wildcardProblem(domain); problem != "" {
+				report.Refused = append(report.Refused, NameIssue{Path: sc.path, Name: domain, Reason: problem})
+				continue
+			}
+			domains = append(domains, domain)
+		}
 
+		candidate := chains.check(sc.certificate(), now)
 		for _, domain := range domains {
-			if prev, exists := certMap[domain]; exists {
-				replaced := isBetterCertificate(prev, candidate)
-				report.recordCandidate(domain, prev, candidate, replaced)
+			if byKeyType[domain] == nil {
+				byKeyType[domain] = make(map[string]Certificate)
+			}
+			if prev, exists := byKeyType[domain][candidate.KeyType]; exists {
+				replaced, reason := policy.compare(domain, prev, candidate)
+				report.recordCandidate(domain, prev, candidate, replaced, reason)
 				if replaced {
-					certMap[domain] = candidate
+					byKeyType[domain][candidate.KeyType] = candidate
 				}
 				continue
 			}
-			certMap[domain] = candidate
+			byKeyType[domain][candidate.KeyType] = candidate
 		}
+	}
 
-		return nil
+	for _, f := range others {
+		kf := keys.read(f.path)
+		switch {
+		case kf.problem != "":
+			report.addUnused(f.path, kf.problem, nil)
+		case kf.pub != nil:
+			if !keys.used[f.path] {
+				report.addUnused(f.path, "private key without a matching certificate in ssl/", nil)
+			}
+		case f.unrecognized != "":
+			report.addUnused(f.path, f.unrecognized, nil)
+		}
+	}
+	sort.Slice(report.Unused, func(i, j int) bool { return report.Unused[i].Path < report.Unused[j].Path })
+	sort.Slice(report.Refused, func(i, j int) bool {
+		if report.Refused[i].Path != report.Refused[j].Path {
+			return report.Refused[i].Path < report.Refused[j].Path
+		}
+		return report.Refused[i].Name < report.Refused[j].Name
 	})
+	for _, u := range report.Unused {
+		logger.Debug("SSL scan: not using %s: %s", u.Path, u.Reason)
+	}
 
-	if err != nil {
-		return nil, ScanReport{}, fmt.Errorf("failed to scan SSL directory: %w", err)
+	certMap := make(map[string]Certificate, len(byKeyType))
+	for domain, certs := range byKeyType {
+		certMap[domain] = policy.combine(domain, certs, &report)
+	}
+
+	// manifest.yaml bindings override the automatic choice.
+	for domain, cert := range pinned {
+		if prev, ok := certMap[domain]; ok && prev.CertPath != cert.CertPath {
+			report.recordCandidate(domain, prev, cert, true, fmt.Sprintf("%s over %s: bound in %s", cert.CertPath, prev.CertPath, ManifestFile))
+		}
+		certMap[domain] = chains.check(cert, now)
 	}
 
 	logger.Info("SSL scan completed: %d domains have valid certificate+key pairs", len(certMap))
@@ -122,33 +308,154 @@ func ScanCertificatesWithReport(sslDir string) (map[string]Certificate, ScanRepo
 	return certMap, report, nil
 }
 
-// ScanCertificates recursively scans the SSL directory for certificates.
-func ScanCertificates(sslDir string) (map[string]Certificate, error) {
-	certs, _, err := ScanCertificatesWithReport(sslDir)
-	return certs, err
-}
+// walkFilesFollowingSymlinks calls fn for every file below root. Symlinked files and
+// directories are followed (certbot, acme.sh and cert-manager layouts use them); each
+// real directory is visited once, which also stops symlink loops.
+//
+// Symlinked files are passed first, so a file reached both ways is reported under its
+// stable name (certbot's live/<domain>/cert.pem rather than archive/<domain>/cert3.pem).
+// Files in certbot's archive/ are only reached through live/; the others are superseded
+// versions.
+func walkFilesFollowingSymlinks(root string, fn func(path string)) error {
+	visited := make(map[string]bool)
+	var linked, plain []string
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		if visited[real] {
+			logger.Debug("SSL scan: %s already scanned (via %s), skipping", dir, real)
+			return nil
+		}
+		visited[real] = true
 
-func isBetterCertificate(existing Certificate, candidate Certificate) bool {
-	// Primary rule: choose the certificate that expires latest.
-	if candidate.NotAfter.After(existing.NotAfter) {
-		return true
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			isDir := e.IsDir()
+			isLink := e.Type()&os.ModeSymlink != 0
+			if isLink {
+				info, err := os.Stat(path)
+				if err != nil {
+					logger.Warn("SSL scan: skipping broken symlink %s: %v", path, err)
+					continue
+				}
+				isDir = info.IsDir()
+			}
+			switch {
+			case isDir:
+				if err := walk(path); err != nil {
+					return err
+				}
+			case isLink:
+				linked = append(linked, path)
+			case isCertbotArchiveFile(path):
+				logger.Debug("SSL scan: skipping %s (not linked from certbot's live/)", path)
+			default:
+				plain = append(plain, path)
+			}
+		}
+		return nil
 	}
-	if existing.NotAfter.After(candidate.NotAfter) {
+	if err := walk(root); err != nil {
+		return err
+	}
+	for _, path := range linked {
+		fn(path)
+	}
+	for _, path := range plain {
+		fn(path)
+	}
+	return nil
+}
+
+// isCertbotArchiveFile reports whether path is archive/<name>/<file> next to a
+// live/<name> directory, the layout certbot keeps every issued version in.
+func isCertbotArchiveFile(path string) bool {
+	nameDir := filepath.Dir(path)
+	archiveDir := filepath.Dir(nameDir)
+	if filepath.Base(archiveDir) != "archive" {
 		return false
 	}
+	info, err := os.Stat(filepath.Join(filepath.Dir(archiveDir), "live", filepath.Base(nameDir)))
+	return err == nil && info.IsDir()
+}
+
+// scannedCert is a certificate file found in the scan, before it is paired with a key
+type scannedCert struct {
+	path    string
+	domains []string
+	leaf    *x509.Certificate
+	certs   []*x509.Certificate // every certificate in the file
+	keyPath string              // set for PKCS#12 bundles, which carry their key
+	certPEM []byte
+	keyPEM  []byte
+}
 
-	// Secondary rule: prefer pem > crt when expirations are equal.
-	existingPriority := certificatePathPriority(existing.CertPath)
-	candidatePriority := certificatePathPriority(candidate.CertPath)
-	if candidatePriority != existingPriority {
-		return candidatePriority > existingPriority
+// otherFile is a scanned file that holds no certificate
+type otherFile struct {
+	path         string
+	unrecognized string
+}
+
+// readScannedCert reads a PEM/DER certificate file or a PKCS#12 bundle. Files that are
+// neither return errNotPKCS12.
+func readScannedCert(path string, pw passwords) (scannedCert, error) {
+	content, err := readFileContent(path)
+	if err != nil {
+		return scannedCert{path: path}, err
 	}
+	return scannedCertFrom(path, content, pw)
+}
 
-	// Deterministic tie-breakers.
-	if !strings.EqualFold(candidate.CertPath, existing.CertPath) {
-		return strings.ToLower(candidate.CertPath) < strings.ToLower(existing.CertPath)
+func scannedCertFrom(path string, content fileContent, pw passwords) (scannedCert, error) {
+	sc := scannedCert{path: path}
+	if len(content.Certs) > 0 {
+		sc.certs = content.certificates()
+		if sc.leaf = pickLeafCertificate(sc.certs); sc.leaf != nil {
+			sc.domains = extractDomainsFromCert(sc.leaf)
+		}
+		return sc, nil
+	}
+	if !content.NeedsPassword {
+		return sc, errNotPKCS12
 	}
-	return strings.ToLower(candidate.KeyPath) < strings.ToLower(existing.KeyPath)
+	// PKCS#12 bundles carry the certificate and its key.
+	var err error
+	sc.domains, sc.leaf, sc.certPEM, sc.keyPEM, err = readPKCS12Bundle(path, pw)
+	if err != nil {
+		return sc, err
+	}
+	sc.certs, _ = parseCertificates(sc.certPEM)
+	sc.keyPath = path
+	return sc, nil
+}
+
+func (sc scannedCert) certificate() Certificate {
+	return Certificate{
+		CertPath:   sc.path,
+		KeyPath:    sc.keyPath,
+		NotBefore:  sc.leaf.NotBefore,
+		NotAfter:   sc.leaf.NotAfter,
+		Issuer:     sc.leaf.Issuer.String(),
+		KeyType:    keyType(sc.leaf),
+		SelfSigned: isSelfSigned(sc.leaf),
+		CertPEM:    sc.certPEM,
+		KeyPEM:     sc.keyPEM,
+		bundled:    len(sc.certs),
+	}
+}
+
+// ScanCertificates recursively scans the SSL directory for certificates.
+func ScanCertificates(sslDir string) (map[string]Certificate, error) {
+	certs, _, err := ScanCertificatesWithReport(sslDir)
+	return certs, err
 }
 
 // certificatePathPriority defines precedence among duplicate certificates when other factors are equal.
@@ -164,49 +471,6 @@ func certificatePathPriority(path string) int {
 	}
 }
 
-// FindCertificate tries exact match first, then wildcard matches (e.g. "*.example.com").
-func FindCertificate(certMap map[string]Certificate, domain string) (Certificate, bool) {
-	if certMap == nil {
-		return Certificate{}, false
-	}
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	if cert, ok := certMap[domain]; ok {
-		return cert, true
-	}
-	for pat, cert := range certMap {
-		if strings.HasPrefix(pat, "*.") {
-			suffix := pat[1:] // ".example.com"
-			if strings.HasSuffix(domain, suffix) && domain != pat[2:] {
-				return cert, true
-			}
-		}
-	}
-	return Certificate{}, false
-}
-
-func readCertificateDomains(path string) ([]string, *x509.Certificate, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	certs, err := parseCertificates(data)
-	if err != nil || len(certs) == 0 {
-		return nil, nil, fmt.Errorf("not a certificate")
-	}
-
-	leaf := pickLeafCertificate(certs)
-	if leaf == nil {
-		return nil, nil, fmt.Errorf("no leaf certificate")
-	}
-
-	domains := extractDomainsFromCert(leaf)
-	if len(domains) == 0 {
-		return nil, leaf, fmt.Errorf("no dns names")
-	}
-	return domains, leaf, nil
-}
-
 func parseCertificates(data []byte) ([]*x509.Certificate, error) {
 	// PEM path
 	var certs []*x509.Certificate
@@ -249,11 +513,13 @@ func pickLeafCertificate(certs []*x509.Certificate) *x509.Certificate {
 	return nil
 }
 
+// extractDomainsFromCert returns the DNS names, IP addresses and common name of cert,
+// normalized the way FindCertificate looks them up.
 func extractDomainsFromCert(cert *x509.Certificate) []string {
 	seen := make(map[string]struct{})
 	var out []string
 	add := func(s string) {
-		s = strings.ToLower(strings.TrimSpace(s))
+		s = normalizeName(s)
 		if s == "" {
 			return
 		}
@@ -266,50 +532,226 @@ func extractDomainsFromCert(cert *x509.Certificate) []string {
 	for _, d := range cert.DNSNames {
 		add(d)
 	}
+	for _, ip := range cert.IPAddresses {
+		add(ip.String())
+	}
 	if cert.Subject.CommonName != "" {
 		add(cert.Subject.CommonName)
 	}
 	return out
 }
 
-func findMatchingPrivateKeyInDir(dir string, cert *x509.Certificate) (string, bool) {
-	entries, err := os.ReadDir(dir)
+// errNotPKCS12 is returned by readPKCS12Bundle for files that are not bundles at all
+var errNotPKCS12 = errors.New("not a PKCS#12 bundle")
+
+// readPKCS12Bundle reads a .p12/.pfx bundle with its configured password (or none)
+func readPKCS12Bundle(path string, pw passwords) ([]string, *x509.Certificate, []byte, []byte, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return "", false
+		return nil, nil, nil, nil, err
+	}
+	if !looksLikePKCS12(data) {
+		return nil, nil, nil, nil, errNotPKCS12
 	}
 
-	certPub, err := publicKeyBytes(cert.PublicKey)
+	password, hasPassword := pw.lookup(path)
+	leaf, certPEM, keyPEM, err := readPKCS12(data, password)
 	if err != nil {
-		return "", false
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) && !hasPassword {
+			err = errPasswordRequired
+		}
+		return nil, nil, nil, nil, err
 	}
+	return extractDomainsFromCert(leaf), leaf, certPEM, keyPEM, nil
+}
 
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+// passwordHint tells where a missing password goes
+func passwordHint(path string, err error) string {
+	if !errors.Is(err, errPasswordRequired) {
+		return ""
+	}
+	return fmt.Sprintf(" (put it in %s.pass or %s)", filepath.Base(path), PasswordsFile)
+}
+
+// keyFiles reads private keys once per scan: certificates and keys can live in different
+// directories, decrypting is slow, and failures should be reported once.
+type keyFiles struct {
+	passwords passwords
+	cache     map[string]keyFile
+	index     map[[32]byte][]string // SHA-256 of the public key -> key files, in scan order
+	used      map[string]bool       // keys that matched a certificate
+}
+
+type keyFile struct {
+	pub       []byte // PKIX public key; nil when the file is not a usable key
+	decrypted []byte // PEM of a key that is stored encrypted
+	problem   string // why an encrypted key could not be used
+}
+
+// add indexes path when it holds a private key. Only encrypted keys are read again;
+// the public key of a plain key is known from content.
+func (k *keyFiles) add(path string, content fileContent) {
+	kf := keyFile{pub: content.PublicKey}
+	if content.NeedsPassword {
+		kf = k.read(path)
+	} else {
+		k.cache[path] = kf
+	}
+	if kf.pub != nil {
+		fp := sha256.Sum256(kf.pub)
+		k.index[fp] = append(k.index[fp], path)
+	}
+}
+
+func (k *keyFiles) read(path string) keyFile {
+	if kf, ok := k.cache[path]; ok {
+		return kf
+	}
+	kf := k.load(path)
+	k.cache[path] = kf
+	return kf
+}
+
+func (k *keyFiles) load(path string) keyFile {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keyFile{}
+	}
+
+	var decrypted []byte
+	if block := findEncryptedKeyBlock(data); block != nil {
+		password, ok := k.passwords.lookup(path)
+		if !ok {
+			return keyFile{problem: fmt.Sprintf("encrypted private key: %v%s", errPasswordRequired, passwordHint(path, errPasswordRequired))}
 		}
-		p := filepath.Join(dir, e.Name())
-		data, err := os.ReadFile(p)
+		der, err := decryptKeyBlock(block, password)
 		if err != nil {
-			continue
+			return keyFile{problem: fmt.Sprintf("encrypted private key: %v", err)}
 		}
-		key, err := parsePrivateKey(data)
-		if err != nil {
-			continue
+		blockType := block.Type
+		if blockType == "ENCRYPTED PRIVATE KEY" {
+			blockType = "PRIVATE KEY"
 		}
-		pub := publicKeyFromPrivate(key)
-		if pub == nil {
-			continue
+		decrypted = pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		data = decrypted
+	}
+
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return keyFile{}
+	}
+	pub := publicKeyFromPrivate(key)
+	if pub == nil {
+		return keyFile{}
+	}
+	pubBytes, err := publicKeyBytes(pub)
+	if err != nil {
+		return keyFile{}
+	}
+	return keyFile{pub: pubBytes, decrypted: decrypted}
+}
+
+// findMatching returns the indexed key file that belongs to cert, preferring one in the
+// certificate's directory, and its decrypted PEM when the file is encrypted.
+func (k *keyFiles) findMatching(certPath string, cert *x509.Certificate) (string, []byte, bool) {
+	certPub, err := publicKeyBytes(cert.PublicKey)
+	if err != nil {
+		return "", nil, false
+	}
+	paths := k.index[sha256.Sum256(certPub)]
+	if len(paths) == 0 {
+		return "", nil, false
+	}
+	best := paths[0]
+	for _, p := range paths {
+		if filepath.Dir(p) == filepath.Dir(certPath) {
+			best = p
+			break
 		}
-		keyPub, err := publicKeyBytes(pub)
-		if err != nil {
-			continue
+	}
+	k.used[best] = true
+	return best, k.cache[best].decrypted, true
+}
+
+// isChainMaterial reports whether cert is a CA certificate that is only there to build
+// chains (a root or intermediate), so it needs no key of its own.
+func isChainMaterial(cert *x509.Certificate) bool {
+	return cert.IsCA && len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0
+}
+
+// tlsFileExts are extensions of files that are meant to be certificates or keys
+var tlsFileExts = map[string]bool{
+	".pem": true, ".crt": true, ".cer": true, ".der": true, ".key": true,
+	".p12": true, ".pfx": true, ".csr": true,
+}
+
+// maxScanFileSize bounds the files the scan reads. PEM bundles are a few KB and PKCS#12
+// bundles rarely reach 100 KB; larger files are backups, archives or logs.
+const maxScanFileSize = 1 << 20
+
+// ignoredFileExts are never certificates or keys; such files are not read at all
+var ignoredFileExts = map[string]bool{
+	".md": true, ".html": true, ".json": true, ".yaml": true, ".yml": true, ".log": true,
+	".gz": true, ".tgz": true, ".zip": true, ".tar": true, ".xz": true, ".7z": true,
+	OCSPExt: true, // read with its certificate, see checkOCSP
+	".crl":  true, // client certificate revocation lists, see LoadClientCA
+}
+
+// skipScanFile reports whether the scan should not read path, and the reason to report
+// when the file looks like it was meant to be TLS material.
+func skipScanFile(path string, info os.FileInfo) (bool, string) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ignoredFileExts[ext] {
+		return true, ""
+	}
+	if info.Size() > maxScanFileSize {
+		if tlsFileExts[ext] {
+			return true, fmt.Sprintf("too large for a certificate or key (%d bytes)", info.Size())
 		}
-		if bytes.Equal(certPub, keyPub) {
-			return p, true
+		logger.Debug("SSL scan: skipping %s (%d bytes)", path, info.Size())
+		return true, ""
+	}
+	return false, ""
+}
+
+// unrecognizedFileReason explains why a file that holds neither a certificate nor a
+// usable key was skipped; empty for files that are not TLS material (e.g. README.md).
+func unrecognizedFileReason(path string, data []byte) string {
+	if block, _ := pem.Decode(data); block != nil {
+		switch {
+		case strings.HasSuffix(block.Type, "CERTIFICATE REQUEST"):
+			return "certificate signing request, not a certificate (the CA returns the certificate)"
+		case block.Type == "CERTIFICATE":
+			return "certificate could not be parsed"
+		case strings.Contains(block.Type, "PRIVATE KEY"):
+			return "private key could not be parsed (unsupported key type?)"
+		case block.Type == "X509 CRL":
+			return "" // client_auth revocation list
 		}
+		return fmt.Sprintf("unsupported PEM block %q", block.Type)
 	}
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		return "malformed PEM data"
+	}
+	if tlsFileExts[strings.ToLower(filepath.Ext(path))] {
+		return "not a certificate, private key or PKCS#12 bundle"
+	}
+	return ""
+}
 
-	return "", false
+// findEncryptedKeyBlock returns the first passphrase-protected key block in data
+func findEncryptedKeyBlock(data []byte) *pem.Block {
+	rest := data
+	for {
+		block, r := pem.Decode(rest)
+		if block == nil {
+			return nil
+		}
+		rest = r
+		if strings.Contains(block.Type, "PRIVATE KEY") && isEncryptedKeyBlock(block) {
+			return block
+		}
+	}
 }
 
 func parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
@@ -7,8 +7,10 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -51,9 +53,16 @@ func writeSelfSignedCertAndKeyNamedWithNotAfter(t *testing.T, dir, certName, key
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageServerAuth,
 		},
-		DNSNames:              dnsNames,
 		BasicConstraintsValid: true,
 	}
+	// IP addresses in dnsNames become IP SANs.
+	for _, name := range dnsNames {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			continue
+		}
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
 
 	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
 	if err != nil {
@@ -198,4 +207,185 @@ func TestFindCertificateWildcard(t *testing.T) {
 	if _, ok := FindCertificate(certMap, "example.com"); ok {
 		t.Fatal("did not expect wildcard to match apex domain")
 	}
+	if _, ok := FindCertificate(certMap, "a.b.example.com"); ok {
+		t.Fatal("did not expect wildcard to match more than one label")
+	}
+}
+
+func TestScanCertificates_FollowsSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	sslDir := filepath.Join(tmpDir, "ssl")
+
+	// certbot layout: live/<domain>/ links into archive/<domain>/
+	archiveDir := filepath.Join(sslDir, "letsencrypt", "archive", "example.com")
+	writeSelfSignedCertAndKeyNamed(t, archiveDir, "fullchain1.pem", "privkey1.pem", []string{"example.com"})
+	// Superseded version certbot keeps in archive/
+	writeSelfSignedCertAndKeyNamed(t, archiveDir, "fullchain0.pem", "privkey0.pem", []string{"example.com"})
+	liveDir := filepath.Join(sslDir, "letsencrypt", "live", "example.com")
+	if err := os.MkdirAll(liveDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"fullchain.pem": "../../archive/example.com/fullchain1.pem",
+		"privkey.pem":   "../../archive/example.com/privkey1.pem",
+	} {
+		if err := os.Symlink(target, filepath.Join(liveDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Directory mounted from outside the SSL directory
+	outside := filepath.Join(tmpDir, "outside")
+	writeSelfSignedCertAndKey(t, outside, []string{"mounted.example.com"})
+	if err := os.Symlink(outside, filepath.Join(sslDir, "mounted")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loop back to the SSL directory and a dangling link must not break the scan
+	if err := os.Symlink("..", filepath.Join(sslDir, "letsencrypt", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing.pem", filepath.Join(sslDir, "dangling.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	certMap, report, err := ScanCertificatesWithReport(sslDir)
+	if err != nil {
+		t.Fatalf("ScanCertificatesWithReport failed: %v", err)
+	}
+	if cert, ok := certMap["example.com"]; !ok || cert.CertPath != filepath.Join(liveDir, "fullchain.pem") || cert.KeyPath != filepath.Join(liveDir, "privkey.pem") {
+		t.Errorf("expected example.com from certbot's live/ paths, got %v", certMap)
+	}
+	for _, u := range report.Unused {
+		if strings.Contains(u.Path, "archive") {
+			t.Errorf("superseded archive version reported: %v", u)
+		}
+	}
+	if cert, ok := certMap["mounted.example.com"]; !ok || !strings.HasPrefix(cert.CertPath, filepath.Join(sslDir, "mounted")) {
+		t.Errorf("expected mounted.example.com under the symlinked directory, got %v", certMap)
+	}
+	if _, ok := report.Multiple["example.com"]; ok {
+		t.Errorf("the same file reached through a symlink must not count as a duplicate")
+	}
+}
+
+func TestScanCertificatesWithReport_UnusedFiles(t *testing.T) {
+	root := t.TempDir()
+	ca := newTestCA(t, "Unused Test CA")
+
+	// Served pair and chain material: not reported.
+	writeTestLeaf(t, filepath.Join(root, "ok"), "site", "ok.example.com", testLeaf{ca: &ca})
+	writeFile(t, filepath.Join(root, "ok", "ca.pem"), pemOf(ca.cert))
+	writeFile(t, filepath.Join(root, "README.md"), "notes\n")
+
+	// Certificate without its key, and a key without its certificate.
+	orphan := writeTestLeaf(t, filepath.Join(root, "certs"), "site", "orphan.example.com", testLeaf{})
+	if err := os.Remove(filepath.Join(root, "certs", "site.key")); err != nil {
+		t.Fatalf("remove key: %v", err)
+	}
+	if err := os.Remove(writeTestLeaf(t, filepath.Join(root, "private"), "site", "gone.example.com", testLeaf{})); err != nil {
+		t.Fatalf("remove cert: %v", err)
+	}
+	orphanKey := filepath.Join(root, "private", "site.key")
+
+	// Encrypted key without a password.
+	encrypted := filepath.Join(root, "enc", "site.key")
+	writeFile(t, encrypted, opensslEncryptedKey)
+
+	csr := filepath.Join(root, "req.csr")
+	writeFile(t, csr, "-----BEGIN CERTIFICATE REQUEST-----\nAAAA\n-----END CERTIFICATE REQUEST-----\n")
+	garbage := filepath.Join(root, "broken.crt")
+	writeFile(t, garbage, "not a certificate\n")
+
+	_, report, err := ScanCertificatesWithReport(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	want := map[string]string{
+		orphan:    "without a matching private key",
+		orphanKey: "private key without a matching certificate",
+		encrypted: "no password is configured",
+		csr:       "certificate signing request",
+		garbage:   "not a certificate, private key or PKCS#12 bundle",
+	}
+	if len(report.Unused) != len(want) {
+		t.Fatalf("expected %d unused files, got %+v", len(want), report.Unused)
+	}
+	for i, u := range report.Unused {
+		if i > 0 && report.Unused[i-1].Path > u.Path {
+			t.Errorf("unused files not sorted by path: %+v", report.Unused)
+		}
+		reason, ok := want[u.Path]
+		if !ok {
+			t.Errorf("unexpected unused file %s: %s", u.Path, u.Reason)
+			continue
+		}
+		if !strings.Contains(u.Reason, reason) {
+			t.Errorf("%s: expected reason containing %q, got %q", u.Path, reason, u.Reason)
+		}
+	}
+	for _, u := range report.Unused {
+		if u.Path == orphan && (len(u.Domains) != 1 || u.Domains[0] != "orphan.example.com") {
+			t.Errorf("expected domains of the orphan certificate, got %v", u.Domains)
+		}
+	}
+}
+
+func TestScanCertificates_KeysInOtherDirectories(t *testing.T) {
+	root := t.TempDir()
+
+	// certs/ and private/ layout written by secrets tooling.
+	certPath := writeTestLeaf(t, filepath.Join(root, "certs"), "site", "split.example.com", testLeaf{ecdsa: true})
+	if err := os.MkdirAll(filepath.Join(root, "private"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	keyPath := filepath.Join(root, "private", "site.key")
+	if err := os.Rename(filepath.Join(root, "certs", "site.key"), keyPath); err != nil {
+		t.Fatalf("move key: %v", err)
+	}
+
+	// A copy of the key next to the certificate wins over one elsewhere.
+	samePath := writeTestLeaf(t, filepath.Join(root, "same"), "site", "same.example.com", testLeaf{ecdsa: true})
+	data, err := os.ReadFile(filepath.Join(root, "same", "site.key"))
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	writeFile(t, filepath.Join(root, "aaa", "copy.key"), string(data))
+
+	certMap, report, err := ScanCertificatesWithReport(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if cert := certMap["split.example.com"]; cert.CertPath != certPath || cert.KeyPath != keyPath {
+		t.Fatalf("expected key from private/, got %+v", cert)
+	}
+	if cert := certMap["same.example.com"]; cert.CertPath != samePath || cert.KeyPath != filepath.Join(root, "same", "site.key") {
+		t.Fatalf("expected the key in the certificate's directory, got %+v", cert)
+	}
+	for _, u := range report.Unused {
+		if u.Path == keyPath {
+			t.Fatalf("matched key reported as unused: %+v", u)
+		}
+	}
+}
+
+func TestScanCertificates_IPAddresses(t *testing.T) {
+	root := t.TempDir()
+	certPath, _ := writeSelfSignedCertAndKey(t, root, []string{"nas.lan", "192.168.50.2", "2001:DB8::0:1"})
+
+	certMap, err := ScanCertificates(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	for _, name := range []string{"nas.lan", "192.168.50.2", "2001:db8::1", "2001:DB8:0::1"} {
+		cert, ok := FindCertificate(certMap, name)
+		if !ok || cert.CertPath != certPath {
+			t.Fatalf("%s: expected %s, got %+v (ok=%v)", name, certPath, cert, ok)
+		}
+	}
+	// An IP is never covered by a wildcard.
+	if _, ok := FindCertificate(map[string]Certificate{"*.168.50.2": {}}, "192.168.50.2"); ok {
+		t.Fatal("did not expect a wildcard to match an IP address")
+	}
 }
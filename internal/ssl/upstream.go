@@ -0,0 +1,41 @@
+package ssl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LoadTrustedCertificates reads the certificates an upstream is verified against (PEM or
+// DER), encoded for nginx. A self-signed backend certificate may be trusted directly.
+func LoadTrustedCertificates(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s holds no certificate", path)
+	}
+	return encodeCertificates(certs), nil
+}
+
+// LoadKeyPair reads a certificate and its key named explicitly, relative to the SSL
+// directory, the way manifest.yaml bindings are read: PKCS#12 bundles and encrypted keys
+// are opened with the passwords of the SSL directory, and keyPath may be empty for a
+// bundle. Converted material is returned in CertPEM and KeyPEM.
+//
+// The key is not searched for in the SSL directory, so keyPath is required otherwise.
+func LoadKeyPair(sslDir, certPath, keyPath string) (Certificate, error) {
+	absSslDir, err := filepath.Abs(sslDir)
+	if err != nil {
+		return Certificate{}, err
+	}
+	pw, err := loadPasswords(absSslDir)
+	if err != nil {
+		return Certificate{}, err
+	}
+	keys := &keyFiles{passwords: pw, cache: make(map[string]keyFile), index: make(map[[32]byte][]string), used: make(map[string]bool)}
+	cert, _, err := resolveManifestEntry(absSslDir, manifestEntry{Cert: certPath, Key: keyPath}, pw, keys, newChainChecker(absSslDir))
+	return cert, err
+}
@@ -0,0 +1,46 @@
+package ssl
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certPath := writeTestLeaf(t, filepath.Join(dir, "backends"), "client", "sslly.example.com", testLeaf{ecdsa: true})
+
+	got, err := LoadKeyPair(dir, "backends/client.pem", "backends/client.key")
+	if err != nil {
+		t.Fatalf("LoadKeyPair: %v", err)
+	}
+	if got.CertPath != certPath || got.KeyPath != filepath.Join(dir, "backends", "client.key") || got.KeyType != "ecdsa" {
+		t.Fatalf("unexpected pair: %+v", got)
+	}
+
+	other := writeTestLeaf(t, dir, "other", "other.example.com", testLeaf{ecdsa: true})
+	for _, tt := range []struct {
+		name, cert, key, want string
+	}{
+		{"key of another certificate", "backends/client.pem", strings.TrimSuffix(other, ".pem") + ".key", "does not match"},
+		{"no key", "backends/client.pem", "", "no private key"},
+		{"missing certificate", "backends/missing.pem", "backends/client.key", "no such file"},
+	} {
+		if _, err := LoadKeyPair(dir, tt.cert, tt.key); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadTrustedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	// A self-signed backend certificate can be trusted directly.
+	certPath := writeTestLeaf(t, dir, "backend", "backend.internal", testLeaf{ecdsa: true})
+	data, err := LoadTrustedCertificates(certPath)
+	if err != nil || !strings.HasPrefix(string(data), "-----BEGIN CERTIFICATE-----") {
+		t.Fatalf("LoadTrustedCertificates = %q, %v", data, err)
+	}
+	if _, err := LoadTrustedCertificates(filepath.Join(dir, "backend.key")); err == nil || !strings.Contains(err.Error(), "holds no certificate") {
+		t.Fatalf("expected an error for a key file, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package ssl
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// FindCertificate returns the certificate for domain, which may also be an IP address.
+// An exact name wins over a wildcard, and a wildcard covers exactly one label (RFC 6125):
+// "*.example.com" covers "a.example.com" but neither "example.com" nor "a.b.example.com".
+func FindCertificate(certMap map[string]Certificate, domain string) (Certificate, bool) {
+	if certMap == nil {
+		return Certificate{}, false
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if cert, ok := certMap[domain]; ok {
+		return cert, true
+	}
+	if ip := normalizeName(domain); ip != domain {
+		// Scanned IP addresses are keyed in canonical form.
+		cert, ok := certMap[ip]
+		return cert, ok
+	}
+	if pattern := wildcardFor(domain); pattern != "" {
+		if cert, ok := certMap[pattern]; ok {
+			return cert, true
+		}
+	}
+	return Certificate{}, false
+}
+
+// FindRefusedWildcard returns the most specific wildcard in certMap that ends like
+// domain but would have to cover more than one label, which TLS clients refuse. Use it
+// to explain why FindCertificate found nothing.
+func FindRefusedWildcard(certMap map[string]Certificate, domain string) (string, Certificate, bool) {
+	domain = normalizeName(domain)
+	if net.ParseIP(domain) != nil {
+		return "", Certificate{}, false
+	}
+	var patterns []string
+	for pattern := range certMap {
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(domain, pattern[1:]) && pattern != wildcardFor(domain) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return "", Certificate{}, false
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns[0], certMap[patterns[0]], true
+}
+
+// WildcardPattern returns the only wildcard pattern of the config files (certs.yaml,
+// tls.yaml, localca.yaml) that covers domain: "*." and its parent, so a pattern covers
+// exactly one label, as in certificates ("*.example.com" for "a.example.com", "*.lan"
+// for "printer.lan"). Empty for IP addresses and names without a parent.
+func WildcardPattern(domain string) string {
+	i := strings.IndexByte(domain, '.')
+	if i <= 0 || i == len(domain)-1 || strings.HasPrefix(domain, "*") || net.ParseIP(domain) != nil {
+		return ""
+	}
+	return "*" + domain[i:]
+}
+
+// wildcardFor returns the only wildcard name that can cover domain ("*.example.com"
+// for "a.example.com"); empty when no wildcard may cover it.
+func wildcardFor(domain string) string {
+	pattern := WildcardPattern(domain)
+	if pattern == "" || wildcardProblem(pattern) != "" {
+		return ""
+	}
+	return pattern
+}
+
+// wildcardProblem explains why clients refuse a certificate name with a wildcard;
+// empty for plain names and valid wildcards.
+func wildcardProblem(name string) string {
+	if !strings.Contains(name, "*") {
+		return ""
+	}
+	if !strings.HasPrefix(name, "*.") || strings.Count(name, "*") > 1 {
+		return "wildcard must be the whole left-most label"
+	}
+	if !strings.Contains(name[2:], ".") {
+		return "wildcard covers a whole top-level domain"
+	}
+	return ""
+}
+
+// normalizeName lower-cases a name and writes IP addresses in canonical form, so
+// "2001:DB8::0:1" and "2001:db8::1" are the same key.
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String()
+	}
+	return name
+}
@@ -0,0 +1,106 @@
+package ssl
+
+import (
+	"testing"
+)
+
+func TestFindCertificate_MostSpecificWins(t *testing.T) {
+	certMap := map[string]Certificate{
+		"*.example.com":     {CertPath: "/ssl/wild.pem"},
+		"*.b.example.com":   {CertPath: "/ssl/b-wild.pem"},
+		"api.b.example.com": {CertPath: "/ssl/api.pem"},
+	}
+	cases := map[string]string{
+		"api.b.example.com": "/ssl/api.pem",
+		"x.b.example.com":   "/ssl/b-wild.pem",
+		"b.example.com":     "/ssl/wild.pem",
+		"A.Example.com":     "/ssl/wild.pem",
+		"x.y.b.example.com": "",
+	}
+	for domain, want := range cases {
+		// Repeat: map iteration order must not matter.
+		for i := 0; i < 20; i++ {
+			cert, ok := FindCertificate(certMap, domain)
+			if want == "" {
+				if ok {
+					t.Fatalf("%s: expected no match, got %s", domain, cert.CertPath)
+				}
+				continue
+			}
+			if !ok || cert.CertPath != want {
+				t.Fatalf("%s: expected %s, got %s (ok=%v)", domain, want, cert.CertPath, ok)
+			}
+		}
+	}
+}
+
+func TestFindRefusedWildcard(t *testing.T) {
+	certMap := map[string]Certificate{
+		"*.example.com":   {CertPath: "/ssl/wild.pem"},
+		"*.b.example.com": {CertPath: "/ssl/b-wild.pem"},
+	}
+	pattern, cert, ok := FindRefusedWildcard(certMap, "x.y.b.example.com")
+	if !ok || pattern != "*.b.example.com" || cert.CertPath != "/ssl/b-wild.pem" {
+		t.Fatalf("expected the most specific refused wildcard, got %q %+v", pattern, cert)
+	}
+	if _, _, ok := FindRefusedWildcard(certMap, "a.example.com"); ok {
+		t.Fatal("a covered name is not a refused match")
+	}
+	if _, _, ok := FindRefusedWildcard(certMap, "example.org"); ok {
+		t.Fatal("unrelated names have no refused match")
+	}
+}
+
+func TestWildcardProblem(t *testing.T) {
+	cases := map[string]bool{
+		"example.com":       false,
+		"*.example.com":     false,
+		"*.lan.example.com": false,
+		"*.com":             true,
+		"a*.example.com":    true,
+		"a.*.example.com":   true,
+		"*.*.example.com":   true,
+		"*":                 true,
+	}
+	for name, refused := range cases {
+		if got := wildcardProblem(name) != ""; got != refused {
+			t.Errorf("%s: expected refused=%v, got %q", name, refused, wildcardProblem(name))
+		}
+	}
+}
+
+func TestWildcardPattern(t *testing.T) {
+	cases := map[string]string{
+		"a.example.com":   "*.example.com",
+		"a.b.example.com": "*.b.example.com",
+		"printer.lan":     "*.lan", // allowed as a config pattern, unlike as a certificate name
+		"example":         "",
+		"lan.":            "",
+		"*.example.com":   "",
+		"192.168.1.10":    "",
+	}
+	for domain, want := range cases {
+		if got := WildcardPattern(domain); got != want {
+			t.Errorf("WildcardPattern(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestScanCertificates_RefusesInvalidWildcards(t *testing.T) {
+	root := t.TempDir()
+	certPath, _ := writeSelfSignedCertAndKey(t, root, []string{"ok.example.com", "*.com", "a*.example.com"})
+
+	certMap, report, err := ScanCertificatesWithReport(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if _, ok := certMap["ok.example.com"]; !ok {
+		t.Fatalf("expected the valid name to be served, got %v", certMap)
+	}
+	if _, ok := certMap["*.com"]; ok {
+		t.Fatal("did not expect a top-level wildcard to be served")
+	}
+	if len(report.Refused) != 2 || report.Refused[0].Name != "*.com" || report.Refused[1].Name != "a*.example.com" || report.Refused[0].Path != certPath {
+		t.Fatalf("unexpected refused names: %+v", report.Refused)
+	}
+}
@@ -63,23 +63,49 @@ func New(dir string) (*Watcher, error) {
 }
 
 func (w *Watcher) addRecursive(dir string) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			if shouldSkipWatchDir(path) {
-				return filepath.SkipDir
-			}
-			if err := w.addWatchDir(path); err != nil {
-				return err
-			}
-			// logger.Info("Watching directory: %s", path)
-		}
+	return w.addRecursiveFollowingSymlinks(dir, make(map[string]bool))
+}
 
+// addRecursiveFollowingSymlinks also watches symlinked directories (e.g. a mounted
+// /etc/letsencrypt); a real directory already seen in this walk is not entered again,
+// which stops symlink loops.
+func (w *Watcher) addRecursiveFollowingSymlinks(dir string, visited map[string]bool) error {
+	if shouldSkipWatchDir(dir) {
 		return nil
-	})
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return nil
+	}
+	visited[real] = true
+
+	if err := w.addWatchDir(dir); err != nil {
+		return err
+	}
+	// logger.Info("Watching directory: %s", dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		isDir := e.IsDir()
+		if e.Type()&os.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			isDir = err == nil && info.IsDir()
+		}
+		if !isDir {
+			continue
+		}
+		if err := w.addRecursiveFollowingSymlinks(path, visited); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (w *Watcher) maybeAddNewDirWatches(event fsnotify.Event) {
@@ -147,7 +173,7 @@ func shouldSkipWatchDir(path string) bool {
 
 	// Ignore internal runtime/backup folders to avoid feedback loops and excessive watches.
 	// We match by path segment so nested snapshots are also excluded.
-	ignoredSegments := []string{"/.sslly-backups/", "/.sslly-runtime/", "/.git/"}
+	ignoredSegments := []string{"/.sslly-backups/", "/.sslly-runtime/", "/.sslly-ca/", "/.git/"}
 	for _, seg := range ignoredSegments {
 		if strings.Contains(p, seg) {
 			return true
@@ -156,5 +182,5 @@ func shouldSkipWatchDir(path string) bool {
 
 	// Also ignore the directory itself if it ends with those names (walk may call with no trailing slash).
 	base := filepath.Base(p)
-	return base == ".sslly-backups" || base == ".sslly-runtime" || base == ".git"
+	return base == ".sslly-backups" || base == ".sslly-runtime" || base == ".sslly-ca" || base == ".git"
 }
@@ -107,6 +107,39 @@ func TestWatcher_AddsNewDirectoriesRecursively(t *testing.T) {
 	}
 }
 
+func TestWatcher_FollowsSymlinkedDirectories(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "ssl")
+	outside := filepath.Join(tmp, "letsencrypt", "live")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatalf("mkdir outside: %v", err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("mkdir root: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "letsencrypt"), filepath.Join(root, "letsencrypt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	// A loop back to the root must not hang New.
+	if err := os.Symlink(root, filepath.Join(outside, "loop")); err != nil {
+		t.Fatalf("symlink loop: %v", err)
+	}
+
+	w, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer w.Stop()
+
+	linkedFile := filepath.Join(root, "letsencrypt", "live", "fullchain.pem")
+	if err := os.WriteFile(linkedFile, []byte("dummy cert"), 0644); err != nil {
+		t.Fatalf("write linked file: %v", err)
+	}
+	if err := waitForEventOnPath(w.Events, w.Errors, linkedFile, 2*time.Second); err != nil {
+		t.Fatalf("expected event for %s: %v", linkedFile, err)
+	}
+}
+
 func TestWatcher_DeleteEventInNewNestedDirectory(t *testing.T) {
 	tmp := t.TempDir()
 